@@ -0,0 +1,172 @@
+package main
+
+import (
+	clist "container/list"
+	"sync"
+)
+
+const (
+	// the memory cost of a cached needle except the data
+	hotCacheItemSize = 128
+	// the needle larger than 1/hotCacheMaxRatio of cache size isn't cached,
+	// so a few big needles won't evict all the others
+	hotCacheMaxRatio = 8
+)
+
+// hotItem a cached needle data, it's valid only if the needle cache of key
+// is still nc and the volume is still gen, so a stale item is never returned
+// even if it's set after the needle overwritten or the volume replaced.
+type hotItem struct {
+	vid    int32
+	gen    uint64
+	key    int64
+	nc     NeedleCache
+	cookie int64
+	enc    NeedleEncoding
+	data   []byte
+}
+
+// HotCache the store lru cache of recently read needle data, shared by all
+// the volumes, size is the bytes budget, a nil cache is disabled.
+type HotCache struct {
+	lock    sync.Mutex
+	size    int64
+	used    int64
+	lru     *clist.List
+	volumes map[int32]map[int64]*clist.Element
+	// the min valid generation of volumes
+	gens map[int32]uint64
+}
+
+// NewHotCache new a hot cache of size bytes, nil if size is zero.
+func NewHotCache(size int64) (c *HotCache) {
+	if size <= 0 {
+		return
+	}
+	c = &HotCache{size: size}
+	c.lru = clist.New()
+	c.volumes = make(map[int32]map[int64]*clist.Element)
+	c.gens = make(map[int32]uint64)
+	return
+}
+
+// Get copy the cached needle data of key into buf, gen is the volume
+// generation, nc is the current needle cache of key, the data is encoded by
+// enc.
+func (c *HotCache) Get(vid int32, gen uint64, key int64, nc NeedleCache, buf []byte) (cookie int64, enc NeedleEncoding, data []byte, ok bool) {
+	var (
+		e    *clist.Element
+		item *hotItem
+	)
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	if e, ok = c.volumes[vid][key]; ok {
+		if item = e.Value.(*hotItem); item.nc == nc && item.gen == gen {
+			c.lru.MoveToFront(e)
+			cookie, enc, data = item.cookie, item.enc, buf[:len(item.data)]
+			copy(data, item.data)
+		} else {
+			ok = false
+		}
+	}
+	c.lock.Unlock()
+	if ok {
+		metricStoreCacheHits.Inc()
+	} else {
+		metricStoreCacheMisses.Inc()
+	}
+	return
+}
+
+// Set cache a copy of the needle data of key, gen is the volume generation
+// and nc is the needle cache which the data read from, the data is cached
+// encoded, it's dropped if the volume generation is deleted.
+func (c *HotCache) Set(vid int32, gen uint64, key int64, nc NeedleCache, cookie int64, enc NeedleEncoding, data []byte) {
+	var (
+		ok     bool
+		e      *clist.Element
+		item   *hotItem
+		needle map[int64]*clist.Element
+	)
+	if c == nil || int64(len(data)) > c.size/hotCacheMaxRatio {
+		return
+	}
+	item = &hotItem{vid: vid, gen: gen, key: key, nc: nc, cookie: cookie, enc: enc, data: make([]byte, len(data))}
+	copy(item.data, data)
+	c.lock.Lock()
+	// a late set of the replaced volume reader
+	if gen < c.gens[vid] {
+		c.lock.Unlock()
+		return
+	}
+	if needle, ok = c.volumes[vid]; !ok {
+		needle = make(map[int64]*clist.Element)
+		c.volumes[vid] = needle
+	}
+	if e, ok = needle[key]; ok {
+		c.remove(e)
+	}
+	needle[key] = c.lru.PushFront(item)
+	c.used += int64(len(item.data)) + hotCacheItemSize
+	for c.used > c.size {
+		c.remove(c.lru.Back())
+		metricStoreCacheEvictions.Inc()
+	}
+	metricStoreCacheBytes.Set(float64(c.used))
+	c.lock.Unlock()
+}
+
+// Del remove the cached needle data of key.
+func (c *HotCache) Del(vid int32, key int64) {
+	var (
+		ok bool
+		e  *clist.Element
+	)
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	if e, ok = c.volumes[vid][key]; ok {
+		c.remove(e)
+		metricStoreCacheBytes.Set(float64(c.used))
+	}
+	c.lock.Unlock()
+}
+
+// DelVolume remove all the cached needle data of the volume, the later sets
+// of the volume generations less than gen are dropped.
+func (c *HotCache) DelVolume(vid int32, gen uint64) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	for _, e := range c.volumes[vid] {
+		c.remove(e)
+	}
+	delete(c.volumes, vid)
+	if gen > c.gens[vid] {
+		c.gens[vid] = gen
+	}
+	metricStoreCacheBytes.Set(float64(c.used))
+	c.lock.Unlock()
+}
+
+// remove remove a cached item, must called with lock.
+func (c *HotCache) remove(e *clist.Element) {
+	var item = c.lru.Remove(e).(*hotItem)
+	delete(c.volumes[item.vid], item.key)
+	c.used -= int64(len(item.data)) + hotCacheItemSize
+}
+
+// Used get the cached bytes.
+func (c *HotCache) Used() (used int64) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	used = c.used
+	c.lock.Unlock()
+	return
+}
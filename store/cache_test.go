@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestHotCache(t *testing.T) {
+	var (
+		ok     bool
+		err    error
+		cookie int64
+		data   []byte
+		buf    = make([]byte, 1024)
+		nc     = NewNeedleCache(1, 64)
+		c      = NewHotCache(10 * (64 + hotCacheItemSize))
+	)
+	if NewHotCache(0) != nil {
+		err = fmt.Errorf("NewHotCache(0) not disabled")
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Set")
+	c.Set(1, 1, 1, nc, 2, NeedleEncodingNone, bytes.Repeat([]byte{1}, 64))
+	if cookie, _, data, ok = c.Get(1, 1, 1, nc, buf); !ok || cookie != 2 || !bytes.Equal(data, bytes.Repeat([]byte{1}, 64)) {
+		err = fmt.Errorf("Get() not match")
+		t.Error(err)
+		goto failed
+	}
+	// the needle overwritten
+	if _, _, _, ok = c.Get(1, 1, 1, NewNeedleCache(2, 64), buf); ok {
+		err = fmt.Errorf("Get() stale needle")
+		t.Error(err)
+		goto failed
+	}
+	t.Log("evict")
+	for key := int64(2); key <= 10; key++ {
+		c.Set(1, 1, key, nc, key, NeedleEncodingNone, make([]byte, 64))
+	}
+	// key 1 is the most recently used
+	c.Get(1, 1, 1, nc, buf)
+	c.Set(2, 1, 1, nc, 1, NeedleEncodingNone, make([]byte, 64))
+	if _, _, _, ok = c.Get(1, 1, 2, nc, buf); ok {
+		err = fmt.Errorf("Get() key 2 not evicted")
+		t.Error(err)
+		goto failed
+	}
+	if _, _, _, ok = c.Get(1, 1, 1, nc, buf); !ok {
+		err = fmt.Errorf("Get() key 1 evicted")
+		t.Error(err)
+		goto failed
+	}
+	// too big
+	c.Set(1, 1, 11, nc, 11, NeedleEncodingNone, make([]byte, 1024))
+	if _, _, _, ok = c.Get(1, 1, 11, nc, buf); ok {
+		err = fmt.Errorf("Get() big needle cached")
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Del")
+	c.Del(1, 1)
+	if _, _, _, ok = c.Get(1, 1, 1, nc, buf); ok {
+		err = fmt.Errorf("Get() deleted needle")
+		t.Error(err)
+		goto failed
+	}
+	t.Log("DelVolume")
+	c.DelVolume(1, 2)
+	if c.Used() != 64+hotCacheItemSize {
+		err = fmt.Errorf("Used(): %d not match", c.Used())
+		t.Error(err)
+		goto failed
+	}
+	// a late set of the replaced volume
+	c.Set(1, 1, 1, nc, 2, NeedleEncodingNone, make([]byte, 64))
+	if c.Used() != 64+hotCacheItemSize {
+		err = fmt.Errorf("Set() stale volume cached")
+		t.Error(err)
+		goto failed
+	}
+	c.Set(1, 2, 1, nc, 2, NeedleEncodingNone, make([]byte, 64))
+	if _, _, _, ok = c.Get(1, 1, 1, nc, buf); ok {
+		err = fmt.Errorf("Get() stale volume")
+		t.Error(err)
+		goto failed
+	}
+	if _, _, _, ok = c.Get(1, 2, 1, nc, buf); !ok {
+		err = fmt.Errorf("Get() volume generation 2 not cached")
+		t.Error(err)
+		goto failed
+	}
+failed:
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestVolumeHotCache(t *testing.T) {
+	var (
+		v     *Volume
+		err   error
+		data  []byte
+		buf   = make([]byte, 1024)
+		bfile = "./test/test.cache"
+		ifile = "./test/test.cache.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	if v, err = NewVolume(1, bfile, ifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	v.cache = NewHotCache(1024 * 1024)
+	if err = v.Add(1, 1, []byte("test1")); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	// miss then hit
+	for i := 0; i < 2; i++ {
+		if data, err = v.Get(1, 1, buf); err != nil || string(data) != "test1" {
+			err = fmt.Errorf("Get() data: %s error(%v)", data, err)
+			t.Error(err)
+			goto failed
+		}
+	}
+	if _, err = v.Get(1, 2, buf); err != ErrNeedleCookie {
+		err = fmt.Errorf("Get() cookie error(%v)", err)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("overwrite")
+	if err = v.Add(1, 1, []byte("test2")); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if data, err = v.Get(1, 1, buf); err != nil || string(data) != "test2" {
+		err = fmt.Errorf("Get() data: %s error(%v)", data, err)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Del")
+	if err = v.Del(1); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	if _, err = v.Get(1, 1, buf); err != ErrNeedleDeleted {
+		err = fmt.Errorf("Get() deleted error(%v)", err)
+		t.Error(err)
+		goto failed
+	}
+	err = nil
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
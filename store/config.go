@@ -5,13 +5,34 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
+	"time"
 )
 
 type Config struct {
 	Index string   `yaml: index`
 	ZK    []string `yaml:",flow"`
-	file  string
-	f     *os.File
+	Dirs  []string `yaml:"dirs,flow"`
+	Http  string   `yaml:"http"`
+	// slow op log threshold, nil keep the default, 0 disable
+	SlowLog *time.Duration `yaml:"slowlog"`
+	// hot needle cache bytes, 0 disable
+	CacheSize int64 `yaml:"cache_size"`
+	// the encryption keys, see KeyFile
+	KeyFile string `yaml:"key_file"`
+	// volume
+	Volume      VolumeOptions `yaml:"volume"`
+	FreeVolumes int           `yaml:"free_volumes"`
+	// the read only erasure code volumes
+	Erasure []EcVolumeConfig `yaml:"erasure"`
+	file    string
+	f       *os.File
+}
+
+// EcVolumeConfig an erasure code volume, the shard files are in order, data
+// shards first.
+type EcVolumeConfig struct {
+	Id     int32    `yaml:"id"`
+	Shards []string `yaml:"shards,flow"`
 }
 
 func NewConfig(file string) (c *Config, err error) {
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	log "github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+	"hash"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// the sealed needle data: nonce + ciphertext + tag
+	cryptNonceSize = 12
+	cryptTagSize   = 16
+	cryptOverhead  = cryptNonceSize + cryptTagSize
+	// the additional data: key id + needle key + cookie
+	cryptAADSize = 18
+	// no encryption
+	cryptNoKey = uint16(0)
+)
+
+var (
+	// the label of the key derived for the needle data sums
+	cryptSumLabel = []byte("bfs needle sum")
+)
+
+// KeyProvider the data encryption keys, a volume records the id of its key
+// in the super block header, so a key must be kept until no volume use it,
+// rotate the key by compress the volumes after the current key changed.
+type KeyProvider interface {
+	// Key get the aes key (16, 24 or 32 bytes) of id.
+	Key(id uint16) ([]byte, error)
+	// Current get the key id used by the new volumes.
+	Current() uint16
+}
+
+// KeyFile the keys loaded from a local yaml file, the keys are hex encoded.
+//
+//	current: 2
+//	keys:
+//	  1: 000102...1f
+//	  2: 202122...3f
+type KeyFile struct {
+	Cur  uint16            `yaml:"current"`
+	Keys map[uint16]string `yaml:"keys"`
+	keys map[uint16][]byte
+}
+
+// NewKeyFile load the keys from file.
+func NewKeyFile(file string) (k *KeyFile, err error) {
+	var (
+		id   uint16
+		s    string
+		key  []byte
+		data []byte
+	)
+	if data, err = ioutil.ReadFile(file); err != nil {
+		log.Errorf("ioutil.ReadFile(\"%s\") error(%v)", file, err)
+		return
+	}
+	k = &KeyFile{}
+	if err = yaml.Unmarshal(data, k); err != nil {
+		log.Errorf("key file: %s yaml.Unmarshal() error(%v)", file, err)
+		return
+	}
+	k.keys = make(map[uint16][]byte, len(k.Keys))
+	for id, s = range k.Keys {
+		if key, err = hex.DecodeString(s); err != nil {
+			log.Errorf("key file: %s key: %d hex.DecodeString() error(%v)", file, id, err)
+			return
+		}
+		if id == cryptNoKey {
+			err = ErrKeyId
+			return
+		}
+		if _, err = aes.NewCipher(key); err != nil {
+			log.Errorf("key file: %s key: %d error(%v)", file, id, err)
+			err = ErrKeySize
+			return
+		}
+		k.keys[id] = key
+	}
+	// the keys are only kept decoded
+	k.Keys = nil
+	if _, ok := k.keys[k.Cur]; !ok && k.Cur != cryptNoKey {
+		err = ErrKeyNotExist
+	}
+	return
+}
+
+// Key get the key of id.
+func (k *KeyFile) Key(id uint16) (key []byte, err error) {
+	var ok bool
+	if key, ok = k.keys[id]; !ok {
+		err = ErrKeyNotExist
+	}
+	return
+}
+
+// Current get the current key id.
+func (k *KeyFile) Current() uint16 {
+	return k.Cur
+}
+
+// newAEAD new a aes-gcm of the key id.
+func newAEAD(keys KeyProvider, id uint16) (aead cipher.AEAD, err error) {
+	var (
+		key   []byte
+		block cipher.Block
+	)
+	if keys == nil {
+		err = ErrKeyNotExist
+		return
+	}
+	if key, err = keys.Key(id); err != nil {
+		return
+	}
+	if block, err = aes.NewCipher(key); err != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
+
+// cryptAAD get the additional data of the needle data sealed by key id, so
+// the sealed data can't be moved to another needle or opened as another key
+// id.
+func cryptAAD(id uint16, key, cookie int64) (aad []byte) {
+	aad = make([]byte, cryptAADSize)
+	BigEndian.PutUint16(aad, id)
+	BigEndian.PutInt64(aad[2:], key)
+	BigEndian.PutInt64(aad[10:], cookie)
+	return
+}
+
+// aead get the aes-gcm of key id, the ciphers are cached.
+func (b *SuperBlock) aead(id uint16) (aead cipher.AEAD, err error) {
+	var ok bool
+	b.klock.Lock()
+	if aead, ok = b.aeads[id]; !ok {
+		if aead, err = newAEAD(b.options.Keys, id); err == nil {
+			b.aeads[id] = aead
+		}
+	}
+	b.klock.Unlock()
+	return
+}
+
+// Seal encrypt the needle data of key and cookie by the key of block, the
+// data is returned if the block isn't encrypted.
+func (b *SuperBlock) Seal(key, cookie int64, data []byte) (sdata []byte, err error) {
+	var aead cipher.AEAD
+	if b.KeyId == cryptNoKey {
+		return data, nil
+	}
+	if aead, err = b.aead(b.KeyId); err != nil {
+		return
+	}
+	sdata = make([]byte, cryptNonceSize, len(data)+cryptOverhead)
+	if _, err = io.ReadFull(rand.Reader, sdata); err != nil {
+		return
+	}
+	sdata = aead.Seal(sdata, sdata, data, cryptAAD(b.KeyId, key, cookie))
+	return
+}
+
+// Open decrypt the needle data of key and cookie into buf, buf is allocated
+// if it's too small, left is the rest of buf, the data is returned if the
+// block isn't encrypted.
+func (b *SuperBlock) Open(key, cookie int64, data, buf []byte) (pdata, left []byte, err error) {
+	return b.open(b.KeyId, key, cookie, data, buf)
+}
+
+// open decrypt the needle data of key and cookie sealed by key id.
+func (b *SuperBlock) open(id uint16, key, cookie int64, data, buf []byte) (pdata, left []byte, err error) {
+	var (
+		size int
+		aead cipher.AEAD
+	)
+	if id == cryptNoKey {
+		return data, buf, nil
+	}
+	if size = len(data) - cryptOverhead; size < 0 {
+		err = ErrNeedleDecrypt
+		return
+	}
+	if aead, err = b.aead(id); err != nil {
+		return
+	}
+	if left = buf; size <= len(buf) {
+		pdata, left = buf[:0], buf[size:]
+	}
+	if pdata, err = aead.Open(pdata, data[:cryptNonceSize], data[cryptNonceSize:], cryptAAD(id, key, cookie)); err != nil {
+		err = ErrNeedleDecrypt
+	}
+	return
+}
+
+// SumKey get the key of the needle data sums, it's derived from the block key
+// by hmac-sha256, so the sums can't be confirmed without the key, nil if the
+// block isn't encrypted.
+func (b *SuperBlock) SumKey() (key []byte, err error) {
+	var h hash.Hash
+	if b.KeyId == cryptNoKey {
+		return
+	}
+	if b.options.Keys == nil {
+		err = ErrKeyNotExist
+		return
+	}
+	if key, err = b.options.Keys.Key(b.KeyId); err != nil {
+		return
+	}
+	h = hmac.New(sha256.New, key)
+	h.Write(cryptSumLabel)
+	key = h.Sum(nil)
+	return
+}
+
+// Reseal get the data of needle n sealed by the key of block for key and
+// cookie, n.Data is sealed by key id, it's returned if the same key and
+// needle, so the compress and import don't decrypt the needles unless the
+// key rotated or the needle key changed.
+func (b *SuperBlock) Reseal(id uint16, n *Needle, key, cookie int64) (sdata []byte, err error) {
+	if id == b.KeyId && (id == cryptNoKey || (n.Key == key && n.Cookie == cookie)) {
+		return n.Data, nil
+	}
+	if sdata, _, err = b.open(id, n.Key, n.Cookie, n.Data, nil); err != nil {
+		return
+	}
+	return b.Seal(key, cookie, sdata)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestKeyFile(t *testing.T) {
+	var (
+		err  error
+		k    *KeyFile
+		key  []byte
+		file = "./test/test.keys"
+	)
+	defer os.Remove(file)
+	if err = ioutil.WriteFile(file, []byte("current: 2\nkeys:\n  1: 000102030405060708090a0b0c0d0e0f\n  2: 000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"), 0664); err != nil {
+		t.Errorf("ioutil.WriteFile() error(%v)", err)
+		goto failed
+	}
+	if k, err = NewKeyFile(file); err != nil {
+		t.Errorf("NewKeyFile() error(%v)", err)
+		goto failed
+	}
+	if k.Current() != 2 {
+		err = fmt.Errorf("Current(): %d not match", k.Current())
+		t.Error(err)
+		goto failed
+	}
+	if key, err = k.Key(1); err != nil || len(key) != 16 {
+		err = fmt.Errorf("Key(1) error(%v) len: %d", err, len(key))
+		t.Error(err)
+		goto failed
+	}
+	if _, err = k.Key(3); err != ErrKeyNotExist {
+		err = fmt.Errorf("Key(3) error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("bad key file")
+	for data, e := range map[string]error{
+		"current: 3\nkeys:\n  1: 000102030405060708090a0b0c0d0e0f\n": ErrKeyNotExist,
+		"current: 1\nkeys:\n  1: 0001020304\n":                       ErrKeySize,
+		"current: 1\nkeys:\n  0: 000102030405060708090a0b0c0d0e0f\n": ErrKeyId,
+	} {
+		if err = ioutil.WriteFile(file, []byte(data), 0664); err != nil {
+			t.Errorf("ioutil.WriteFile() error(%v)", err)
+			goto failed
+		}
+		if _, err = NewKeyFile(file); err != e {
+			err = fmt.Errorf("NewKeyFile() error(%v) not match: %v", err, e)
+			t.Error(err)
+			goto failed
+		}
+	}
+	err = nil
+failed:
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestVolumeEncrypt(t *testing.T) {
+	var (
+		v, nv, cv *Volume
+		err       error
+		e         NeedleEncoding
+		d         []byte
+		ebuf      = &bytes.Buffer{}
+		buf       = make([]byte, NeedleMaxSize)
+		plain     = []byte("the plain needle data")
+		data      = bytes.Repeat([]byte(`{"key": "value"}`), 64)
+		keys      = &KeyFile{Cur: 1, keys: map[uint16][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+		o         = &VolumeOptions{Encrypt: true, Keys: keys, Encoding: NeedleEncodingOptGzip, Retention: time.Hour}
+		bfile     = "./test/test.encrypt"
+		ifile     = "./test/test.encrypt.idx"
+		nbfile    = "./test/test.encrypt.import"
+		nifile    = "./test/test.encrypt.import.idx"
+		cbfile    = "./test/test.encrypt.compress"
+		cifile    = "./test/test.encrypt.compress.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	defer os.Remove(nbfile)
+	defer os.Remove(nifile)
+	defer os.Remove(cbfile)
+	defer os.Remove(cifile)
+	if _, err = NewVolume(1, bfile, ifile, &VolumeOptions{Encrypt: true}); err != ErrSuperBlockKey {
+		err = fmt.Errorf("NewVolume() no keys error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	os.Remove(bfile)
+	os.Remove(ifile)
+	if v, err = NewVolume(1, bfile, ifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if v.block.KeyId != 1 {
+		err = fmt.Errorf("key id: %d not match", v.block.KeyId)
+		t.Error(err)
+		goto failed
+	}
+	if err = v.Add(1, 1, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(2, 2, plain); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if err = v.Flush(); err != nil {
+		t.Errorf("Flush() error(%v)", err)
+		goto failed
+	}
+	if d, err = ioutil.ReadFile(bfile); err != nil || bytes.Contains(d, plain) {
+		err = fmt.Errorf("block file error(%v) has plain data", err)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Get")
+	if err = testVolumeEncoding(v, buf, data, plain); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	t.Log("sealed for the needle")
+	if d, err = v.block.Seal(2, 2, plain); err != nil {
+		t.Errorf("Seal() error(%v)", err)
+		goto failed
+	}
+	if _, _, err = v.block.Open(1, 2, d, nil); err != ErrNeedleDecrypt {
+		err = fmt.Errorf("Open() other key error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	if _, _, err = v.block.Open(2, 1, d, nil); err != ErrNeedleDecrypt {
+		err = fmt.Errorf("Open() other cookie error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	if d, _, err = v.block.Open(2, 2, d, nil); err != nil || !bytes.Equal(d, plain) {
+		err = fmt.Errorf("Open() error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	if d, e, err = v.GetEncoded(1, 1, buf); err != nil || e != NeedleEncodingGzip || e.Size(d) != int32(len(data)) {
+		err = fmt.Errorf("GetEncoded(1) encoding: %d error(%v)", e, err)
+		t.Error(err)
+		goto failed
+	}
+	if v.Sendfile(2) {
+		err = fmt.Errorf("Sendfile() encrypted volume")
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Undelete")
+	if err = v.Del(2); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	if err = v.Undelete(2); err != nil {
+		t.Errorf("Undelete() error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeEncoding(v, buf, data, plain); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Export")
+	if _, err = v.Export(ebuf); err != nil {
+		t.Errorf("Export() error(%v)", err)
+		goto failed
+	}
+	if bytes.Contains(ebuf.Bytes(), plain) {
+		err = fmt.Errorf("export stream has plain data")
+		t.Error(err)
+		goto failed
+	}
+	// import into a plain volume
+	if nv, err = NewVolume(2, nbfile, nifile, &VolumeOptions{Keys: keys}); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if _, err = nv.Import(bytes.NewReader(ebuf.Bytes()), nil); err != nil {
+		t.Errorf("Import() error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeEncoding(nv, buf, data, plain); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	t.Log("rotate")
+	keys.keys[2] = bytes.Repeat([]byte{2}, 32)
+	keys.Cur = 2
+	if cv, err = NewVolume(3, cbfile, cifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = v.StartCompress(cv); err != nil {
+		t.Errorf("StartCompress() error(%v)", err)
+		goto failed
+	}
+	if err = v.StopCompress(cv); err != nil {
+		t.Errorf("StopCompress() error(%v)", err)
+		goto failed
+	}
+	cv.Close()
+	// the old key is retired
+	delete(keys.keys, 1)
+	if cv, err = NewVolume(3, cbfile, cifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if cv.block.KeyId != 2 {
+		err = fmt.Errorf("key id: %d not rotated", cv.block.KeyId)
+		t.Error(err)
+		goto failed
+	}
+	if err = testVolumeEncoding(cv, buf, data, plain); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	v.Close()
+	if v, err = NewVolume(1, bfile, ifile, o); err != ErrKeyNotExist {
+		err = fmt.Errorf("NewVolume() retired key error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	v = nil
+	err = nil
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if nv != nil {
+		nv.Close()
+	}
+	if cv != nil {
+		cv.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
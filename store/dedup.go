@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	log "github.com/golang/glog"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// dedup keeps the sha-256 of the needle data, a key added with the same data
+// as a live needle is an alias of it: the index points the key at the needle
+// offset, the needle isn't written again. the needle header has the cookie
+// of its own key, so the alias cookies are kept in the dedup file next to
+// the index. a needle is shared by its key and aliases, it's only flagged
+// deleted when the last of them deleted or overwritten.
+//
+// dedup file format:
+//  ---------------
+// |     record    |           -------------------
+// |     record    |  ---->   |  kind (byte)      |
+// |     ......    |          |  padding(3bytes)  |
+//  ---------------           |  offset (uint32)  |
+//                            |  size (int32)     |
+//                            |  padding(4bytes)  |
+//                            |  key (int64)      |
+//                            |  cookie (int64)   |
+//                            |  sum (32bytes)    |
+//                             -------------------
+//                               int bigendian
+//
+// field     | explanation
+// ---------------------------------------------------------
+// kind      | s: the sum of a needle, a: an alias of a needle
+// offset    | the needle offset
+// size      | the needle size
+// key       | the needle key, or the alias key
+// cookie    | the alias cookie
+// sum       | the sha-256 of the needle data before encode and encrypt, the
+//           | hmac-sha256 by the sum key of block if the volume is encrypted
+
+const (
+	dedupRecordSize = 64
+	// record offset
+	dedupOffsetOffset = 4
+	dedupSizeOffset   = 8
+	dedupKeyOffset    = 16
+	dedupCookieOffset = 24
+	dedupSumOffset    = 32
+	// kind
+	dedupKindSum   = byte('s')
+	dedupKindAlias = byte('a')
+	// the dedup file suffix of index file
+	dedupSuffix = ".dedup"
+)
+
+// dedupSum the sha-256 of needle data.
+type dedupSum [sha256.Size]byte
+
+// newDedupSum get the sum of data, keyed by key if it isn't nil, so the sums
+// of an encrypted volume don't confirm the plain data.
+func newDedupSum(key, data []byte) *dedupSum {
+	var sum dedupSum
+	if key == nil {
+		sum = dedupSum(sha256.Sum256(data))
+	} else {
+		h := hmac.New(sha256.New, key)
+		h.Write(data)
+		h.Sum(sum[:0])
+	}
+	return &sum
+}
+
+// dedupNeedle a needle of known sum, refs is the live keys point to it, the
+// aliases may have the stale keys.
+type dedupNeedle struct {
+	key     int64
+	offset  uint32
+	size    int32
+	refs    int32
+	sum     dedupSum
+	aliases []int64
+}
+
+// dedupAlias an alias key of the needle at offset.
+type dedupAlias struct {
+	key    int64
+	cookie int64
+	offset uint32
+}
+
+// dedup the needle sums and the aliases of a volume, it's changed with the
+// volume lock, the readers only look up the alias cookies with lock.
+type dedup struct {
+	File    string
+	lock    sync.RWMutex
+	f       *os.File
+	bw      *bufio.Writer
+	buf     [dedupRecordSize]byte
+	key     []byte
+	sums    map[dedupSum]*dedupNeedle
+	needles map[uint32]*dedupNeedle
+	aliases map[int64]dedupAlias
+}
+
+// openDedup open the dedup file, the sums are keyed by skey if it isn't nil,
+// the live keys of every needle are counted from the needle map, the torn
+// record of a crash is truncated.
+func openDedup(file string, skey []byte, needles NeedleMap) (d *dedup, err error) {
+	var (
+		ok     bool
+		key    int64
+		size   int64
+		offset uint32
+		n      *dedupNeedle
+		a      dedupAlias
+		rd     *bufio.Reader
+		buf    = make([]byte, dedupRecordSize)
+	)
+	d = &dedup{File: file, key: skey}
+	d.sums = make(map[dedupSum]*dedupNeedle)
+	d.needles = make(map[uint32]*dedupNeedle)
+	d.aliases = make(map[int64]dedupAlias)
+	if d.f, err = os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0664); err != nil {
+		log.Errorf("os.OpenFile(\"%s\", os.O_RDWR|os.O_CREATE, 0664) error(%v)", file, err)
+		return
+	}
+	rd = bufio.NewReader(d.f)
+	for {
+		if _, err = io.ReadFull(rd, buf); err != nil {
+			break
+		}
+		key = BigEndian.Int64(buf[dedupKeyOffset:])
+		offset = BigEndian.Uint32(buf[dedupOffsetOffset:])
+		if buf[0] == dedupKindSum {
+			n = &dedupNeedle{key: key, offset: offset, size: BigEndian.Int32(buf[dedupSizeOffset:])}
+			copy(n.sum[:], buf[dedupSumOffset:])
+			d.needles[offset] = n
+		} else if buf[0] == dedupKindAlias {
+			d.aliases[key] = dedupAlias{key: key, cookie: BigEndian.Int64(buf[dedupCookieOffset:]), offset: offset}
+		} else {
+			log.Errorf("dedup: %s offset: %d kind: %d error, truncate", file, size, buf[0])
+			break
+		}
+		size += dedupRecordSize
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Errorf("dedup: %s read error(%v)", file, err)
+		goto failed
+	}
+	if err = d.f.Truncate(size); err != nil {
+		log.Errorf("dedup: %s Truncate() error(%v)", file, err)
+		goto failed
+	}
+	if _, err = d.f.Seek(size, os.SEEK_SET); err != nil {
+		log.Errorf("dedup: %s Seek() error(%v)", file, err)
+		goto failed
+	}
+	d.bw = bufio.NewWriter(d.f)
+	needles.Range(func(key int64, nc NeedleCache) bool {
+		offset, _ := nc.Value()
+		if n = d.needles[offset]; n == nil {
+			return true
+		}
+		if key == n.key {
+			n.refs++
+		} else if a, ok = d.aliases[key]; ok && a.offset == offset {
+			n.refs++
+			n.aliases = append(n.aliases, key)
+		}
+		return true
+	})
+	for offset, n = range d.needles {
+		if n.refs == 0 {
+			delete(d.needles, offset)
+		} else {
+			d.sums[n.sum] = n
+		}
+	}
+	log.Infof("dedup: %s load %d needles, %d aliases", file, len(d.needles), len(d.aliases))
+	return
+failed:
+	d.f.Close()
+	return
+}
+
+// write append a record of needle n.
+func (d *dedup) write(kind byte, key, cookie int64, n *dedupNeedle) (err error) {
+	var b = d.buf[:]
+	b[0] = kind
+	BigEndian.PutUint32(b[dedupOffsetOffset:], n.offset)
+	BigEndian.PutInt32(b[dedupSizeOffset:], n.size)
+	BigEndian.PutInt64(b[dedupKeyOffset:], key)
+	BigEndian.PutInt64(b[dedupCookieOffset:], cookie)
+	copy(b[dedupSumOffset:], n.sum[:])
+	if _, err = d.bw.Write(b); err != nil {
+		log.Errorf("dedup: %s Write() error(%v)", d.File, err)
+	}
+	return
+}
+
+// sum get the sum of data, nil if the volume doesn't dedup.
+func (d *dedup) sum(data []byte) *dedupSum {
+	if d == nil {
+		return nil
+	}
+	return newDedupSum(d.key, data)
+}
+
+// find get the live needle of sum, nil if not exists or it's the needle of
+// key, the key overwritten with the same data keeps its new cookie.
+func (d *dedup) find(key int64, sum *dedupSum) (n *dedupNeedle) {
+	if d == nil || sum == nil {
+		return
+	}
+	if n = d.sums[*sum]; n != nil && n.key == key {
+		n = nil
+	}
+	return
+}
+
+// add record the sum of a new needle of key.
+func (d *dedup) add(key int64, offset uint32, size int32, sum *dedupSum) (n *dedupNeedle, err error) {
+	n = &dedupNeedle{key: key, offset: offset, size: size, refs: 1, sum: *sum}
+	if err = d.write(dedupKindSum, key, 0, n); err != nil {
+		return
+	}
+	d.needles[offset] = n
+	d.sums[n.sum] = n
+	return
+}
+
+// ref add key as an alias of needle n.
+func (d *dedup) ref(key, cookie int64, n *dedupNeedle) (err error) {
+	if err = d.write(dedupKindAlias, key, cookie, n); err != nil {
+		return
+	}
+	d.lock.Lock()
+	d.aliases[key] = dedupAlias{key: key, cookie: cookie, offset: n.offset}
+	d.lock.Unlock()
+	n.refs++
+	n.aliases = append(n.aliases, key)
+	return
+}
+
+// unref release a key of the needle at offset, del is true if no key point
+// to it, so the flag can be updated.
+func (d *dedup) unref(offset uint32) (del bool) {
+	var n *dedupNeedle
+	if d == nil {
+		return true
+	}
+	if n = d.needles[offset]; n == nil {
+		return true
+	}
+	if n.refs--; n.refs > 0 {
+		return false
+	}
+	delete(d.needles, offset)
+	if d.sums[n.sum] == n {
+		delete(d.sums, n.sum)
+	}
+	return true
+}
+
+// reref add back a key of the needle at offset undeleted in place, the needle
+// released by all the keys isn't deduped again.
+func (d *dedup) reref(offset uint32) {
+	var n *dedupNeedle
+	if d == nil {
+		return
+	}
+	if n = d.needles[offset]; n != nil {
+		n.refs++
+	}
+}
+
+// shared check the needle at offset is pointed by any key.
+func (d *dedup) shared(offset uint32) bool {
+	return d != nil && d.needles[offset] != nil
+}
+
+// alias get the cookie of key if it's an alias of the needle at offset.
+func (d *dedup) alias(key int64, offset uint32) (cookie int64, ok bool) {
+	var a dedupAlias
+	if d == nil {
+		return
+	}
+	d.lock.RLock()
+	a, ok = d.aliases[key]
+	d.lock.RUnlock()
+	if ok = ok && a.offset == offset; ok {
+		cookie = a.cookie
+	}
+	return
+}
+
+// Flush flush the dedup file buffer.
+func (d *dedup) Flush() (err error) {
+	if d == nil {
+		return
+	}
+	if err = d.bw.Flush(); err != nil {
+		log.Errorf("dedup: %s Flush() error(%v)", d.File, err)
+	}
+	return
+}
+
+// Sync fsync the dedup file.
+func (d *dedup) Sync() (err error) {
+	if d == nil {
+		return
+	}
+	if err = d.bw.Flush(); err != nil {
+		log.Errorf("dedup: %s Flush() error(%v)", d.File, err)
+		return
+	}
+	if err = d.f.Sync(); err != nil {
+		log.Errorf("dedup: %s Sync() error(%v)", d.File, err)
+	}
+	return
+}
+
+// Close close the dedup file.
+func (d *dedup) Close() {
+	if d == nil {
+		return
+	}
+	d.Flush()
+	d.f.Close()
+}
+
+// writeAlias write key as an alias of the needle n, must called with lock.
+func (v *Volume) writeAlias(key, cookie int64, n *dedupNeedle) (err error) {
+	var ooffset, osize = v.needleValue(key)
+	if err = v.dedup.ref(key, cookie, n); err != nil {
+		return
+	}
+	// the alias cookie before the index
+	if err = v.dedup.Flush(); err != nil {
+		return
+	}
+	if err = v.indexer.Write(key, n.offset, n.size); err != nil {
+		return
+	}
+	log.V(1).Infof("add alias needle, key: %d, offset: %d, size: %d", key, n.offset, n.size)
+	v.setNeedle(key, NewNeedleCache(n.offset, n.size))
+	delete(v.deleted, key)
+	atomic.AddInt64(&v.liveBytes, int64(n.size))
+	v.syncer.Advance(indexSize)
+	if ooffset != NeedleCacheDelOffset {
+		atomic.AddInt64(&v.liveBytes, -int64(osize))
+		if v.dedup.unref(ooffset) {
+			v.queueDel(ooffset)
+			err = v.asyncDel(ooffset)
+		}
+	}
+	v.mergeNeedles(false)
+	return
+}
+
+// dedupAliases get the data sum and the live aliases of the needle at
+// offset, sum is nil if unknown, must called with lock.
+func (v *Volume) dedupAliases(offset uint32) (sum *dedupSum, aliases []dedupAlias) {
+	var (
+		ok   bool
+		key  int64
+		keys []int64
+		a    dedupAlias
+		n    *dedupNeedle
+		seen map[int64]struct{}
+	)
+	if v.dedup == nil {
+		return
+	}
+	if n = v.dedup.needles[offset]; n == nil {
+		return
+	}
+	sum = &dedupSum{}
+	*sum = n.sum
+	seen = make(map[int64]struct{}, len(n.aliases))
+	for _, key = range n.aliases {
+		if _, ok = seen[key]; ok {
+			continue
+		}
+		if noffset, _ := v.needleValue(key); noffset != offset {
+			continue
+		}
+		if a, ok = v.dedup.aliases[key]; !ok || a.offset != offset {
+			continue
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+		aliases = append(aliases, a)
+	}
+	// drop the stale keys
+	n.aliases = keys
+	return
+}
+
+// dedupNeedle get the dedup needle of key, the sum is recorded if unknown,
+// nil if the volume doesn't dedup, must called with lock.
+func (v *Volume) dedupNeedle(key int64, sum *dedupSum) (n *dedupNeedle, err error) {
+	var offset, size = v.needleValue(key)
+	if v.dedup == nil || offset == NeedleCacheDelOffset {
+		return
+	}
+	if n = v.dedup.needles[offset]; n == nil {
+		n, err = v.dedup.add(key, offset, size, sum)
+	}
+	return
+}
+
+// compressAliases write the aliases of a compressed needle, keep is true if
+// the needle is written alive, or the first alias is written as the needle,
+// the others are added as the aliases of it, or the copies if the volume
+// doesn't dedup.
+func (v *Volume) compressAliases(n *Needle, id uint16, keep bool, sum *dedupSum, aliases []dedupAlias) (err error) {
+	var (
+		a   dedupAlias
+		dn  *dedupNeedle
+		key = n.Key
+	)
+	// the sum is keyed by the block key, so it's computed again if rotated
+	if id != v.block.KeyId && v.dedup != nil {
+		if sum, err = v.resum(n, id); err != nil {
+			return
+		}
+	}
+	for _, a = range aliases {
+		if keep && dn == nil {
+			if dn, err = v.dedupNeedle(key, sum); err != nil {
+				return
+			}
+		}
+		if dn != nil {
+			err = v.writeAlias(a.key, a.cookie, dn)
+		} else {
+			err = v.writeFrom(a.key, a.cookie, n, id)
+			key, keep = a.key, true
+		}
+		if err != nil {
+			return
+		}
+	}
+	if keep && dn == nil {
+		_, err = v.dedupNeedle(key, sum)
+	}
+	return
+}
+
+// resum get the data sum of needle n sealed by key id.
+func (v *Volume) resum(n *Needle, id uint16) (sum *dedupSum, err error) {
+	var data []byte
+	if data, _, err = v.block.open(id, n.Key, n.Cookie, n.Data, nil); err != nil {
+		return
+	}
+	if data, err = n.Encoding.Decode(data, nil); err != nil {
+		return
+	}
+	sum = v.dedup.sum(data)
+	return
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestVolumeDedup(t *testing.T) {
+	var (
+		v, nv, cv *Volume
+		err       error
+		end       uint32
+		offset    uint32
+		d         []byte
+		ebuf      = &bytes.Buffer{}
+		buf       = make([]byte, NeedleMaxSize)
+		data      = []byte("the same needle data uploaded again")
+		o         = &VolumeOptions{Dedup: true}
+		bfile     = "./test/test.dedup"
+		ifile     = "./test/test.dedup.idx"
+		nbfile    = "./test/test.dedup.import"
+		nifile    = "./test/test.dedup.import.idx"
+		cbfile    = "./test/test.dedup.compress"
+		cifile    = "./test/test.dedup.compress.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	defer os.Remove(ifile + dedupSuffix)
+	defer os.Remove(nbfile)
+	defer os.Remove(nifile)
+	defer os.Remove(cbfile)
+	defer os.Remove(cifile)
+	defer os.Remove(cifile + dedupSuffix)
+	if _, err = NewVolume(1, bfile, ifile, &VolumeOptions{Dedup: true, Versions: 2}); err != ErrVolumeDedup {
+		err = fmt.Errorf("NewVolume() versions error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	if v, err = NewVolume(1, bfile, ifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(1, 1, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	end = v.block.offset
+	if err = v.Add(2, 2, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if offset, _ = v.needleValue(2); v.block.offset != end || offset != v.dedup.sums[*v.dedup.sum(data)].offset {
+		err = fmt.Errorf("alias offset: %d, block offset: %d not match", offset, v.block.offset)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Get")
+	if err = testVolumeDedup(v, buf, data, 1, 2); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	if _, err = v.Get(2, 1, buf); err != ErrNeedleCookie {
+		err = fmt.Errorf("Get(2) cookie error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Del")
+	// the needle is kept for the alias
+	if err = v.Del(1); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeDedup(v, buf, data, 2); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	t.Log("reopen")
+	v.Close()
+	if v, err = NewVolume(1, bfile, ifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeDedup(v, buf, data, 2); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	if _, err = v.Get(1, 1, buf); err != ErrNeedleDeleted {
+		err = fmt.Errorf("Get(1) error(%v) not deleted", err)
+		t.Error(err)
+		goto failed
+	}
+	end = v.block.offset
+	if err = v.Add(3, 3, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if v.block.offset != end || v.dedup.sums[*v.dedup.sum(data)].refs != 2 {
+		err = fmt.Errorf("Add(3) not deduped")
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Undelete")
+	if err = v.Del(3); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	if err = v.Undelete(3); err != nil {
+		t.Errorf("Undelete() error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeDedup(v, buf, data, 2, 3); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Export")
+	if _, err = v.Export(ebuf); err != nil {
+		t.Errorf("Export() error(%v)", err)
+		goto failed
+	}
+	if nv, err = NewVolume(2, nbfile, nifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if _, err = nv.Import(bytes.NewReader(ebuf.Bytes()), nil); err != nil {
+		t.Errorf("Import() error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeDedup(nv, buf, data, 2, 3); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Compress")
+	if cv, err = NewVolume(3, cbfile, cifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = v.StartCompress(cv); err != nil {
+		t.Errorf("StartCompress() error(%v)", err)
+		goto failed
+	}
+	if err = v.StopCompress(cv); err != nil {
+		t.Errorf("StopCompress() error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeDedup(cv, buf, data, 2, 3); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	if err = cv.Flush(); err != nil {
+		t.Errorf("Flush() error(%v)", err)
+		goto failed
+	}
+	if d, err = ioutil.ReadFile(cbfile); err != nil || bytes.Count(d, data) != 1 {
+		err = fmt.Errorf("compressed block error(%v) data not deduped", err)
+		t.Error(err)
+		goto failed
+	}
+	// the needle is flagged when the last key deleted
+	if err = cv.Del(2); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeDedup(cv, buf, data, 3); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	offset, _ = cv.needleValue(3)
+	if err = cv.Del(3); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	if cv.dedup.shared(offset) {
+		err = fmt.Errorf("needle: %d still shared", offset)
+		t.Error(err)
+		goto failed
+	}
+	err = nil
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if nv != nil {
+		nv.Close()
+	}
+	if cv != nil {
+		cv.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestVolumeDedupEncrypt(t *testing.T) {
+	var (
+		v, cv  *Volume
+		iv     *Volume
+		err    error
+		end    uint32
+		d      []byte
+		ebuf   = &bytes.Buffer{}
+		buf    = make([]byte, NeedleMaxSize)
+		data   = []byte("the same needle data uploaded again!")
+		plain  = sha256.Sum256(data)
+		keys   = &KeyFile{Cur: 1, keys: map[uint16][]byte{1: bytes.Repeat([]byte{1}, 32), 2: bytes.Repeat([]byte{2}, 32)}}
+		o      = &VolumeOptions{Dedup: true, Encrypt: true, Keys: keys}
+		bfile  = "./test/test.dedup.encrypt"
+		ifile  = "./test/test.dedup.encrypt.idx"
+		cbfile = "./test/test.dedup.encrypt.compress"
+		cifile = "./test/test.dedup.encrypt.compress.idx"
+		ibfile = "./test/test.dedup.encrypt.import"
+		iifile = "./test/test.dedup.encrypt.import.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	defer os.Remove(ifile + dedupSuffix)
+	defer os.Remove(ibfile)
+	defer os.Remove(iifile)
+	defer os.Remove(iifile + dedupSuffix)
+	defer os.Remove(cbfile)
+	defer os.Remove(cifile)
+	defer os.Remove(cifile + dedupSuffix)
+	if v, err = NewVolume(1, bfile, ifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(1, 1, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	end = v.block.offset
+	if err = v.Add(2, 2, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if v.block.offset != end {
+		err = fmt.Errorf("Add(2) not deduped")
+		t.Error(err)
+		goto failed
+	}
+	if err = v.Flush(); err != nil {
+		t.Errorf("Flush() error(%v)", err)
+		goto failed
+	}
+	if d, err = ioutil.ReadFile(ifile + dedupSuffix); err != nil || bytes.Contains(d, plain[:]) {
+		err = fmt.Errorf("dedup file error(%v) has plain sum", err)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Export the alias sealed for itself")
+	if _, err = v.Export(ebuf); err != nil {
+		t.Errorf("Export() error(%v)", err)
+		goto failed
+	}
+	if iv, err = NewVolume(3, ibfile, iifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if _, err = iv.Import(ebuf, nil); err != nil {
+		t.Errorf("Import() error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeDedup(iv, buf, data, 1, 2); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	// the alias is copied when the needle deleted
+	if err = v.Del(1); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	t.Log("Compress with the key rotated")
+	keys.Cur = 2
+	if cv, err = NewVolume(2, cbfile, cifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = v.StartCompress(cv); err != nil {
+		t.Errorf("StartCompress() error(%v)", err)
+		goto failed
+	}
+	if err = v.StopCompress(cv); err != nil {
+		t.Errorf("StopCompress() error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeDedup(cv, buf, data, 2); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	if _, err = cv.Get(1, 1, buf); err == nil {
+		err = fmt.Errorf("Get(1) deleted needle compressed")
+		t.Error(err)
+		goto failed
+	}
+	end = cv.block.offset
+	if err = cv.Add(3, 3, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if cv.block.offset != end {
+		err = fmt.Errorf("Add(3) not deduped by the rotated key")
+		t.Error(err)
+		goto failed
+	}
+	err = nil
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if cv != nil {
+		cv.Close()
+	}
+	if iv != nil {
+		iv.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+// testVolumeDedup check the needles of keys, the cookie is the key.
+func testVolumeDedup(v *Volume, buf, data []byte, keys ...int64) (err error) {
+	var d []byte
+	for _, key := range keys {
+		if d, err = v.Get(key, key, buf); err != nil || !bytes.Equal(d, data) {
+			return fmt.Errorf("Get(%d) error(%v) not match", key, err)
+		}
+	}
+	return nil
+}
+
+func TestVolumeDedupCrash(t *testing.T) {
+	var (
+		v, cv  *Volume
+		err    error
+		buf    = make([]byte, NeedleMaxSize)
+		data   = []byte("the same needle data uploaded again")
+		o      = &VolumeOptions{Dedup: true, Sync: SyncAlways}
+		bfile  = "./test/test.dedup.crash"
+		ifile  = "./test/test.dedup.crash.idx"
+		cbfile = "./test/test.dedup.crash.copy"
+		cifile = "./test/test.dedup.crash.copy.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	defer os.Remove(ifile + dedupSuffix)
+	defer os.Remove(cbfile)
+	defer os.Remove(cifile)
+	defer os.Remove(cifile + dedupSuffix)
+	if v, err = NewVolume(1, bfile, ifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(1, 1, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(2, 2, []byte("test")); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if err = v.Del(2); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(3, 3, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	// killed after the alias acknowledged, only the synced files are left
+	if err = testCopyFile(bfile, cbfile); err == nil {
+		if err = testCopyFile(ifile, cifile); err == nil {
+			err = testCopyFile(ifile+dedupSuffix, cifile+dedupSuffix)
+		}
+	}
+	if err != nil {
+		t.Errorf("testCopyFile() error(%v)", err)
+		goto failed
+	}
+	if cv, err = NewVolume(1, cbfile, cifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeDedup(cv, buf, data, 1, 3); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	// the block isn't recovered from the alias offset
+	if _, err = cv.Get(2, 2, buf); err != ErrNeedleDeleted {
+		err = fmt.Errorf("Get(2) error(%v) not deleted", err)
+		t.Error(err)
+		goto failed
+	}
+	err = nil
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if cv != nil {
+		cv.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+// testCopyFile copy the file as it's on disk.
+func testCopyFile(src, dst string) (err error) {
+	var d []byte
+	if d, err = ioutil.ReadFile(src); err != nil {
+		return
+	}
+	return ioutil.WriteFile(dst, d, 0664)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	log "github.com/golang/glog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	diskVolumePrefix     = "volume_"
+	diskFreeVolumePrefix = "free_"
+	diskIndexExt         = ".idx"
+	diskProbeFile        = ".probe"
+)
+
+var diskProbeData = []byte("bfs")
+
+// Disk is a store data directory, usually a mount point of a physical disk,
+// all the volumes on a failed disk are failed together.
+type Disk struct {
+	Path string
+	lock sync.Mutex
+	err  error
+}
+
+// DiskStat the disk state.
+type DiskStat struct {
+	Path    string `json:"path"`
+	Free    uint64 `json:"free"`
+	Volumes int    `json:"volumes"`
+	Error   string `json:"error,omitempty"`
+}
+
+// NewDisk new a disk, create the data directory if not exists.
+func NewDisk(path string) (d *Disk, err error) {
+	d = &Disk{}
+	if d.Path, err = filepath.Abs(path); err != nil {
+		log.Errorf("filepath.Abs(\"%s\") error(%v)", path, err)
+		return
+	}
+	if err = os.MkdirAll(d.Path, 0775); err != nil {
+		log.Errorf("os.MkdirAll(\"%s\") error(%v)", d.Path, err)
+	}
+	return
+}
+
+// Free get the disk free space for unprivileged users.
+func (d *Disk) Free() (free uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(d.Path, &st); err != nil {
+		log.Errorf("syscall.Statfs(\"%s\") error(%v)", d.Path, err)
+		return
+	}
+	free = uint64(st.Bavail) * uint64(st.Bsize)
+	return
+}
+
+// Contains check the file is in the disk.
+func (d *Disk) Contains(file string) bool {
+	var err error
+	if file, err = filepath.Abs(file); err != nil {
+		return false
+	}
+	return filepath.Dir(file) == d.Path
+}
+
+// VolumeFile get the volume block and index file path in the disk.
+func (d *Disk) VolumeFile(id int32) (bfile, ifile string) {
+	bfile = filepath.Join(d.Path, diskVolumePrefix+strconv.FormatInt(int64(id), 10))
+	ifile = bfile + diskIndexExt
+	return
+}
+
+// FreeVolumeFile get the free volume block and index file path in the disk.
+func (d *Disk) FreeVolumeFile(n int) (bfile, ifile string) {
+	bfile = filepath.Join(d.Path, diskFreeVolumePrefix+strconv.Itoa(n))
+	ifile = bfile + diskIndexExt
+	return
+}
+
+// FreeVolumes get the free volume block files in the disk.
+func (d *Disk) FreeVolumes() (bfiles []string, err error) {
+	var (
+		file  string
+		files []string
+	)
+	if files, err = filepath.Glob(filepath.Join(d.Path, diskFreeVolumePrefix+"*")); err != nil {
+		log.Errorf("filepath.Glob(\"%s\") error(%v)", d.Path, err)
+		return
+	}
+	for _, file = range files {
+		if filepath.Ext(file) != diskIndexExt {
+			bfiles = append(bfiles, file)
+		}
+	}
+	return
+}
+
+// freeVolumeId get the free volume number from file name.
+func freeVolumeId(bfile string) (n int) {
+	n, _ = strconv.Atoi(strings.TrimPrefix(filepath.Base(bfile), diskFreeVolumePrefix))
+	return
+}
+
+// Fail mark the disk failed.
+func (d *Disk) Fail(err error) {
+	d.lock.Lock()
+	if d.err == nil {
+		log.Errorf("disk: %s failed, error(%v)", d.Path, err)
+		d.err = err
+	}
+	d.lock.Unlock()
+}
+
+// Probe re-check a failed disk by writing and syncing a probe file, the
+// failure is cleared if it succeeds.
+func (d *Disk) Probe() (err error) {
+	var (
+		f    *os.File
+		file = filepath.Join(d.Path, diskProbeFile)
+	)
+	if err = d.Error(); err == nil {
+		return
+	}
+	if f, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664); err != nil {
+		log.Errorf("os.OpenFile(\"%s\") error(%v)", file, err)
+		return
+	}
+	if _, err = f.Write(diskProbeData); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	os.Remove(file)
+	if err != nil {
+		log.Errorf("disk: %s probe error(%v)", d.Path, err)
+		return
+	}
+	d.lock.Lock()
+	d.err = nil
+	d.lock.Unlock()
+	log.Infof("disk: %s recovered", d.Path)
+	return
+}
+
+// Error get the disk failed error, nil if disk is ok.
+func (d *Disk) Error() (err error) {
+	d.lock.Lock()
+	err = d.err
+	d.lock.Unlock()
+	return
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDisk(t *testing.T) {
+	var (
+		s          *Store
+		v1, v2, v3 *Volume
+		v4         *Volume
+		err        error
+		stats      []*DiskStat
+		data       = []byte("test")
+		buf        = make([]byte, 40)
+		file       = "./test/disk.idx"
+		dir1       = "./test/disk1"
+		dir2       = "./test/disk2"
+	)
+	defer os.Remove(file)
+	defer os.RemoveAll(dir1)
+	defer os.RemoveAll(dir2)
+	if s, err = NewStore(&Config{Index: file, Dirs: []string{dir1, dir2}}); err != nil {
+		t.Errorf("NewStore() error(%v)", err)
+		goto failed
+	}
+	defer s.Close()
+	t.Log("CreateVolume(1)")
+	if v1, err = s.CreateVolume(1); err != nil {
+		t.Errorf("CreateVolume(1) error(%v)", err)
+		goto failed
+	}
+	time.Sleep(1 * time.Second)
+	t.Log("CreateVolume(2)")
+	if v2, err = s.CreateVolume(2); err != nil {
+		t.Errorf("CreateVolume(2) error(%v)", err)
+		goto failed
+	}
+	time.Sleep(1 * time.Second)
+	if _, err = s.CreateVolume(2); err != ErrVolumeExist {
+		err = fmt.Errorf("CreateVolume(2) must be ErrVolumeExist")
+		t.Error(err)
+		goto failed
+	}
+	if v1.disk == nil || v2.disk == nil {
+		err = fmt.Errorf("volume disk not set")
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Disks()")
+	stats = s.Disks()
+	if len(stats) != 2 || stats[0].Volumes+stats[1].Volumes != 2 || stats[0].Free == 0 {
+		err = fmt.Errorf("Disks() %v not match", stats)
+		t.Error(err)
+		goto failed
+	}
+	if err = v1.Add(1, 1, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	t.Log("closed volume")
+	// a get races the volume close isn't a disk error
+	if v4, err = NewVolume(4, dir2+"/test.closed", dir2+"/test.closed.idx", nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	v4.disk = v2.disk
+	v4.Close()
+	if _, err = v4.Get(1, 1, buf); err == nil {
+		err = fmt.Errorf("Get() on closed volume must error")
+		t.Error(err)
+		goto failed
+	}
+	v4.setIOError(&os.PathError{Op: "open", Path: v4.block.File, Err: syscall.ENOENT})
+	if err = v2.diskError(); err != nil {
+		t.Errorf("disk failed by closed volume error(%v)", err)
+		goto failed
+	}
+	t.Log("disk fail")
+	v1.setIOError(&os.PathError{Op: "write", Path: v1.block.File, Err: syscall.EIO})
+	if _, err = v1.Get(1, 1, buf); err == nil {
+		err = fmt.Errorf("Get() on failed disk must error")
+		t.Error(err)
+		goto failed
+	}
+	// the other disk is ok, all the new volumes placed to it
+	if v3, err = s.CreateVolume(3); err != nil {
+		t.Errorf("CreateVolume(3) error(%v)", err)
+		goto failed
+	}
+	if v3.disk == v1.disk || v3.diskError() != nil {
+		err = fmt.Errorf("CreateVolume(3) placed on failed disk")
+		t.Error(err)
+		goto failed
+	}
+	t.Log("disk probe")
+	if s.Ready(); v1.diskError() != nil {
+		err = fmt.Errorf("disk not recovered by probe")
+		t.Error(err)
+		goto failed
+	}
+	if _, err = v1.Get(1, 1, buf); err != nil {
+		t.Errorf("Get() error(%v)", err)
+		goto failed
+	}
+	err = nil
+failed:
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestFreeVolume(t *testing.T) {
+	var (
+		s     *Store
+		v     *Volume
+		err   error
+		bfile string
+		file  = "./test/free.idx"
+		dir   = "./test/free"
+	)
+	defer os.Remove(file)
+	defer os.RemoveAll(dir)
+	if s, err = NewStore(&Config{Index: file, Dirs: []string{dir}, FreeVolumes: 2}); err != nil {
+		t.Errorf("NewStore() error(%v)", err)
+		goto failed
+	}
+	if s.FreeVolumes() != 2 {
+		err = fmt.Errorf("FreeVolumes(): %d not match", s.FreeVolumes())
+		t.Error(err)
+		goto failed
+	}
+	t.Log("CreateVolume(1) claim free volume")
+	if v, err = s.CreateVolume(1); err != nil {
+		t.Errorf("CreateVolume(1) error(%v)", err)
+		goto failed
+	}
+	if bfile, _ = v.File(); v.Id != 1 || bfile != filepath.Join(s.disks[0].Path, "volume_1") {
+		err = fmt.Errorf("volume: %d file: %s not match", v.Id, bfile)
+		t.Error(err)
+		goto failed
+	}
+	if err = v.Add(1, 1, []byte("test")); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	time.Sleep(1 * time.Second)
+	if s.FreeVolumes() != 2 {
+		err = fmt.Errorf("FreeVolumes(): %d not match", s.FreeVolumes())
+		t.Error(err)
+		goto failed
+	}
+	s.Close()
+	t.Log("reload free volumes")
+	if s, err = NewStore(&Config{Index: file, Dirs: []string{dir}, FreeVolumes: 1}); err != nil {
+		t.Errorf("NewStore() error(%v)", err)
+		goto failed
+	}
+	defer s.Close()
+	if s.FreeVolumes() != 2 || s.Volume(1) == nil {
+		err = fmt.Errorf("reload store not match")
+		t.Error(err)
+		goto failed
+	}
+failed:
+	if err != nil {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	log "github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+const (
+	// sync policy
+	SyncNone     = "none"
+	SyncInterval = "interval"
+	SyncAlways   = "always"
+	// default interval sync
+	syncDefaultInterval = 1 * time.Second
+)
+
+// syncer fsync the volume block and index file according to the durability
+// policy.
+//
+// none: never fsync, the os decides when the data reach the disk.
+// interval: fsync every N ms or every N bytes written.
+// always: fsync before acknowledging, concurrent writers are group
+// committed, the first waiter fsync for all the waiters.
+type syncer struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	policy  string
+	bytes   int64
+	written int64
+	synced  int64
+	syncing bool
+	fn      func() error
+	signal  chan struct{}
+	done    chan struct{}
+}
+
+// newSyncer new a syncer, fn fsync the files.
+func newSyncer(o *VolumeOptions, fn func() error) (s *syncer) {
+	var interval = o.SyncInterval
+	s = &syncer{}
+	s.cond = sync.NewCond(&s.lock)
+	s.fn = fn
+	s.bytes = o.SyncBytes
+	switch o.Sync {
+	case SyncInterval, SyncAlways:
+		s.policy = o.Sync
+	default:
+		s.policy = SyncNone
+	}
+	if s.policy == SyncInterval {
+		if interval <= 0 {
+			interval = syncDefaultInterval
+		}
+		s.signal = make(chan struct{}, 1)
+		s.done = make(chan struct{})
+		go s.loop(interval)
+	}
+	return
+}
+
+// Advance record n bytes written, return the write sequence used to wait,
+// it's safe after Close, the signal channel is never closed.
+func (s *syncer) Advance(n int64) (seq int64) {
+	s.lock.Lock()
+	s.written += n
+	seq = s.written
+	s.lock.Unlock()
+	if s.policy == SyncInterval && s.bytes > 0 && seq-s.Synced() >= s.bytes {
+		select {
+		case s.signal <- struct{}{}:
+		default:
+		}
+	}
+	return
+}
+
+// Synced get the synced sequence.
+func (s *syncer) Synced() (seq int64) {
+	s.lock.Lock()
+	seq = s.synced
+	s.lock.Unlock()
+	return
+}
+
+// Commit wait the write sequence synced if the policy is always.
+func (s *syncer) Commit(seq int64) (err error) {
+	if s.policy != SyncAlways {
+		return
+	}
+	err = s.wait(seq)
+	return
+}
+
+// wait wait until the sequence synced, if no one is syncing, fsync for all
+// the writers.
+func (s *syncer) wait(seq int64) (err error) {
+	var target int64
+	s.lock.Lock()
+	for s.synced < seq {
+		if s.syncing {
+			s.cond.Wait()
+			continue
+		}
+		// leader
+		s.syncing = true
+		target = s.written
+		s.lock.Unlock()
+		err = s.fn()
+		s.lock.Lock()
+		s.syncing = false
+		if err == nil && target > s.synced {
+			s.synced = target
+		}
+		s.cond.Broadcast()
+		if err != nil {
+			break
+		}
+	}
+	s.lock.Unlock()
+	return
+}
+
+// Sync fsync all the written data.
+func (s *syncer) Sync() (err error) {
+	s.lock.Lock()
+	var seq = s.written
+	s.lock.Unlock()
+	err = s.wait(seq)
+	return
+}
+
+// loop fsync in every interval or when signaled by written bytes.
+func (s *syncer) loop(interval time.Duration) {
+	var (
+		err    error
+		ticker = time.NewTicker(interval)
+	)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.signal:
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		if err = s.Sync(); err != nil {
+			log.Errorf("interval sync error(%v)", err)
+		}
+	}
+}
+
+// Close stop the interval sync goroutine.
+func (s *syncer) Close() {
+	if s.done != nil {
+		close(s.done)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSyncer(t *testing.T) {
+	var (
+		err   error
+		wg    sync.WaitGroup
+		calls int32
+		s     *syncer
+		fn    = func() error {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		}
+	)
+	t.Log("always group commit")
+	s = newSyncer(&VolumeOptions{Sync: SyncAlways}, fn)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Commit(s.Advance(8)); err != nil {
+				t.Errorf("Commit() error(%v)", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls >= 20 || s.Synced() != 160 {
+		err = fmt.Errorf("group commit calls: %d, synced: %d not match", calls, s.Synced())
+		t.Error(err)
+		goto failed
+	}
+	s.Close()
+	t.Log("none")
+	calls = 0
+	s = newSyncer(&VolumeOptions{}, fn)
+	if err = s.Commit(s.Advance(8)); err != nil || calls != 0 {
+		err = fmt.Errorf("none policy must not sync")
+		t.Error(err)
+		goto failed
+	}
+	s.Close()
+	t.Log("interval bytes")
+	s = newSyncer(&VolumeOptions{Sync: SyncInterval, SyncInterval: time.Hour, SyncBytes: 16}, fn)
+	s.Advance(8)
+	s.Advance(8)
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(&calls) != 1 || s.Synced() != 16 {
+		err = fmt.Errorf("interval bytes calls: %d, synced: %d not match", calls, s.Synced())
+		t.Error(err)
+		goto failed
+	}
+	s.Close()
+	// the late writers never panic
+	s.Advance(16)
+	s.Advance(16)
+failed:
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestVolumeSyncAlways(t *testing.T) {
+	var (
+		v     *Volume
+		err   error
+		buf   = make([]byte, 40)
+		data  = []byte("test")
+		o     = &VolumeOptions{Sync: SyncAlways}
+		bfile = "./test/test.sync"
+		ifile = "./test/test.sync.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	if v, err = NewVolume(1, bfile, ifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	// the options are per volume
+	if v.options == o || o.RingSize != 0 {
+		err = fmt.Errorf("volume options shared")
+		t.Error(err)
+		goto failed
+	}
+	if err = v.Add(1, 1, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if v.syncer.Synced() != 40 {
+		err = fmt.Errorf("synced: %d not match", v.syncer.Synced())
+		t.Error(err)
+		goto failed
+	}
+	if _, err = v.Get(1, 1, buf); err != nil {
+		t.Errorf("Get() error(%v)", err)
+		goto failed
+	}
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func BenchmarkVolumeAddSyncAlways(b *testing.B) {
+	var (
+		v     *Volume
+		err   error
+		key   int64
+		file  = "./test/testb4"
+		ifile = "./test/testb4.idx"
+		data  = make([]byte, 1*1024)
+	)
+	defer os.Remove(file)
+	defer os.Remove(ifile)
+	if v, err = NewVolume(1, file, ifile, &VolumeOptions{Sync: SyncAlways}); err != nil {
+		b.Errorf("NewVolume() error(%v)", err)
+		b.FailNow()
+	}
+	defer v.Close()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			k := atomic.AddInt64(&key, 1)
+			if err := v.Add(k, k, data); err != nil {
+				b.Errorf("Add() error(%v)", err)
+				return
+			}
+		}
+	})
+}
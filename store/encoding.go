@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// NeedleEncoding the content encoding of needle data, it's recorded in the
+// first padding byte of needle, so it isn't lost when the flag updated by
+// del, zero is the raw data, as the old needles.
+type NeedleEncoding byte
+
+const (
+	NeedleEncodingNone = NeedleEncoding(0)
+	NeedleEncodingGzip = NeedleEncoding(1)
+	// option names
+	NeedleEncodingOptNone = "none"
+	NeedleEncodingOptGzip = "gzip"
+	// the gzip trailer is crc32 and isize (the original size), little endian
+	gzipIsizeSize = 4
+)
+
+var (
+	// the http content encoding
+	needleEncodingNames = [...]string{
+		NeedleEncodingNone: "identity",
+		NeedleEncodingGzip: "gzip",
+	}
+	gzipWriters = sync.Pool{New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}}
+	gzipReaders sync.Pool
+)
+
+// ParseNeedleEncoding parse the encoding option, none by default.
+func ParseNeedleEncoding(s string) (e NeedleEncoding, err error) {
+	switch s {
+	case "", NeedleEncodingOptNone:
+		e = NeedleEncodingNone
+	case NeedleEncodingOptGzip:
+		e = NeedleEncodingGzip
+	default:
+		err = ErrNeedleEncoding
+	}
+	return
+}
+
+// Valid check the encoding is known.
+func (e NeedleEncoding) Valid() bool {
+	return int(e) < len(needleEncodingNames)
+}
+
+// String get the http content encoding name.
+func (e NeedleEncoding) String() string {
+	return needleEncodingNames[e]
+}
+
+// Size get the original size of the encoded data, the gzip isize is the
+// original size mod 2^32, the needle never exceeds it.
+func (e NeedleEncoding) Size(data []byte) int32 {
+	if e == NeedleEncodingNone || len(data) < gzipIsizeSize {
+		return int32(len(data))
+	}
+	return int32(binary.LittleEndian.Uint32(data[len(data)-gzipIsizeSize:]))
+}
+
+// Encode encode the data, the data is returned if encoding is none.
+func (e NeedleEncoding) Encode(data []byte) (edata []byte, err error) {
+	var (
+		w *gzip.Writer
+		b *bytes.Buffer
+	)
+	if e == NeedleEncodingNone {
+		return data, nil
+	}
+	b = bytes.NewBuffer(make([]byte, 0, len(data)/2))
+	w = gzipWriters.Get().(*gzip.Writer)
+	w.Reset(b)
+	if _, err = w.Write(data); err == nil {
+		err = w.Close()
+	}
+	gzipWriters.Put(w)
+	edata = b.Bytes()
+	return
+}
+
+// Decode decode the data into buf, buf is allocated if it's too small, the
+// data is returned if encoding is none.
+func (e NeedleEncoding) Decode(data, buf []byte) (ddata []byte, err error) {
+	var (
+		ok   bool
+		n    int
+		size int32
+		r    *gzip.Reader
+		eof  [1]byte
+		br   = bytes.NewReader(data)
+	)
+	if e == NeedleEncodingNone {
+		return data, nil
+	}
+	if size = e.Size(data); size > NeedleMaxSize || size < 0 {
+		err = ErrNeedleSize
+		return
+	}
+	if int(size) > len(buf) {
+		buf = make([]byte, size)
+	}
+	if r, ok = gzipReaders.Get().(*gzip.Reader); ok {
+		err = r.Reset(br)
+	} else {
+		r, err = gzip.NewReader(br)
+	}
+	if err != nil {
+		return
+	}
+	r.Multistream(false)
+	if _, err = io.ReadFull(r, buf[:size]); err == nil {
+		// the gzip crc32 and isize are checked at eof
+		if n, err = r.Read(eof[:]); n != 0 || err == nil {
+			err = ErrNeedleDecode
+		} else if err == io.EOF {
+			err = nil
+		}
+	}
+	gzipReaders.Put(r)
+	if err == nil {
+		ddata = buf[:size]
+	}
+	return
+}
+
+// encode encode the data by the volume option, the data is kept raw if the
+// encoded isn't smaller.
+func (v *Volume) encode(data []byte) (e NeedleEncoding, edata []byte) {
+	var err error
+	if e, edata = v.encoding, data; e == NeedleEncodingNone || len(data) > NeedleMaxSize {
+		return NeedleEncodingNone, data
+	}
+	if edata, err = e.Encode(data); err != nil || len(edata) >= len(data) {
+		return NeedleEncodingNone, data
+	}
+	return
+}
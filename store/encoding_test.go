@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNeedleEncoding(t *testing.T) {
+	var (
+		err   error
+		e     NeedleEncoding
+		edata []byte
+		ddata []byte
+		data  = bytes.Repeat([]byte(`{"key": "value"}`), 64)
+	)
+	if e, err = ParseNeedleEncoding(""); err != nil || e != NeedleEncodingNone {
+		err = fmt.Errorf("ParseNeedleEncoding(\"\") not none")
+		t.Error(err)
+		goto failed
+	}
+	if e, err = ParseNeedleEncoding(NeedleEncodingOptGzip); err != nil || e != NeedleEncodingGzip {
+		err = fmt.Errorf("ParseNeedleEncoding(gzip) not match")
+		t.Error(err)
+		goto failed
+	}
+	if _, err = ParseNeedleEncoding("zstd"); err != ErrNeedleEncoding {
+		err = fmt.Errorf("ParseNeedleEncoding(zstd) error(%v)", err)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Encode")
+	if edata, err = NeedleEncodingGzip.Encode(data); err != nil {
+		t.Errorf("Encode() error(%v)", err)
+		goto failed
+	}
+	if len(edata) >= len(data) || NeedleEncodingGzip.Size(edata) != int32(len(data)) {
+		err = fmt.Errorf("encoded size: %d, original size: %d not match", len(edata), NeedleEncodingGzip.Size(edata))
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Decode")
+	// the buf is too small
+	if ddata, err = NeedleEncodingGzip.Decode(edata, make([]byte, 8)); err != nil || !bytes.Equal(ddata, data) {
+		err = fmt.Errorf("Decode() error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	if ddata, err = NeedleEncodingNone.Decode(data, nil); err != nil || !bytes.Equal(ddata, data) {
+		err = fmt.Errorf("Decode() none error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	edata[len(edata)/2] ^= 0xff
+	if _, err = NeedleEncodingGzip.Decode(edata, nil); err == nil {
+		err = fmt.Errorf("Decode() corrupted data")
+		t.Error(err)
+		goto failed
+	}
+	err = nil
+failed:
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestVolumeEncoding(t *testing.T) {
+	var (
+		v, nv  *Volume
+		cv     *Volume
+		err    error
+		e      NeedleEncoding
+		d      []byte
+		size   int32
+		random = make([]byte, 1024)
+		data   = bytes.Repeat([]byte(`{"key": "value"}`), 64)
+		buf    = make([]byte, NeedleMaxSize)
+		ebuf   = &bytes.Buffer{}
+		o      = &VolumeOptions{Encoding: NeedleEncodingOptGzip, Retention: time.Hour}
+		bfile  = "./test/test.encoding"
+		ifile  = "./test/test.encoding.idx"
+		nbfile = "./test/test.encoding.import"
+		nifile = "./test/test.encoding.import.idx"
+		cbfile = "./test/test.encoding.compress"
+		cifile = "./test/test.encoding.compress.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	defer os.Remove(nbfile)
+	defer os.Remove(nifile)
+	defer os.Remove(cbfile)
+	defer os.Remove(cifile)
+	if _, err = rand.Read(random); err != nil {
+		t.Errorf("rand.Read() error(%v)", err)
+		goto failed
+	}
+	if v, err = NewVolume(1, bfile, ifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(1, 1, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	// incompressible
+	if err = v.Add(2, 2, random); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if _, size = v.needleValue(1); int(size) >= len(data) {
+		err = fmt.Errorf("needle size: %d not compressed", size)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Get")
+	if err = testVolumeEncoding(v, buf, data, random); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	if d, e, err = v.GetEncoded(1, 1, buf); err != nil || e != NeedleEncodingGzip || e.Size(d) != int32(len(data)) {
+		err = fmt.Errorf("GetEncoded(1) encoding: %d error(%v)", e, err)
+		t.Error(err)
+		goto failed
+	}
+	if _, e, err = v.GetEncoded(2, 2, buf); err != nil || e != NeedleEncodingNone {
+		err = fmt.Errorf("GetEncoded(2) encoding: %d error(%v)", e, err)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Undelete")
+	if err = v.Del(1); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	if err = v.Undelete(1); err != nil {
+		t.Errorf("Undelete() error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeEncoding(v, buf, data, random); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Export")
+	if _, err = v.Export(ebuf); err != nil {
+		t.Errorf("Export() error(%v)", err)
+		goto failed
+	}
+	// import into a raw volume, the encoded needle is kept
+	if nv, err = NewVolume(2, nbfile, nifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if _, err = nv.Import(bytes.NewReader(ebuf.Bytes()), nil); err != nil {
+		t.Errorf("Import() error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeEncoding(nv, buf, data, random); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	if _, e, err = nv.GetEncoded(1, 1, buf); err != nil || e != NeedleEncodingGzip {
+		err = fmt.Errorf("GetEncoded(1) encoding: %d error(%v)", e, err)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Compress")
+	if cv, err = NewVolume(3, cbfile, cifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = v.StartCompress(cv); err != nil {
+		t.Errorf("StartCompress() error(%v)", err)
+		goto failed
+	}
+	if err = v.StopCompress(cv); err != nil {
+		t.Errorf("StopCompress() error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeEncoding(cv, buf, data, random); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	if _, e, err = cv.GetEncoded(1, 1, buf); err != nil || e != NeedleEncodingGzip {
+		err = fmt.Errorf("GetEncoded(1) encoding: %d error(%v)", e, err)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("reopen")
+	v.Close()
+	if v, err = NewVolume(1, bfile, ifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeEncoding(v, buf, data, random); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	if _, err = NewVolume(3, bfile, ifile, &VolumeOptions{Encoding: "zstd"}); err != ErrNeedleEncoding {
+		err = fmt.Errorf("NewVolume() encoding error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	err = nil
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if nv != nil {
+		nv.Close()
+	}
+	if cv != nil {
+		cv.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestHttpGetEncoding(t *testing.T) {
+	var (
+		v      *Volume
+		s      *Store
+		err    error
+		req    *http.Request
+		resp   *http.Response
+		body   []byte
+		srv    *httptest.Server
+		data   = bytes.Repeat([]byte(`{"key": "value"}`), 1024)
+		file   = "./test/store.encoding.idx"
+		bfile  = "./test/test.encoding.http"
+		ifile  = "./test/test.encoding.http.idx"
+		config = &Config{Index: file, Volume: VolumeOptions{Encoding: NeedleEncodingOptGzip}}
+	)
+	defer os.Remove(file)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	if s, err = NewStore(config); err != nil {
+		t.Errorf("NewStore() error(%v)", err)
+		t.FailNow()
+	}
+	defer s.Close()
+	if _, err = s.AddVolume(1, bfile, ifile); err != nil {
+		t.Errorf("AddVolume() error(%v)", err)
+		t.FailNow()
+	}
+	time.Sleep(1 * time.Second)
+	if v = s.Volume(1); v == nil {
+		t.Errorf("Volume(1) not exist")
+		t.FailNow()
+	}
+	if err = v.Add(1, 1, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		t.FailNow()
+	}
+	srv = httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		get(s, wr, r)
+	}))
+	defer srv.Close()
+	// buffered and sendfile
+	for _, sendfile := range []int32{0, 1} {
+		v.options.Sendfile = sendfile
+		for _, ae := range []string{"identity", "gzip", "gzip;q=0"} {
+			t.Logf("sendfile: %d, accept encoding: %s", sendfile, ae)
+			if req, err = http.NewRequest("GET", srv.URL+"/get?vid=1&key=1&cookie=1", nil); err != nil {
+				t.Errorf("http.NewRequest() error(%v)", err)
+				t.FailNow()
+			}
+			req.Header.Set("Accept-Encoding", ae)
+			if resp, err = http.DefaultClient.Do(req); err != nil {
+				t.Errorf("http.Do() error(%v)", err)
+				t.FailNow()
+			}
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("X-Original-Size") != fmt.Sprint(len(data)) {
+				t.Errorf("get status: %d error(%v)", resp.StatusCode, err)
+				t.FailNow()
+			}
+			if ae == "gzip" {
+				if resp.Header.Get("Content-Encoding") != "gzip" || len(body) >= len(data) {
+					t.Errorf("get encoded: %s, len: %d not match", resp.Header.Get("Content-Encoding"), len(body))
+					t.FailNow()
+				}
+				if body, err = NeedleEncodingGzip.Decode(body, nil); err != nil {
+					t.Errorf("Decode() error(%v)", err)
+					t.FailNow()
+				}
+			}
+			if !bytes.Equal(body, data) {
+				t.Errorf("get data not match")
+				t.FailNow()
+			}
+		}
+	}
+	v.options.Sendfile = 0
+}
+
+// testVolumeEncoding check the encoded needle 1 and raw needle 2.
+func testVolumeEncoding(v *Volume, buf, data, random []byte) (err error) {
+	var d []byte
+	if d, err = v.Get(1, 1, buf); err != nil || !bytes.Equal(d, data) {
+		return fmt.Errorf("Get(1) error(%v) not match", err)
+	}
+	if d, err = v.Get(2, 2, buf); err != nil || !bytes.Equal(d, random) {
+		return fmt.Errorf("Get(2) error(%v) not match", err)
+	}
+	return nil
+}
@@ -15,6 +15,14 @@ func (bigEndian) PutUint16(b []byte, v uint16) {
 	b[1] = byte(v)
 }
 
+func (bigEndian) WriteUint16(w *bufio.Writer, v uint16) (err error) {
+	if err = w.WriteByte(byte(v >> 8)); err != nil {
+		return
+	}
+	err = w.WriteByte(byte(v))
+	return
+}
+
 func (bigEndian) Int32(b []byte) int32 {
 	return int32(b[3]) | int32(b[2])<<8 | int32(b[1])<<16 | int32(b[0])<<24
 }
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	log "github.com/golang/glog"
+	"io"
+	"os"
+)
+
+// An erasure code volume is a read only volume stored as reed-solomon
+// shards, the block file is striped by rows of data chunks, a row is the
+// next data * chunk bytes of the block file, the data shard i keeps the
+// chunk i of every row, the parity shards keep the parity of every row, so
+// the shards can be placed on different disks or stores, and any data
+// shards of them can reconstruct the block. a needle is read from the data
+// shards its bytes are in, the missing or corrupted ones are reconstructed
+// from the others. the needles are kept in a sorted file next to the first
+// parity + 1 shards, so any parity shards lost keep one.
+//
+// shard file format:
+//  ---------------
+// |     header    |           -------------------
+//  ---------------           |  magic (4bytes)   |
+// |     chunk     |          |  ver (byte)       |
+// |     chunk     |          |  data (byte)      |
+// |     ......    |          |  parity (byte)    |
+//  ---------------           |  index (byte)     |
+//                            |  chunk (uint32)   |
+//                            |  padding(4bytes)  |
+//                            |  size (int64)     |
+//                             -------------------
+//                               int bigendian
+//
+// field     | explanation
+// ---------------------------------------------------------
+// magic     | shard magic number
+// ver       | shard version
+// data      | data shards count
+// parity    | parity shards count
+// index     | the shard index, data shards first
+// chunk     | the chunk size
+// size      | the block file size
+
+const (
+	erasureHeaderSize = 24
+	erasureChunkSize  = 1024 * 1024
+	// header offset
+	erasureVerOffset    = 4
+	erasureDataOffset   = 5
+	erasureParityOffset = 6
+	erasureIndexOffset  = 7
+	erasureChunkOffset  = 8
+	erasureSizeOffset   = 16
+	// ver
+	erasureVer1 = byte(1)
+)
+
+var (
+	erasureMagic = []byte{0x62, 0x66, 0x73, 0x65}
+)
+
+// ErasureVolume convert the volume of block and index file into the shards,
+// the volume must not be served, the keys of o are used by the encrypted
+// volume, the dedup volume isn't supported since the alias cookies aren't
+// in the shards.
+func ErasureVolume(bfile, ifile string, files []string, data int, o *VolumeOptions) (err error) {
+	var (
+		v  *Volume
+		vo VolumeOptions
+	)
+	if o != nil {
+		vo = *o
+	}
+	if _, err = os.Stat(ifile + dedupSuffix); err == nil {
+		return ErrEcDedup
+	}
+	vo.Dedup = false
+	if v, err = NewVolume(0, bfile, ifile, &vo); err != nil {
+		return
+	}
+	err = v.Erasure(files, data)
+	v.Close()
+	return
+}
+
+// Erasure write the volume block into the data shards and parity shards of
+// files, data shards first.
+func (v *Volume) Erasure(files []string, data int) (err error) {
+	var (
+		i       int
+		n       int
+		size    int64
+		rs      *ReedSolomon
+		r       io.Reader
+		f       *os.File
+		ws      = make([]*os.File, len(files))
+		bws     = make([]*bufio.Writer, len(files))
+		shards  = make([][]byte, len(files))
+		header  = make([]byte, erasureHeaderSize)
+		buf     = make([]byte, len(files)*erasureChunkSize)
+		rowSize = data * erasureChunkSize
+	)
+	if rs, err = NewReedSolomon(data, len(files)-data); err != nil {
+		return
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.dedup != nil {
+		return ErrEcDedup
+	}
+	if err = v.block.Flush(); err != nil {
+		return
+	}
+	log.Infof("volume: %d erasure code into %d data shards, %d parity shards", v.Id, rs.data, rs.parity)
+	size = BlockOffset(v.block.offset)
+	if f, err = os.OpenFile(v.block.File, os.O_RDONLY, 0664); err != nil {
+		log.Errorf("os.OpenFile(\"%s\", os.O_RDONLY, 0664) error(%v)", v.block.File, err)
+		return
+	}
+	defer f.Close()
+	// the preallocated tail isn't included
+	r = io.LimitReader(f, size)
+	copy(header, erasureMagic)
+	header[erasureVerOffset] = erasureVer1
+	header[erasureDataOffset] = byte(rs.data)
+	header[erasureParityOffset] = byte(rs.parity)
+	BigEndian.PutUint32(header[erasureChunkOffset:], erasureChunkSize)
+	BigEndian.PutInt64(header[erasureSizeOffset:], size)
+	for i = range files {
+		if ws[i], err = os.OpenFile(files[i], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664); err != nil {
+			log.Errorf("os.OpenFile(\"%s\", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664) error(%v)", files[i], err)
+			goto failed
+		}
+		bws[i] = bufio.NewWriterSize(ws[i], erasureChunkSize)
+		header[erasureIndexOffset] = byte(i)
+		if _, err = bws[i].Write(header); err != nil {
+			goto failed
+		}
+		shards[i] = buf[i*erasureChunkSize : (i+1)*erasureChunkSize]
+	}
+	for {
+		// the last row is zero filled
+		if n, err = io.ReadFull(r, buf[:rowSize]); err == io.EOF {
+			err = nil
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			for i = n; i < rowSize; i++ {
+				buf[i] = 0
+			}
+		} else if err != nil {
+			log.Errorf("block: %s read error(%v)", v.block.File, err)
+			goto failed
+		}
+		if err = rs.Encode(shards); err != nil {
+			goto failed
+		}
+		for i = range shards {
+			if _, err = bws[i].Write(shards[i]); err != nil {
+				goto failed
+			}
+		}
+		if n < rowSize {
+			break
+		}
+	}
+	for i = range files {
+		if err = bws[i].Flush(); err != nil {
+			goto failed
+		}
+		if err = ws[i].Sync(); err != nil {
+			goto failed
+		}
+	}
+	for i = 0; i <= rs.parity; i++ {
+		if err = WriteDiskNeedleMap(files[i]+diskNeedleMapSuffix, v.needles, 0, v.block.offset); err != nil {
+			goto failed
+		}
+	}
+	log.Infof("volume: %d erasure code %d bytes [ok]", v.Id, size)
+failed:
+	if err != nil {
+		log.Errorf("volume: %d erasure code error(%v)", v.Id, err)
+	}
+	for i = range ws {
+		if ws[i] != nil {
+			ws[i].Close()
+		}
+	}
+	return
+}
+
+// EcVolume a read only erasure code volume.
+type EcVolume struct {
+	Id     int32
+	Files  []string
+	chunk  int64
+	size   int64
+	shards []*os.File
+	rs     *ReedSolomon
+	// the needles and block meta
+	needles *DiskNeedleMap
+	block   *SuperBlock
+}
+
+// NewEcVolume open the erasure code volume of shard files, the missing or
+// invalid shards are reconstructed by reads, if o is nil use the default
+// options.
+func NewEcVolume(id int32, files []string, o *VolumeOptions) (v *EcVolume, err error) {
+	var (
+		i, n   int
+		f      *os.File
+		hdr    []byte
+		header = make([]byte, erasureHeaderSize)
+		buf    = make([]byte, superBlockHeaderSize)
+	)
+	if o == nil {
+		o = &VolumeOptions{}
+	}
+	v = &EcVolume{Id: id, Files: files}
+	v.shards = make([]*os.File, len(files))
+	v.block = &SuperBlock{File: files[0], options: o, aeads: make(map[uint16]cipher.AEAD)}
+	for i = range files {
+		if f, err = os.OpenFile(files[i], os.O_RDONLY, 0664); err != nil {
+			log.Errorf("os.OpenFile(\"%s\", os.O_RDONLY, 0664) error(%v)", files[i], err)
+			continue
+		}
+		if _, err = f.ReadAt(header, 0); err == nil {
+			if hdr != nil {
+				err = checkErasureHeader(header, hdr, i, len(files))
+			} else if err = checkErasureHeader(header, header, i, len(files)); err == nil {
+				hdr = append(hdr, header...)
+			}
+		}
+		if err != nil {
+			log.Errorf("ec volume: %d shard: %s error(%v)", id, files[i], err)
+			f.Close()
+			continue
+		}
+		v.shards[i] = f
+		n++
+	}
+	if hdr == nil || n < int(hdr[erasureDataOffset]) {
+		err = ErrEcShards
+		goto failed
+	}
+	if v.rs, err = NewReedSolomon(int(hdr[erasureDataOffset]), int(hdr[erasureParityOffset])); err != nil {
+		goto failed
+	}
+	v.chunk = int64(BigEndian.Uint32(hdr[erasureChunkOffset:]))
+	v.size = BigEndian.Int64(hdr[erasureSizeOffset:])
+	for i = 0; i <= v.rs.parity; i++ {
+		if v.needles, err = OpenDiskNeedleMap(files[i] + diskNeedleMapSuffix); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		goto failed
+	}
+	if err = v.read(buf, 0, -1); err != nil {
+		goto failed
+	}
+	if err = v.block.parseHeader(buf); err != nil {
+		goto failed
+	}
+	log.Infof("ec volume: %d open %d/%d shards", id, n, len(files))
+	return
+failed:
+	v.Close()
+	return
+}
+
+// checkErasureHeader check the shard header of file i, it must be same as
+// the first valid one hdr except the index.
+func checkErasureHeader(header, hdr []byte, i, n int) (err error) {
+	if !bytes.Equal(header[:erasureVerOffset], erasureMagic) {
+		return ErrEcMagic
+	}
+	if header[erasureVerOffset] != erasureVer1 {
+		return ErrEcVer
+	}
+	if int(header[erasureIndexOffset]) != i || int(header[erasureDataOffset])+int(header[erasureParityOffset]) != n {
+		return ErrEcCount
+	}
+	if !bytes.Equal(header[:erasureIndexOffset], hdr[:erasureIndexOffset]) || !bytes.Equal(header[erasureChunkOffset:], hdr[erasureChunkOffset:]) {
+		return ErrEcCount
+	}
+	return
+}
+
+// Get get a needle by key, the data is decrypted and decoded.
+func (v *EcVolume) Get(key, cookie int64, buf []byte) (data []byte, err error) {
+	var (
+		ok          bool
+		bad         int
+		size        int32
+		offset      uint32
+		raw, spare  []byte
+		needleCache NeedleCache
+		needle      = &Needle{}
+	)
+	if needleCache, ok = v.needles.Get(key); !ok {
+		err = ErrNoNeedle
+		return
+	}
+	if offset, size = needleCache.Value(); offset == NeedleCacheDelOffset {
+		err = ErrNeedleDeleted
+		return
+	}
+	raw, spare = buf[:size], buf[size:]
+	// read from the data shards first, if the needle is corrupted, the data
+	// shards it's in are reconstructed one by one
+	for _, bad = range v.columns(BlockOffset(offset), int64(size)) {
+		if err = v.read(raw, BlockOffset(offset), bad); err != nil {
+			return
+		}
+		if err = needle.ParseHeader(raw[:NeedleHeaderSize]); err == nil {
+			if err = needle.ParseData(raw[NeedleHeaderSize:], v.block.Checksum); err == nil {
+				break
+			}
+		}
+		log.Errorf("ec volume: %d key: %d reconstruct shard: %d error(%v)", v.Id, key, bad, err)
+	}
+	if err != nil {
+		return
+	}
+	if needle.Key != key {
+		err = ErrNeedleKey
+		return
+	}
+	if needle.Cookie != cookie {
+		err = ErrNeedleCookie
+		return
+	}
+	if needle.Flag == NeedleStatusDel {
+		err = ErrNeedleDeleted
+		return
+	}
+	if data, spare, err = v.block.Open(needle.Key, needle.Cookie, needle.Data, spare); err != nil {
+		return
+	}
+	data, err = needle.Encoding.Decode(data, spare)
+	return
+}
+
+// columns get the data shards of the block bytes [offset, offset+size), the
+// first is -1, none is reconstructed.
+func (v *EcVolume) columns(offset, size int64) (cols []int) {
+	var (
+		c, col int
+		data   = int64(v.rs.data)
+	)
+	cols = append(cols, -1)
+	for chunk := offset / v.chunk; chunk <= (offset+size-1)/v.chunk; chunk++ {
+		c = int(chunk % data)
+		for _, col = range cols {
+			if col == c {
+				break
+			}
+		}
+		if col != c {
+			cols = append(cols, c)
+		}
+	}
+	return
+}
+
+// read read the block bytes at offset into p, the data shard bad and the
+// unreadable ones are reconstructed.
+func (v *EcVolume) read(p []byte, offset int64, bad int) (err error) {
+	var (
+		c, n  int64
+		col   int
+		soff  int64
+		chunk int64
+		data  = int64(v.rs.data)
+	)
+	if offset+int64(len(p)) > v.size {
+		return ErrEcSize
+	}
+	for len(p) > 0 {
+		chunk = offset / v.chunk
+		col = int(chunk % data)
+		c = offset % v.chunk
+		if n = v.chunk - c; n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		soff = erasureHeaderSize + chunk/data*v.chunk + c
+		if col == bad || v.readShard(col, p[:n], soff) != nil {
+			if err = v.reconstruct(col, p[:n], soff); err != nil {
+				return
+			}
+		}
+		p = p[n:]
+		offset += n
+	}
+	return
+}
+
+// readShard read the shard i at offset into p.
+func (v *EcVolume) readShard(i int, p []byte, offset int64) (err error) {
+	if v.shards[i] == nil {
+		return ErrEcShards
+	}
+	if _, err = v.shards[i].ReadAt(p, offset); err != nil {
+		log.Errorf("ec volume: %d shard: %s ReadAt(%d) error(%v)", v.Id, v.Files[i], offset, err)
+	}
+	return
+}
+
+// reconstruct reconstruct the data shard col at offset into p from the
+// other shards.
+func (v *EcVolume) reconstruct(col int, p []byte, offset int64) (err error) {
+	var (
+		i      int
+		n      int
+		shards = make([][]byte, len(v.shards))
+	)
+	for i = range v.shards {
+		if i == col {
+			continue
+		}
+		if n == v.rs.data {
+			break
+		}
+		shards[i] = make([]byte, len(p))
+		if err = v.readShard(i, shards[i], offset); err != nil {
+			shards[i] = nil
+			continue
+		}
+		n++
+	}
+	if err = v.rs.Reconstruct(shards); err != nil {
+		log.Errorf("ec volume: %d reconstruct shard: %d error(%v)", v.Id, col, err)
+		return
+	}
+	copy(p, shards[col])
+	return
+}
+
+// Close close the erasure code volume.
+func (v *EcVolume) Close() {
+	for _, f := range v.shards {
+		if f != nil {
+			f.Close()
+		}
+	}
+	if v.needles != nil {
+		v.needles.Close()
+	}
+}
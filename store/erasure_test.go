@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	var (
+		i, j   int
+		err    error
+		r      *ReedSolomon
+		shards [][]byte
+		data   = make([][]byte, 6)
+	)
+	if _, err = NewReedSolomon(200, 57); err != ErrEcCount {
+		err = fmt.Errorf("NewReedSolomon(200, 57) error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	if r, err = NewReedSolomon(4, 2); err != nil {
+		t.Errorf("NewReedSolomon() error(%v)", err)
+		goto failed
+	}
+	for i = range data {
+		data[i] = make([]byte, 1024)
+		if i < 4 {
+			rand.Read(data[i])
+		}
+	}
+	if err = r.Encode(data); err != nil {
+		t.Errorf("Encode() error(%v)", err)
+		goto failed
+	}
+	t.Log("Reconstruct")
+	// every two shards lost
+	for i = 0; i < len(data); i++ {
+		for j = i + 1; j < len(data); j++ {
+			shards = append(shards[:0], data...)
+			shards[i], shards[j] = nil, nil
+			if err = r.Reconstruct(shards); err != nil {
+				t.Errorf("Reconstruct() error(%v)", err)
+				goto failed
+			}
+			for k := 0; k < 4; k++ {
+				if !bytes.Equal(shards[k], data[k]) {
+					err = fmt.Errorf("lost: %d, %d shard: %d not match", i, j, k)
+					t.Error(err)
+					goto failed
+				}
+			}
+		}
+	}
+	shards = append(shards[:0], data...)
+	shards[0], shards[1], shards[5] = nil, nil, nil
+	if err = r.Reconstruct(shards); err != ErrEcShards {
+		err = fmt.Errorf("Reconstruct() three lost error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	err = nil
+failed:
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestEcVolume(t *testing.T) {
+	var (
+		i      int
+		v      *Volume
+		ev     *EcVolume
+		err    error
+		d      []byte
+		files  = make([]string, 6)
+		buf    = make([]byte, NeedleMaxSize)
+		large  = make([]byte, 3*erasureChunkSize)
+		bfile  = "./test/test.erasure"
+		ifile  = "./test/test.erasure.idx"
+		keys   = &KeyFile{Cur: 1, keys: map[uint16][]byte{1: bytes.Repeat([]byte{1}, 32)}}
+		o      = &VolumeOptions{Encrypt: true, Keys: keys}
+		needle = []byte("the needle in an erasure code volume")
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	defer os.Remove(ifile + dedupSuffix)
+	for i = range files {
+		files[i] = fmt.Sprintf("./test/test.erasure.%d", i)
+		defer os.Remove(files[i])
+		defer os.Remove(files[i] + diskNeedleMapSuffix)
+	}
+	rand.Read(large)
+	if v, err = NewVolume(1, bfile, ifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	for i = 1; i <= 100; i++ {
+		if err = v.Add(int64(i), int64(i), needle); err != nil {
+			t.Errorf("Add() error(%v)", err)
+			goto failed
+		}
+	}
+	// the needle is in several chunks
+	if err = v.Add(101, 101, large); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if err = v.Del(1); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	v.Close()
+	v = nil
+	if err = ErasureVolume(bfile, ifile, files, 4, o); err != nil {
+		t.Errorf("ErasureVolume() error(%v)", err)
+		goto failed
+	}
+	if ev, err = NewEcVolume(1, files, o); err != nil {
+		t.Errorf("NewEcVolume() error(%v)", err)
+		goto failed
+	}
+	if err = testEcVolume(ev, buf, needle, large); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	if _, err = ev.Get(2, 1, buf); err != ErrNeedleCookie {
+		err = fmt.Errorf("Get(2) cookie error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	ev.Close()
+	t.Log("corrupt")
+	if d, err = ioutil.ReadFile(files[1]); err != nil {
+		t.Errorf("ioutil.ReadFile() error(%v)", err)
+		goto failed
+	}
+	for i = erasureHeaderSize; i < len(d); i += 512 {
+		d[i] ^= 0xff
+	}
+	if err = ioutil.WriteFile(files[1], d, 0664); err != nil {
+		t.Errorf("ioutil.WriteFile() error(%v)", err)
+		goto failed
+	}
+	if ev, err = NewEcVolume(1, files, o); err != nil {
+		t.Errorf("NewEcVolume() error(%v)", err)
+		goto failed
+	}
+	if err = testEcVolume(ev, buf, needle, large); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	ev.Close()
+	t.Log("reconstruct")
+	// a data shard and a parity shard lost
+	os.Remove(files[1])
+	os.Remove(files[5])
+	if ev, err = NewEcVolume(1, files, o); err != nil {
+		t.Errorf("NewEcVolume() error(%v)", err)
+		goto failed
+	}
+	if err = testEcVolume(ev, buf, needle, large); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	ev.Close()
+	ev = nil
+	os.Remove(files[2])
+	os.Remove(files[3])
+	if _, err = NewEcVolume(1, files, o); err != ErrEcShards {
+		err = fmt.Errorf("NewEcVolume() error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	// the dedup volume can not be erasure coded
+	if err = ioutil.WriteFile(ifile+dedupSuffix, nil, 0664); err != nil {
+		t.Errorf("ioutil.WriteFile() error(%v)", err)
+		goto failed
+	}
+	if err = ErasureVolume(bfile, ifile, files, 4, o); err != ErrEcDedup {
+		err = fmt.Errorf("ErasureVolume() dedup error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	err = nil
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if ev != nil {
+		ev.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestHttpGetEcVolume(t *testing.T) {
+	var (
+		i      int
+		s      *Store
+		err    error
+		resp   *http.Response
+		body   []byte
+		srv    *httptest.Server
+		v      *Volume
+		files  = make([]string, 3)
+		data   = []byte("the needle in an erasure code volume")
+		file   = "./test/store.erasure.idx"
+		bfile  = "./test/test.erasure.http"
+		ifile  = "./test/test.erasure.http.idx"
+		config = &Config{Index: file}
+	)
+	defer os.Remove(file)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	for i = range files {
+		files[i] = fmt.Sprintf("./test/test.erasure.http.%d", i)
+		defer os.Remove(files[i])
+		defer os.Remove(files[i] + diskNeedleMapSuffix)
+	}
+	if v, err = NewVolume(1, bfile, ifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		t.FailNow()
+	}
+	if err = v.Add(1, 1, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		t.FailNow()
+	}
+	err = v.Erasure(files, 2)
+	v.Close()
+	if err != nil {
+		t.Errorf("Erasure() error(%v)", err)
+		t.FailNow()
+	}
+	config.Erasure = []EcVolumeConfig{{Id: 2, Shards: files}}
+	if s, err = NewStore(config); err != nil {
+		t.Errorf("NewStore() error(%v)", err)
+		t.FailNow()
+	}
+	defer s.Close()
+	srv = httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		get(s, wr, r)
+	}))
+	defer srv.Close()
+	if resp, err = http.Get(srv.URL + "/get?vid=2&key=1&cookie=1"); err != nil {
+		t.Errorf("http.Get() error(%v)", err)
+		t.FailNow()
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Errorf("get status: %d error(%v) not match", resp.StatusCode, err)
+		t.FailNow()
+	}
+	if resp, err = http.Get(srv.URL + "/get?vid=2&key=2&cookie=2"); err != nil {
+		t.Errorf("http.Get() error(%v)", err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("get status: %d not found", resp.StatusCode)
+		t.FailNow()
+	}
+}
+
+// testEcVolume check the needles of the erasure code volume.
+func testEcVolume(ev *EcVolume, buf, needle, large []byte) (err error) {
+	var d []byte
+	if _, err = ev.Get(1, 1, buf); err != ErrNeedleDeleted {
+		return fmt.Errorf("Get(1) error(%v) not deleted", err)
+	}
+	for i := int64(2); i <= 100; i++ {
+		if d, err = ev.Get(i, i, buf); err != nil || !bytes.Equal(d, needle) {
+			return fmt.Errorf("Get(%d) error(%v) not match", i, err)
+		}
+	}
+	if d, err = ev.Get(101, 101, buf); err != nil || !bytes.Equal(d, large) {
+		return fmt.Errorf("Get(101) error(%v) not match", err)
+	}
+	return nil
+}
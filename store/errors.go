@@ -10,10 +10,18 @@ var (
 	ErrSuperBlockVer     = errors.New("super block ver error")
 	ErrSuperBlockPadding = errors.New("super block padding error")
 	ErrSuperBlockNoSpace = errors.New("super block no left free space")
+	ErrSuperBlockMmap    = errors.New("super block mmap not support")
+	ErrSuperBlockFault   = errors.New("super block mapping fault, the file may be truncated")
+	ErrSuperBlockCrc     = errors.New("super block checksum type error")
+	ErrSuperBlockKey     = errors.New("super block encryption key not set")
 	// needle
 	ErrNeedleExists      = errors.New("needle already exists")
 	ErrNoNeedle          = errors.New("needle not exists")
 	ErrNeedleChecksum    = errors.New("needle checksum error")
+	ErrNeedleCrcType     = errors.New("needle checksum type not support")
+	ErrNeedleEncoding    = errors.New("needle encoding not support")
+	ErrNeedleDecode      = errors.New("needle data decode error")
+	ErrNeedleDecrypt     = errors.New("needle data decrypt error")
 	ErrNeedleFlag        = errors.New("needle flag error")
 	ErrNeedleSize        = errors.New("needle size error")
 	ErrNeedleHeaderMagic = errors.New("needle header magic number error")
@@ -23,13 +31,48 @@ var (
 	ErrNeedleCookie      = errors.New("needle cookie error")
 	ErrNeedleDeleted     = errors.New("needle deleted")
 	ErrNeedleTooLarge    = errors.New("needle too large")
+	ErrNeedleVersion     = errors.New("needle version not exists")
 	// ring
 	ErrRingEmpty = errors.New("ring buffer empty")
 	ErrRingFull  = errors.New("ring buffer full")
 	// store
 	ErrStoreVolumeIndex = errors.New("store volume index error")
+	ErrStoreNoDisk      = errors.New("store no available disk")
 	// volume
 	ErrVolumeNotExist   = errors.New("volume not exist")
+	ErrVolumeExist      = errors.New("volume already exist")
 	ErrVolumeDel        = errors.New("volume del error, may volume del goroutine crash or io too slow")
 	ErrVolumeInCompress = errors.New("volume in compress")
+	ErrVolumeDelExit    = errors.New("volume del goroutine exit")
+	ErrVolumeDelWedged  = errors.New("volume del goroutine wedged")
+	ErrVolumeClosed     = errors.New("volume closed")
+	ErrVolumeNoVersion  = errors.New("volume not versioned")
+	ErrVolumeNeedleMap  = errors.New("volume needle map type not support")
+	ErrVolumeDedup      = errors.New("volume dedup can't be used with versions")
+	ErrListCursor       = errors.New("volume list cursor not exists or expired")
+	// index
+	ErrIndexerExit = errors.New("index write goroutine exit")
+	// export
+	ErrExportMagic = errors.New("export magic number error")
+	ErrExportVer   = errors.New("export ver error")
+	ErrExportCrc   = errors.New("export checksum type error")
+	ErrExportFrame = errors.New("export frame type error")
+	ErrExportCount = errors.New("export needles count not match")
+	// key
+	ErrKeyNotExist = errors.New("encryption key not exists")
+	ErrKeySize     = errors.New("encryption key size error")
+	ErrKeyId       = errors.New("encryption key id 0 is reserved")
+	// erasure code
+	ErrEcMagic     = errors.New("erasure code shard magic number error")
+	ErrEcVer       = errors.New("erasure code shard ver error")
+	ErrEcCount     = errors.New("erasure code shards count error")
+	ErrEcShards    = errors.New("erasure code shards not enough")
+	ErrEcShardSize = errors.New("erasure code shards size not match")
+	ErrEcSize      = errors.New("erasure code read out of block range")
+	ErrEcMatrix    = errors.New("erasure code matrix singular")
+	ErrEcDedup     = errors.New("erasure code dedup volume not support")
+	// sorted
+	ErrSortedMagic = errors.New("sorted magic number error")
+	ErrSortedVer   = errors.New("sorted ver error")
+	ErrSortedCount = errors.New("sorted entries count not match")
 )
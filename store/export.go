@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	log "github.com/golang/glog"
+	"io"
+	"os"
+)
+
+// Export dump the live needles of a volume into a self-describing stream,
+// the stream doesn't depend on the super block layout and alignment, so it
+// can be imported into any version volume.
+//
+// export stream format:
+//  ---------------
+// |     header    |           ----------------
+//  ---------------           |  magic (4bytes)|
+// |     frame     |          |  ver (byte)    |
+// |     frame     |          | checksum(byte) |
+// |     frame     |          | key id (int16) |
+// |     ......    |           ----------------
+// |   end frame   |
+//  ---------------            ----------------
+//                            |  type (byte)   |
+//                            |  key (int64)   |
+//        needle frame ---->  |  cookie (int64)|
+//                            |  flag (byte)   |
+//                            |  size (int32)  |
+//                            |  data (bytes)  |
+//                            | checksum(int32)|
+//                             ----------------
+//                             ----------------
+//        end frame    ---->  |  type (byte)   |
+//                            |  count (int64) |
+//                             ----------------
+//                               int bigendian
+//
+// field     | explanation
+// ---------------------------------------------------------
+// magic     | export magic number
+// ver       | export format version, 2 since the needle flag
+// checksum  | the checksum algorithm, koopman (0) or castagnoli (1)
+// key id    | the encryption key id of data, zero is plain
+// type      | frame type, needle, gzip needle or end
+// key       | 64bit photo id
+// cookie    | random number to mitigate brute force lookups
+// flag      | needle status flag, ok or deleted
+// size      | data size
+// data      | the actual photo data, encoded and sealed as stored
+// checksum  | crc32 of data, used to check integrity
+// count     | needle frames count, used to check stream truncated
+
+const (
+	exportHeaderSize = 8
+	exportMagicSize  = 4
+	exportVerSize    = 1
+	// the checksum algorithm of needle frames, zero is koopman
+	exportChecksumOffset = exportMagicSize + exportVerSize
+	// the encryption key id of needle frames, zero is plain
+	exportKeyOffset = exportChecksumOffset + 1
+	// ver, ver2 add the needle flag, the ver1 frames are rejected
+	exportVer1 = byte(1)
+	exportVer2 = byte(2)
+	// frame type
+	exportFrameNeedle = byte('n')
+	exportFrameGzip   = byte('g')
+	exportFrameEnd    = byte('e')
+	// frame size
+	exportTypeSize         = 1
+	exportKeySize          = 8
+	exportCookieSize       = 8
+	exportFlagSize         = 1
+	exportSizeSize         = 4
+	exportChecksumSize     = 4
+	exportCountSize        = 8
+	exportNeedleHeaderSize = exportTypeSize + exportKeySize + exportCookieSize +
+		exportFlagSize + exportSizeSize
+)
+
+var (
+	exportMagic = []byte{0x62, 0x66, 0x73, 0x78}
+	exportVer   = []byte{exportVer2}
+	// the needle frame type of encoding
+	exportFrames = [...]byte{
+		NeedleEncodingNone: exportFrameNeedle,
+		NeedleEncodingGzip: exportFrameGzip,
+	}
+)
+
+// Export write all the live needles of volume to w, the deleted and
+// overwritten needles are skipped.
+func (v *Volume) Export(w io.Writer) (count int64, err error) {
+	var (
+		ok           bool
+		size         int32
+		end, noffset uint32
+		offset       uint32
+		data, adata  []byte
+		r            *os.File
+		rd           *bufio.Reader
+		n            = &Needle{}
+		needleCache  NeedleCache
+		aliases      []dedupAlias
+		bw           = bufio.NewWriterSize(w, NeedleMaxSize)
+	)
+	log.Infof("volume: %d export", v.Id)
+	// the needles appended after now are not included
+	v.lock.Lock()
+	end = v.block.offset
+	v.lock.Unlock()
+	if r, err = os.OpenFile(v.block.File, os.O_RDONLY, 0664); err != nil {
+		log.Errorf("os.OpenFile(\"%s\", os.O_RDONLY, 0664) error(%v)", v.block.File, err)
+		return
+	}
+	defer r.Close()
+	if _, err = r.Seek(superBlockHeaderOffset, os.SEEK_SET); err != nil {
+		log.Errorf("block: %s Seek() error(%v)", v.block.File, err)
+		return
+	}
+	if err = writeExportHeader(bw, v.block.Checksum, v.block.KeyId); err != nil {
+		return
+	}
+	noffset = NeedleOffset(superBlockHeaderOffset)
+	rd = bufio.NewReaderSize(r, NeedleMaxSize)
+	for noffset < end {
+		// header
+		if data, err = rd.Peek(NeedleHeaderSize); err != nil {
+			break
+		}
+		if err = n.ParseHeader(data); err != nil {
+			break
+		}
+		if _, err = rd.Discard(NeedleHeaderSize); err != nil {
+			break
+		}
+		// data
+		if data, err = rd.Peek(n.DataSize); err != nil {
+			break
+		}
+		if err = n.ParseData(data, v.block.Checksum); err != nil {
+			break
+		}
+		size = int32(NeedleHeaderSize + n.DataSize)
+		// only the needle cache point to is alive
+		v.lock.Lock()
+		needleCache, ok = v.needles.Get(n.Key)
+		_, aliases = v.dedupAliases(noffset)
+		v.lock.Unlock()
+		if offset, _ = needleCache.Value(); ok && offset == noffset && n.Flag == NeedleStatusOK {
+			if err = writeExportNeedle(bw, n.Key, n.Cookie, n.Flag, n.Encoding, n.Data, n.Checksum); err != nil {
+				break
+			}
+			count++
+		}
+		// the aliases are exported as the copies, sealed for the alias
+		for _, a := range aliases {
+			if adata, err = v.block.Reseal(v.block.KeyId, n, a.key, a.cookie); err != nil {
+				break
+			}
+			if err = writeExportNeedle(bw, a.key, a.cookie, n.Flag, n.Encoding, adata, v.block.Checksum.Sum(adata)); err != nil {
+				break
+			}
+			count++
+		}
+		if err != nil {
+			break
+		}
+		if _, err = rd.Discard(n.DataSize); err != nil {
+			break
+		}
+		noffset += NeedleOffset(int64(size))
+	}
+	if err != nil {
+		log.Errorf("volume: %d export error(%v)", v.Id, err)
+		return
+	}
+	if err = writeExportEnd(bw, count); err != nil {
+		return
+	}
+	err = bw.Flush()
+	log.Infof("volume: %d export %d needles", v.Id, count)
+	return
+}
+
+// Import read a export stream, check every needle checksum then write into
+// the volume, the needle frames flagged deleted are skipped. if remap is not
+// nil, the needle key is replaced by remap(key).
+func (v *Volume) Import(r io.Reader, remap func(key int64) int64) (count int64, err error) {
+	var (
+		ecount   int64
+		key      int64
+		cookie   int64
+		flag     byte
+		size     int32
+		checksum uint32
+		c        NeedleChecksum
+		e        NeedleEncoding
+		id       uint16
+		n        = &Needle{}
+		buf      = make([]byte, NeedleMaxSize)
+		rd       = bufio.NewReaderSize(r, NeedleMaxSize)
+	)
+	log.Infof("volume: %d import", v.Id)
+	if c, id, err = readExportHeader(rd, buf); err != nil {
+		return
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for {
+		if _, err = io.ReadFull(rd, buf[:exportTypeSize]); err != nil {
+			break
+		}
+		if buf[0] == exportFrameEnd {
+			if _, err = io.ReadFull(rd, buf[:exportCountSize]); err != nil {
+				break
+			}
+			if ecount = BigEndian.Int64(buf); ecount != count {
+				log.Errorf("volume: %d import count: %d not match end frame count: %d", v.Id, count, ecount)
+				err = ErrExportCount
+			}
+			break
+		}
+		if i := bytes.IndexByte(exportFrames[:], buf[0]); i >= 0 {
+			e = NeedleEncoding(i)
+		} else {
+			err = ErrExportFrame
+			break
+		}
+		if _, err = io.ReadFull(rd, buf[:exportNeedleHeaderSize-exportTypeSize]); err != nil {
+			break
+		}
+		key = BigEndian.Int64(buf)
+		cookie = BigEndian.Int64(buf[exportKeySize:])
+		flag = buf[exportKeySize+exportCookieSize]
+		if flag != NeedleStatusOK && flag != NeedleStatusDel {
+			err = ErrNeedleFlag
+			break
+		}
+		size = BigEndian.Int32(buf[exportKeySize+exportCookieSize+exportFlagSize:])
+		if size > NeedleMaxSize || size < 1 {
+			err = ErrNeedleSize
+			break
+		}
+		if _, err = io.ReadFull(rd, buf[:size+exportChecksumSize]); err != nil {
+			break
+		}
+		checksum = BigEndian.Uint32(buf[size:])
+		if checksum != c.Sum(buf[:size]) {
+			log.Errorf("volume: %d import key: %d checksum error", v.Id, key)
+			err = ErrNeedleChecksum
+			break
+		}
+		count++
+		if flag == NeedleStatusDel {
+			continue
+		}
+		// the data is sealed for the exported key
+		n.Key, n.Cookie, n.Encoding, n.Data = key, cookie, e, buf[:size]
+		if remap != nil {
+			key = remap(key)
+		}
+		if err = v.writeFrom(key, cookie, n, id); err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		// missing end frame
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		log.Errorf("volume: %d import error(%v)", v.Id, err)
+		v.Flush()
+		return
+	}
+	err = v.Flush()
+	log.Infof("volume: %d import %d needles", v.Id, count)
+	return
+}
+
+// writeExportHeader write export header into bufio, c is the checksum
+// algorithm and id is the encryption key id of the needle frames.
+func writeExportHeader(w *bufio.Writer, c NeedleChecksum, id uint16) (err error) {
+	if _, err = w.Write(exportMagic); err != nil {
+		return
+	}
+	if _, err = w.Write(exportVer); err != nil {
+		return
+	}
+	if err = w.WriteByte(byte(c)); err != nil {
+		return
+	}
+	err = BigEndian.WriteUint16(w, id)
+	return
+}
+
+// readExportHeader read and check the export header, get the checksum
+// algorithm and the encryption key id of the needle frames.
+func readExportHeader(r *bufio.Reader, buf []byte) (c NeedleChecksum, id uint16, err error) {
+	if _, err = io.ReadFull(r, buf[:exportHeaderSize]); err != nil {
+		return
+	}
+	if !bytes.Equal(buf[:exportMagicSize], exportMagic) {
+		err = ErrExportMagic
+		return
+	}
+	if buf[exportMagicSize] != exportVer2 {
+		err = ErrExportVer
+		return
+	}
+	if c = NeedleChecksum(buf[exportChecksumOffset]); !c.Valid() {
+		err = ErrExportCrc
+		return
+	}
+	id = BigEndian.Uint16(buf[exportKeyOffset:])
+	return
+}
+
+// writeExportNeedle write a needle frame into bufio, the frame type is by
+// the data encoding.
+func writeExportNeedle(w *bufio.Writer, key, cookie int64, flag byte, e NeedleEncoding, data []byte, checksum uint32) (err error) {
+	if err = w.WriteByte(exportFrames[e]); err != nil {
+		return
+	}
+	if err = BigEndian.WriteInt64(w, key); err != nil {
+		return
+	}
+	if err = BigEndian.WriteInt64(w, cookie); err != nil {
+		return
+	}
+	if err = w.WriteByte(flag); err != nil {
+		return
+	}
+	if err = BigEndian.WriteInt32(w, int32(len(data))); err != nil {
+		return
+	}
+	if _, err = w.Write(data); err != nil {
+		return
+	}
+	err = BigEndian.WriteUint32(w, checksum)
+	return
+}
+
+// writeExportEnd write the end frame into bufio.
+func writeExportEnd(w *bufio.Writer, count int64) (err error) {
+	if err = w.WriteByte(exportFrameEnd); err != nil {
+		return
+	}
+	err = BigEndian.WriteInt64(w, count)
+	return
+}
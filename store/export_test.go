@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	var (
+		v, nv  *Volume
+		err    error
+		count  int64
+		flag   int
+		d      []byte
+		data   = []byte("test")
+		data1  = []byte("test1")
+		buf    = make([]byte, 48)
+		ebuf   = &bytes.Buffer{}
+		bfile  = "./test/test.export"
+		ifile  = "./test/test.export.idx"
+		nbfile = "./test/test.import"
+		nifile = "./test/test.import.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	defer os.Remove(nbfile)
+	defer os.Remove(nifile)
+	if v, err = NewVolume(1, bfile, ifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(1, 1, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(2, 2, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(3, 3, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	// overwrite 1, del 2
+	if err = v.Add(1, 1, data1); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if err = v.Del(2); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	t.Log("Export")
+	if count, err = v.Export(ebuf); err != nil {
+		t.Errorf("Export() error(%v)", err)
+		goto failed
+	}
+	if count != 2 {
+		err = fmt.Errorf("export count: %d not match", count)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Import")
+	if nv, err = NewVolume(2, nbfile, nifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if count, err = nv.Import(bytes.NewReader(ebuf.Bytes()), func(key int64) int64 { return key + 100 }); err != nil {
+		t.Errorf("Import() error(%v)", err)
+		goto failed
+	}
+	if count != 2 {
+		err = fmt.Errorf("import count: %d not match", count)
+		t.Error(err)
+		goto failed
+	}
+	if d, err = nv.Get(101, 1, buf); err != nil {
+		t.Errorf("Get(101) error(%v)", err)
+		goto failed
+	}
+	if !bytes.Equal(d, data1) {
+		err = fmt.Errorf("Get(101) data: %s not match", d)
+		t.Error(err)
+		goto failed
+	}
+	if _, err = nv.Get(103, 3, buf); err != nil {
+		t.Errorf("Get(103) error(%v)", err)
+		goto failed
+	}
+	if _, err = nv.Get(102, 2, buf); err != ErrNoNeedle {
+		err = fmt.Errorf("Get(102) must be ErrNoNeedle")
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Import flag")
+	// first needle frame flag
+	d = append([]byte(nil), ebuf.Bytes()...)
+	flag = exportHeaderSize + exportTypeSize + exportKeySize + exportCookieSize
+	if d[flag] != NeedleStatusOK {
+		err = fmt.Errorf("export flag: %d not match", d[flag])
+		t.Error(err)
+		goto failed
+	}
+	d[flag] = NeedleStatusDel
+	if count, err = nv.Import(bytes.NewReader(d), func(key int64) int64 { return key + 200 }); err != nil {
+		t.Errorf("Import() error(%v)", err)
+		goto failed
+	}
+	if count != 2 {
+		err = fmt.Errorf("import count: %d not match", count)
+		t.Error(err)
+		goto failed
+	}
+	if _, err = nv.Get(201, 1, buf); err != nil {
+		t.Errorf("Get(201) error(%v)", err)
+		goto failed
+	}
+	if _, err = nv.Get(203, 3, buf); err != ErrNoNeedle {
+		err = fmt.Errorf("Get(203) must be ErrNoNeedle")
+		t.Error(err)
+		goto failed
+	}
+	d[flag] = 0xff
+	if _, err = nv.Import(bytes.NewReader(d), nil); err != ErrNeedleFlag {
+		err = fmt.Errorf("Import() must be ErrNeedleFlag")
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Import ver1")
+	d[flag] = NeedleStatusOK
+	d[exportMagicSize] = exportVer1
+	if _, err = nv.Import(bytes.NewReader(d), nil); err != ErrExportVer {
+		err = fmt.Errorf("Import() must be ErrExportVer")
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Import checksum error")
+	d = ebuf.Bytes()
+	// first needle frame data
+	d[exportHeaderSize+exportNeedleHeaderSize] ^= 0xff
+	if _, err = nv.Import(bytes.NewReader(d), nil); err != ErrNeedleChecksum {
+		err = fmt.Errorf("Import() must be ErrNeedleChecksum")
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Import truncated")
+	if _, err = nv.Import(bytes.NewReader(d[:exportHeaderSize]), nil); err == nil {
+		err = fmt.Errorf("Import() truncated stream must error")
+		t.Error(err)
+		goto failed
+	}
+	err = nil
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if nv != nil {
+		nv.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
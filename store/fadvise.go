@@ -0,0 +1,27 @@
+package main
+
+import (
+	log "github.com/golang/glog"
+	"os"
+)
+
+// pageDropper drop the written pages of a file from the os page cache every
+// size bytes written, so the uploaded needles won't evict the hot ones, the
+// pages of the last window are advised again, the ones dirty last time are
+// dropped after written back.
+type pageDropper struct {
+	size  int64
+	start int64
+	last  int64
+}
+
+// advise drop the pages before offset if size bytes written since last time.
+func (d *pageDropper) advise(f *os.File, file string, offset int64) {
+	if d.size <= 0 || offset-d.last < d.size {
+		return
+	}
+	if err := fadvise(f, d.start, offset-d.start); err != nil {
+		log.Errorf("fadvise(\"%s\", %d, %d) error(%v)", file, d.start, offset-d.start, err)
+	}
+	d.start, d.last = d.last, offset
+}
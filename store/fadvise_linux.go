@@ -0,0 +1,15 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// fadvise drop the file pages in range from the os page cache, the dirty
+// pages are only written back.
+func fadvise(f *os.File, offset, size int64) error {
+	return unix.Fadvise(int(f.Fd()), offset, size, unix.FADV_DONTNEED)
+}
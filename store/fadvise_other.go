@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+)
+
+// fadvise isn't supported, the pages are kept in the os page cache.
+func fadvise(f *os.File, offset, size int64) error {
+	return nil
+}
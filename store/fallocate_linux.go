@@ -0,0 +1,14 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate preallocate the file space, the file size is extended.
+func fallocate(f *os.File, offset, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), 0, offset, size)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+)
+
+// fallocate extend the file size, the space isn't reserved without
+// fallocate syscall.
+func fallocate(f *os.File, offset, size int64) error {
+	return f.Truncate(offset + size)
+}
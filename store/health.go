@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// FailedVolume the volume failed recovery when store init.
+type FailedVolume struct {
+	Id    int32  `json:"id"`
+	Block string `json:"block"`
+	Index string `json:"index"`
+	Error string `json:"error"`
+}
+
+// VolumeHealth the volume health detail.
+type VolumeHealth struct {
+	Id    int32  `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// StoreHealth the store health detail.
+type StoreHealth struct {
+	Alive   bool            `json:"alive"`
+	Ready   bool            `json:"ready"`
+	Command bool            `json:"command"`
+	Failed  []*FailedVolume `json:"failed,omitempty"`
+	Volumes []*VolumeHealth `json:"volumes,omitempty"`
+}
+
+// diskErrnos the errnos of a failed device, the others like ENOENT, EINVAL
+// are not the disk's fault.
+var diskErrnos = []syscall.Errno{syscall.EIO, syscall.ENOSPC, syscall.EROFS, syscall.ENXIO, syscall.ENODEV}
+
+// isIOError check the error is a disk io error or a mapping fault, a file
+// closed by the volume close never is.
+func isIOError(err error) (ok bool) {
+	var errno syscall.Errno
+	if err == nil || errors.Is(err, os.ErrClosed) {
+		return
+	}
+	if errors.Is(err, ErrSuperBlockFault) {
+		return true
+	}
+	for _, errno = range diskErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return
+}
+
+// Alive check the store process and command goroutine.
+func (s *Store) Alive() (h *StoreHealth) {
+	h = &StoreHealth{}
+	h.Command = atomic.LoadInt32(&s.running) == 1
+	h.Alive = h.Command
+	return
+}
+
+// Ready check the store is fit to serve, any failed recovery volume, disk io
+// error, index or del goroutine exit make the store unready.
+func (s *Store) Ready() (h *StoreHealth) {
+	var (
+		err error
+		d   *Disk
+		v   *Volume
+	)
+	h = s.Alive()
+	h.Ready = h.Alive
+	if h.Failed = s.failed; len(h.Failed) > 0 {
+		h.Ready = false
+	}
+	// the recovered disks are ready again
+	for _, d = range s.disks {
+		d.Probe()
+	}
+	for _, v = range s.Volumes() {
+		// the replaced volume is skipped
+		if !v.Ref() {
+			continue
+		}
+		if err = v.Health(); err != nil {
+			h.Ready = false
+			h.Volumes = append(h.Volumes, &VolumeHealth{Id: v.Id, Error: err.Error()})
+		} else {
+			h.Volumes = append(h.Volumes, &VolumeHealth{Id: v.Id})
+		}
+		v.Unref()
+	}
+	return
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStoreHealth(t *testing.T) {
+	var (
+		s     *Store
+		v     *Volume
+		err   error
+		h     *StoreHealth
+		file  = "./test/health.idx"
+		bfile = "./test/health.volume"
+		ifile = "./test/health.volume.idx"
+	)
+	defer os.Remove(file)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	// volume 2 block magic error
+	if err = ioutil.WriteFile(bfile, []byte("bfsbfsbfs"), 0664); err != nil {
+		t.Errorf("ioutil.WriteFile() error(%v)", err)
+		goto failed
+	}
+	if err = ioutil.WriteFile(file, []byte(fmt.Sprintf("%s,%s,2\n", bfile, ifile)), 0664); err != nil {
+		t.Errorf("ioutil.WriteFile() error(%v)", err)
+		goto failed
+	}
+	if s, err = NewStore(&Config{Index: file}); err != nil {
+		t.Errorf("NewStore() error(%v)", err)
+		goto failed
+	}
+	defer s.Close()
+	t.Log("Alive")
+	if h = s.Alive(); !h.Alive || !h.Command {
+		err = fmt.Errorf("store must alive")
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Ready failed volume")
+	if h = s.Ready(); h.Ready || len(h.Failed) != 1 || h.Failed[0].Id != 2 {
+		err = fmt.Errorf("store must not ready")
+		t.Error(err)
+		goto failed
+	}
+	s.failed = nil
+	os.Remove(bfile)
+	if _, err = s.AddVolume(1, bfile, ifile); err != nil {
+		t.Errorf("AddVolume() error(%v)", err)
+		goto failed
+	}
+	time.Sleep(1 * time.Second)
+	t.Log("Ready")
+	if h = s.Ready(); !h.Ready || len(h.Volumes) != 1 {
+		err = fmt.Errorf("store must ready")
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Ready io error")
+	v = s.Volume(1)
+	v.setIOError(&os.PathError{Op: "write", Path: bfile, Err: syscall.EIO})
+	if h = s.Ready(); h.Ready || h.Volumes[0].Error == "" {
+		err = fmt.Errorf("store must not ready")
+		t.Error(err)
+		goto failed
+	}
+failed:
+	if err != nil {
+		t.FailNow()
+	}
+}
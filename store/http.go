@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// StartHttp start the store http server, serve the admin apis.
+func StartHttp(s *Store, addr string) {
+	var serveMux = http.NewServeMux()
+	prometheus.MustRegister(NewStoreCollector(s))
+	serveMux.Handle("/metrics", promhttp.Handler())
+	serveMux.HandleFunc("/healthz", func(wr http.ResponseWriter, r *http.Request) {
+		var h = s.Alive()
+		retHealth(wr, h, h.Alive)
+	})
+	serveMux.HandleFunc("/readyz", func(wr http.ResponseWriter, r *http.Request) {
+		var h = s.Ready()
+		retHealth(wr, h, h.Ready)
+	})
+	serveMux.HandleFunc("/list", func(wr http.ResponseWriter, r *http.Request) {
+		list(s, wr, r)
+	})
+	serveMux.HandleFunc("/get", func(wr http.ResponseWriter, r *http.Request) {
+		get(s, wr, r)
+	})
+	go func() {
+		var err error
+		log.Infof("start http listen addr: %s", addr)
+		if err = http.ListenAndServe(addr, serveMux); err != nil {
+			log.Errorf("http.ListenAndServe(\"%s\") error(%v)", addr, err)
+		}
+	}()
+	return
+}
+
+// retHealth write the health detail json, 503 if not ok.
+func retHealth(wr http.ResponseWriter, h *StoreHealth, ok bool) {
+	var (
+		err  error
+		data []byte
+	)
+	if data, err = json.Marshal(h); err != nil {
+		log.Errorf("json.Marshal(\"%v\") error(%v)", h, err)
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wr.Header().Set("Content-Type", "application/json;charset=utf-8")
+	if !ok {
+		wr.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if _, err = wr.Write(data); err != nil {
+		log.Errorf("http Write() error(%v)", err)
+	}
+	return
+}
+
+// listRes the list api response, pass next as after and cursor to get the
+// next page of the same snapshot.
+type listRes struct {
+	Needles []NeedleInfo `json:"needles"`
+	Next    int64        `json:"next"`
+	Cursor  uint64       `json:"cursor"`
+	More    bool         `json:"more"`
+}
+
+// list list the needles of a volume in key order, params: vid, after, limit
+// and cursor, the first page takes a new snapshot without cursor.
+func list(s *Store, wr http.ResponseWriter, r *http.Request) {
+	var (
+		err    error
+		vid    int64
+		after  int64
+		limit  int
+		cursor uint64
+		data   []byte
+		v      *Volume
+		res    = &listRes{}
+		q      = r.URL.Query()
+	)
+	if vid, err = strconv.ParseInt(q.Get("vid"), 10, 32); err != nil {
+		http.Error(wr, "bad vid", http.StatusBadRequest)
+		return
+	}
+	if q.Get("after") != "" {
+		if after, err = strconv.ParseInt(q.Get("after"), 10, 64); err != nil {
+			http.Error(wr, "bad after", http.StatusBadRequest)
+			return
+		}
+	} else {
+		after = -1 << 63
+	}
+	if limit = listLimitDefault; q.Get("limit") != "" {
+		if limit, err = strconv.Atoi(q.Get("limit")); err != nil || limit <= 0 {
+			http.Error(wr, "bad limit", http.StatusBadRequest)
+			return
+		}
+		if limit > listLimitMax {
+			limit = listLimitMax
+		}
+	}
+	if q.Get("cursor") != "" {
+		if cursor, err = strconv.ParseUint(q.Get("cursor"), 10, 64); err != nil {
+			http.Error(wr, "bad cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	if v = s.RefVolume(int32(vid)); v == nil {
+		http.Error(wr, ErrVolumeNotExist.Error(), http.StatusNotFound)
+		return
+	}
+	defer v.Unref()
+	if res.Needles, res.Cursor, res.More, err = v.List(cursor, after, limit); err != nil {
+		http.Error(wr, err.Error(), http.StatusGone)
+		return
+	}
+	if len(res.Needles) > 0 {
+		res.Next = res.Needles[len(res.Needles)-1].Key
+	} else {
+		res.Needles = []NeedleInfo{}
+		res.Next = after
+	}
+	if data, err = json.Marshal(res); err != nil {
+		log.Errorf("json.Marshal(\"%v\") error(%v)", res, err)
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wr.Header().Set("Content-Type", "application/json;charset=utf-8")
+	if _, err = wr.Write(data); err != nil {
+		log.Errorf("http Write() error(%v)", err)
+	}
+	return
+}
+
+// get get the needle data, params: vid, key, cookie and version, the old
+// versions are read from the versioned volume and decoded, the large needles
+// are sent from the block file with sendfile, the encoded needles are sent
+// as is if the client accepts the encoding, otherwise decoded.
+func get(s *Store, wr http.ResponseWriter, r *http.Request) {
+	var (
+		err         error
+		vid         int64
+		key, cookie int64
+		version     int64
+		buf, data   []byte
+		e           NeedleEncoding
+		v           *Volume
+		ev          *EcVolume
+		nf          *NeedleFile
+		q           = r.URL.Query()
+	)
+	if vid, err = strconv.ParseInt(q.Get("vid"), 10, 32); err != nil {
+		http.Error(wr, "bad vid", http.StatusBadRequest)
+		return
+	}
+	if key, err = strconv.ParseInt(q.Get("key"), 10, 64); err != nil {
+		http.Error(wr, "bad key", http.StatusBadRequest)
+		return
+	}
+	if cookie, err = strconv.ParseInt(q.Get("cookie"), 10, 64); err != nil {
+		http.Error(wr, "bad cookie", http.StatusBadRequest)
+		return
+	}
+	if q.Get("version") != "" {
+		if version, err = strconv.ParseInt(q.Get("version"), 10, 32); err != nil || version < 0 {
+			http.Error(wr, "bad version", http.StatusBadRequest)
+			return
+		}
+	}
+	// the volume and the mapping data are held until the response written
+	if v = s.RefVolume(int32(vid)); v == nil {
+		if ev = s.EcVolume(int32(vid)); ev == nil {
+			http.Error(wr, ErrVolumeNotExist.Error(), http.StatusNotFound)
+			return
+		}
+	} else {
+		defer v.Unref()
+	}
+	wr.Header().Set("Content-Type", "application/octet-stream")
+	wr.Header().Set("Vary", "Accept-Encoding")
+	// the erasure code needles are decoded
+	if ev != nil {
+		if version != 0 {
+			retGetError(wr, ErrVolumeNoVersion)
+			return
+		}
+		buf = s.Buffer()
+		defer s.FreeBuffer(buf)
+		if data, err = ev.Get(key, cookie, buf); err != nil {
+			retGetError(wr, err)
+			return
+		}
+		setEncoding(wr, NeedleEncodingNone, int32(len(data)))
+		wr.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if _, err = wr.Write(data); err != nil {
+			log.Errorf("http Write() error(%v)", err)
+		}
+		return
+	}
+	if version == 0 && v.Sendfile(key) {
+		if nf, err = v.Open(key, cookie); err != nil {
+			retGetError(wr, err)
+			return
+		}
+		defer nf.Close()
+	}
+	if nf == nil || (nf.Encoding != NeedleEncodingNone && !acceptEncoding(r, nf.Encoding)) {
+		buf = s.Buffer()
+		defer s.FreeBuffer(buf)
+		if version != 0 {
+			data, err = v.GetVersion(key, cookie, int32(version), buf)
+		} else if v.encoding != NeedleEncodingNone && acceptEncoding(r, v.encoding) {
+			data, e, err = v.GetEncoded(key, cookie, buf)
+		} else {
+			data, err = v.Get(key, cookie, buf)
+		}
+		if err != nil {
+			retGetError(wr, err)
+			return
+		}
+		setEncoding(wr, e, e.Size(data))
+		wr.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if _, err = wr.Write(data); err != nil {
+			log.Errorf("http Write() error(%v)", err)
+		}
+		return
+	}
+	setEncoding(wr, nf.Encoding, nf.OriginalSize)
+	wr.Header().Set("Content-Length", strconv.Itoa(int(nf.Size)))
+	if _, err = nf.WriteTo(wr); err != nil {
+		log.Errorf("needle: %d WriteTo() error(%v)", key, err)
+		if err == ErrNeedleChecksum {
+			// the client must not take the corrupted data as complete
+			panic(http.ErrAbortHandler)
+		}
+	}
+	return
+}
+
+// acceptEncoding check the client accepts the encoding.
+func acceptEncoding(r *http.Request, e NeedleEncoding) bool {
+	var i int
+	for _, ae := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		q := ""
+		if i = strings.IndexByte(ae, ';'); i >= 0 {
+			ae, q = ae[:i], ae[i+1:]
+		}
+		if strings.TrimSpace(ae) == e.String() {
+			return strings.TrimSpace(q) != "q=0"
+		}
+	}
+	return false
+}
+
+// setEncoding set the content encoding and the original size headers.
+func setEncoding(wr http.ResponseWriter, e NeedleEncoding, size int32) {
+	if e != NeedleEncodingNone {
+		wr.Header().Set("Content-Encoding", e.String())
+	}
+	wr.Header().Set("X-Original-Size", strconv.Itoa(int(size)))
+}
+
+// retGetError write the get api error.
+func retGetError(wr http.ResponseWriter, err error) {
+	switch err {
+	case ErrNoNeedle, ErrNeedleDeleted, ErrNeedleKey, ErrNeedleCookie, ErrNeedleVersion:
+		http.Error(wr, err.Error(), http.StatusNotFound)
+	case ErrVolumeNoVersion:
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -6,6 +6,9 @@ import (
 	log "github.com/golang/glog"
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Index for fast recovery super block needle cache in memory, index is async
@@ -27,6 +30,10 @@ import (
 // key       | needle key (photo id)
 // offset    | needle offset in super block (aligned)
 // size      | needle data size
+//
+// a deleted needle appends a tombstone index which offset is zero (no
+// needle can be at offset zero, it's the super block header), so the
+// delete is durable before the super block needle flag updated.
 
 const (
 	// signal command
@@ -42,15 +49,27 @@ const (
 	indexKeyOffset    = 0
 	indexOffsetOffset = indexKeyOffset + indexKeySize
 	indexSizeOffset   = indexOffsetOffset + indexOffsetSize
+	// ring
+	indexRingDefault    = 102400
+	indexTimeoutDefault = 100 * time.Millisecond
 )
 
 // Indexer used for fast recovery super block needle cache.
 type Indexer struct {
 	f      *os.File
+	lock   sync.Mutex
 	bw     *bufio.Writer
 	signal chan int
+	space  chan struct{}
 	ring   *Ring
 	File   string
+	exit   int32
+	done   chan struct{}
+	// ring full
+	timeout time.Duration
+	full    int64
+	// page cache
+	drop pageDropper
 }
 
 // Index index data.
@@ -82,6 +101,9 @@ Size:           %d
 func NewIndexer(file string, ring int) (i *Indexer, err error) {
 	i = &Indexer{}
 	i.signal = make(chan int, signalNum)
+	i.space = make(chan struct{}, signalNum)
+	i.done = make(chan struct{})
+	i.timeout = indexTimeoutDefault
 	i.ring = NewRing(ring)
 	i.File = file
 	if i.f, err = os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0664); err != nil {
@@ -98,6 +120,11 @@ func (i *Indexer) ready() bool {
 	return (<-i.signal) == indexReady
 }
 
+// Alive check the indexer write goroutine is running.
+func (i *Indexer) Alive() bool {
+	return atomic.LoadInt32(&i.exit) == 0
+}
+
 // Signal wake up indexer write goroutine merge index data.
 func (i *Indexer) Signal() {
 	// just ignore duplication signal
@@ -119,22 +146,88 @@ func writeIndex(w *bufio.Writer, key int64, offset uint32, size int32) (err erro
 	return
 }
 
-// Add append a index data to ring, signal bg goroutine merge to disk.
+// Add append a index data to ring, signal bg goroutine merge to disk, if
+// the ring is full, wait the bg goroutine free space.
 func (i *Indexer) Add(key int64, offset uint32, size int32) (err error) {
-	if err = i.Append(key, offset, size); err != nil {
+	if err = i.Append(key, offset, size); err == ErrRingFull {
+		atomic.AddInt64(&i.full, 1)
+		err = i.wait(key, offset, size)
+	}
+	if err != nil {
 		return
 	}
 	i.Signal()
 	return
 }
 
+// wait wait the bg goroutine merge the ring then append the index data, if
+// timeout, merge the ring and write the index data synchronously.
+func (i *Indexer) wait(key int64, offset uint32, size int32) (err error) {
+	var timer = time.NewTimer(i.timeout)
+	defer timer.Stop()
+	for {
+		i.Signal()
+		select {
+		case <-i.space:
+			if err = i.Append(key, offset, size); err != ErrRingFull {
+				return
+			}
+		case <-timer.C:
+			log.Warningf("index: %s ring full, write synchronously", i.File)
+			err = i.writeSync(key, offset, size)
+			return
+		}
+	}
+}
+
+// writeSync merge the ring then write the index data and flush, so the
+// index data is after all the appended.
+func (i *Indexer) writeSync(key int64, offset uint32, size int32) (err error) {
+	i.lock.Lock()
+	if err = i.merge(); err == nil {
+		if err = writeIndex(i.bw, key, offset, size); err == nil {
+			err = i.flush()
+		}
+	}
+	i.lock.Unlock()
+	return
+}
+
+// Merge merge the ring and flush, return the index file offset which all
+// the index data appended before are written.
+func (i *Indexer) Merge() (offset int64, err error) {
+	i.lock.Lock()
+	if err = i.merge(); err == nil {
+		if err = i.flush(); err == nil {
+			if offset, err = i.f.Seek(0, os.SEEK_CUR); err != nil {
+				log.Errorf("index: %s Seek() error(%v)", i.File, err)
+			}
+		}
+	}
+	i.lock.Unlock()
+	return
+}
+
+// Del write a tombstone index of the key synchronously.
+func (i *Indexer) Del(key int64, size int32) (err error) {
+	if err = i.writeSync(key, NeedleCacheDelOffset, size); err != nil {
+		log.Errorf("index: %s del key: %d error(%v)", i.File, key, err)
+	}
+	return
+}
+
+// Full get the times of ring full.
+func (i *Indexer) Full() int64 {
+	return atomic.LoadInt64(&i.full)
+}
+
 // Append append a index data to ring.
 func (i *Indexer) Append(key int64, offset uint32, size int32) (err error) {
 	var (
 		index *Index
 	)
 	if index, err = i.ring.Set(); err != nil {
-		log.Errorf("index ring buffer full")
+		log.V(1).Infof("index: %s ring buffer full", i.File)
 		return
 	}
 	index.Key = key
@@ -144,14 +237,24 @@ func (i *Indexer) Append(key int64, offset uint32, size int32) (err error) {
 	return
 }
 
-// Write append index needle to disk, WARN can't concurrency with write.
+// Write append index needle to disk.
 func (i *Indexer) Write(key int64, offset uint32, size int32) (err error) {
+	i.lock.Lock()
 	err = writeIndex(i.bw, key, offset, size)
+	i.lock.Unlock()
 	return
 }
 
 // Flush flush writer buffer.
 func (i *Indexer) Flush() (err error) {
+	i.lock.Lock()
+	err = i.flush()
+	i.lock.Unlock()
+	return
+}
+
+// flush flush writer buffer, must called with lock.
+func (i *Indexer) flush() (err error) {
 	for {
 		// write may be less than request, we call flush in a loop
 		if err = i.bw.Flush(); err != nil && err != io.ErrShortWrite {
@@ -160,15 +263,25 @@ func (i *Indexer) Flush() (err error) {
 		} else if err == io.ErrShortWrite {
 			continue
 		}
-		// TODO append N times call flush then clean the os page cache
-		// page cache no used here...
-		// after upload a photo, we cache in user-level.
 		break
 	}
+	if i.drop.size > 0 {
+		if offset, serr := i.f.Seek(0, os.SEEK_CUR); serr == nil {
+			i.drop.advise(i.f, i.File, offset)
+		}
+	}
 	return
 }
 
-// merge get index data from ring then write to disk.
+// Sync fsync the index file.
+func (i *Indexer) Sync() (err error) {
+	if err = i.f.Sync(); err != nil {
+		log.Errorf("index: %s Sync() error(%v)", i.File, err)
+	}
+	return
+}
+
+// merge get index data from ring then write to disk, must called with lock.
 func (i *Indexer) merge() (err error) {
 	var index *Index
 	for {
@@ -182,6 +295,11 @@ func (i *Indexer) merge() (err error) {
 		}
 		i.ring.GetAdv()
 	}
+	// wake up the ring full waiter
+	select {
+	case i.space <- struct{}{}:
+	default:
+	}
 	return
 }
 
@@ -196,36 +314,51 @@ func (i *Indexer) write() {
 			log.Info("signal index write goroutine exit")
 			break
 		}
+		i.lock.Lock()
 		if err = i.merge(); err != nil {
+			i.lock.Unlock()
 			log.Errorf("index merge error(%v)", err)
 			break
 		}
-		if err = i.Flush(); err != nil {
+		err = i.flush()
+		i.lock.Unlock()
+		if err != nil {
 			break
 		}
 	}
+	i.lock.Lock()
 	if err = i.merge(); err != nil {
 		log.Errorf("index merge error(%v)", err)
+	} else if err = i.flush(); err != nil {
+		log.Errorf("index flush error(%v)", err)
 	}
+	i.lock.Unlock()
 	if err = i.f.Sync(); err != nil {
 		log.Errorf("index: %s Sync() error(%v)", i.File, err)
 	}
 	err = i.f.Close()
+	atomic.StoreInt32(&i.exit, 1)
+	close(i.done)
 	log.Errorf("index write goroutine exit")
 	return
 }
 
 // Recovery recovery needle cache meta data in memory, index file  will stop
 // at the right parse data offset.
-func (i *Indexer) Recovery(needles map[int64]NeedleCache) (noffset uint32, err error) {
+func (i *Indexer) Recovery(needles NeedleMap) (noffset uint32, err error) {
+	return i.recovery(needles, 0, nil)
+}
+
+// recovery recovery needle cache from the index file offset, fn is called
+// with every index before it's applied to the needle cache.
+func (i *Indexer) recovery(needles NeedleMap, offset int64, fn func(ix *Index)) (noffset uint32, err error) {
 	var (
-		rd     *bufio.Reader
-		data   []byte
-		offset int64
-		ix     = &Index{}
+		rd   *bufio.Reader
+		data []byte
+		ix   = &Index{}
 	)
-	log.Infof("index: %s recovery", i.File)
-	if offset, err = i.f.Seek(0, os.SEEK_SET); err != nil {
+	log.Infof("index: %s recovery from offset: %d", i.File, offset)
+	if offset, err = i.f.Seek(offset, os.SEEK_SET); err != nil {
 		log.Errorf("index: %s Seek() error(%v)", i.File, err)
 		return
 	}
@@ -246,9 +379,20 @@ func (i *Indexer) Recovery(needles map[int64]NeedleCache) (noffset uint32, err e
 		}
 		log.V(1).Info(ix.String())
 		offset += int64(indexSize)
-		needles[ix.Key] = NewNeedleCache(ix.Offset, ix.Size)
-		// save this for recovery supper block
-		noffset = ix.Offset + NeedleOffset(int64(ix.Size))
+		if fn != nil {
+			fn(ix)
+		}
+		if ix.Offset == NeedleCacheDelOffset {
+			// tombstone
+			needles.Set(ix.Key, NewNeedleCache(NeedleCacheDelOffset, ix.Size))
+			continue
+		}
+		needles.Set(ix.Key, NewNeedleCache(ix.Offset, ix.Size))
+		// save this for recovery supper block, a dedup alias points to an
+		// older needle, so the block offset never goes back
+		if end := ix.Offset + NeedleOffset(int64(ix.Size)); end > noffset {
+			noffset = end
+		}
 	}
 	if err != io.EOF {
 		return
@@ -261,8 +405,22 @@ func (i *Indexer) Recovery(needles map[int64]NeedleCache) (noffset uint32, err e
 	return
 }
 
-// Close close the indexer file.
+// indexKeys get the index number of index file, used to presize the needle
+// map, zero if the file not exists.
+func indexKeys(file string) int {
+	var (
+		err error
+		fi  os.FileInfo
+	)
+	if fi, err = os.Stat(file); err != nil {
+		return 0
+	}
+	return int(fi.Size() / indexSize)
+}
+
+// Close close the indexer file, wait the left index data merged.
 func (i *Indexer) Close() {
 	close(i.signal)
+	<-i.done
 	return
 }
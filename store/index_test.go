@@ -13,7 +13,7 @@ func init() {
 func TestIndex(t *testing.T) {
 	var (
 		file    = "./test/test.idx"
-		needles = make(map[int64]NeedleCache)
+		needles = make(HashNeedleMap)
 		noffset uint32
 	)
 	defer os.Remove(file)
@@ -112,7 +112,7 @@ failed:
 func TestIndex1(t *testing.T) {
 	var (
 		file    = "./test/test1.idx"
-		needles = make(map[int64]NeedleCache)
+		needles = make(HashNeedleMap)
 		noffset uint32
 	)
 	i, err := NewIndexer(file, 10)
@@ -173,3 +173,68 @@ failed:
 		t.FailNow()
 	}
 }
+
+func TestIndexRingFull(t *testing.T) {
+	var (
+		file    = "./test/test2.idx"
+		needles = make(HashNeedleMap)
+		noffset uint32
+	)
+	defer os.Remove(file)
+	i, err := NewIndexer(file, 2)
+	if err != nil {
+		t.Errorf("NewIndexer(\"%s\", 2)", file)
+		goto failed
+	}
+	// fill the ring without signal the merge goroutine
+	if err = i.Append(1, 1, 8); err != nil {
+		t.Errorf("i.Append() error(%v)", err)
+		goto failed
+	}
+	if err = i.Append(2, 2, 8); err != nil {
+		t.Errorf("i.Append() error(%v)", err)
+		goto failed
+	}
+	t.Log("Test Add() ring full")
+	if err = i.Add(3, 3, 8); err != nil {
+		t.Errorf("i.Add() error(%v)", err)
+		goto failed
+	}
+	if i.Full() != 1 {
+		err = fmt.Errorf("ring full: %d not match", i.Full())
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Test Add() ring full timeout")
+	i.timeout = 0
+	if err = i.Append(4, 4, 8); err != nil {
+		t.Errorf("i.Append() error(%v)", err)
+		goto failed
+	}
+	if err = i.Append(5, 5, 8); err != nil && err != ErrRingFull {
+		t.Errorf("i.Append() error(%v)", err)
+		goto failed
+	}
+	if err = i.Add(6, 6, 8); err != nil {
+		t.Errorf("i.Add() error(%v)", err)
+		goto failed
+	}
+	time.Sleep(1 * time.Second)
+	if noffset, err = i.Recovery(needles); err != nil {
+		t.Errorf("i.Recovery() error(%v)", err)
+		goto failed
+	}
+	// no index lost
+	if noffset != 7 {
+		err = fmt.Errorf("noffset: %d not match", noffset)
+		t.Error(err)
+		goto failed
+	}
+failed:
+	if i != nil {
+		i.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
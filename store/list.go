@@ -0,0 +1,184 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	listLimitDefault = 1000
+	listLimitMax     = 10000
+	// the list cursors of a volume, the least recently used one is dropped
+	// if more, the idle ones expire.
+	listCursorMax = 16
+	listCursorTTL = 5 * time.Minute
+)
+
+// NeedleInfo the needle meta data of a volume key.
+type NeedleInfo struct {
+	Key     int64  `json:"key"`
+	Offset  uint32 `json:"offset"`
+	Size    int32  `json:"size"`
+	Deleted bool   `json:"deleted"`
+}
+
+// needleInfos sort by key.
+type needleInfos []NeedleInfo
+
+func (p needleInfos) Len() int           { return len(p) }
+func (p needleInfos) Less(i, j int) bool { return p[i].Key < p[j].Key }
+func (p needleInfos) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// listCursor a needles snapshot paged by List.
+type listCursor struct {
+	needles []NeedleInfo
+	used    time.Time
+}
+
+// needleInfo get the needle info of the needle cache.
+func needleInfo(key int64, nc NeedleCache) (n NeedleInfo) {
+	n.Key = key
+	n.Offset, n.Size = nc.Value()
+	n.Deleted = n.Offset == NeedleCacheDelOffset
+	return
+}
+
+// deletedOffsets set the offsets of the deleted needles which are still on
+// disk, only the volume lock is taken for the deleted needles.
+func (v *Volume) deletedOffsets(needles []NeedleInfo) {
+	var (
+		i int
+		d delNeedle
+	)
+	v.lock.Lock()
+	for i = range needles {
+		if !needles[i].Deleted {
+			continue
+		}
+		if d = v.deleted[needles[i].Key]; d.offset != NeedleCacheDelOffset {
+			needles[i].Offset = d.offset
+		}
+	}
+	v.lock.Unlock()
+}
+
+// List get at most limit needles which key greater than after in key order
+// from the needles snapshot of cursor, zero cursor takes a new snapshot and
+// next is the cursor of it, so all the pages are consistent and only the
+// snapshot scans the needle map, the writers wait for the scan once per
+// cursor. more is true if there are needles left, the cursor is dropped
+// after the last page and next is zero.
+func (v *Volume) List(cursor uint64, after int64, limit int) (needles []NeedleInfo, next uint64, more bool, err error) {
+	var (
+		i, j int
+		c    *listCursor
+	)
+	if limit <= 0 {
+		return
+	}
+	if c, next, err = v.listCursor(cursor); err != nil {
+		return
+	}
+	i = sort.Search(len(c.needles), func(i int) bool { return c.needles[i].Key > after })
+	if j = i + limit; j >= len(c.needles) {
+		j = len(c.needles)
+	} else {
+		more = true
+	}
+	needles = append([]NeedleInfo(nil), c.needles[i:j]...)
+	if !more {
+		v.clock.Lock()
+		delete(v.cursors, next)
+		v.clock.Unlock()
+		next = 0
+	}
+	return
+}
+
+// listCursor get the snapshot of cursor, zero cursor takes a new one.
+func (v *Volume) listCursor(cursor uint64) (c *listCursor, next uint64, err error) {
+	var (
+		id   uint64
+		lc   *listCursor
+		lru  uint64
+		used time.Time
+		now  = time.Now()
+	)
+	if cursor != 0 {
+		v.clock.Lock()
+		if c = v.cursors[cursor]; c == nil || now.Sub(c.used) > listCursorTTL {
+			delete(v.cursors, cursor)
+			c, err = nil, ErrListCursor
+		} else {
+			c.used, next = now, cursor
+		}
+		v.clock.Unlock()
+		return
+	}
+	c = &listCursor{needles: v.Snapshot().needles, used: now}
+	v.clock.Lock()
+	for id, lc = range v.cursors {
+		if now.Sub(lc.used) > listCursorTTL {
+			delete(v.cursors, id)
+		} else if lru == 0 || lc.used.Before(used) {
+			lru, used = id, lc.used
+		}
+	}
+	if len(v.cursors) >= listCursorMax {
+		delete(v.cursors, lru)
+	}
+	v.cursorId++
+	next = v.cursorId
+	v.cursors[next] = c
+	v.clock.Unlock()
+	return
+}
+
+// NeedleIterator iterate a consistent snapshot of volume needles in key
+// order.
+type NeedleIterator struct {
+	needles []NeedleInfo
+	i       int
+}
+
+// Snapshot get a iterator of the volume needles at now, the needles added
+// or deleted later are not seen by the iterator.
+func (v *Volume) Snapshot() (it *NeedleIterator) {
+	it = &NeedleIterator{i: -1}
+	v.nlock.RLock()
+	it.needles = make([]NeedleInfo, 0, v.needles.Len())
+	v.needles.Range(func(key int64, nc NeedleCache) bool {
+		it.needles = append(it.needles, needleInfo(key, nc))
+		return true
+	})
+	v.nlock.RUnlock()
+	sort.Sort(needleInfos(it.needles))
+	v.deletedOffsets(it.needles)
+	return
+}
+
+// SeekAfter move the iterator before the first needle which key greater than
+// after.
+func (it *NeedleIterator) SeekAfter(after int64) {
+	it.i = sort.Search(len(it.needles), func(i int) bool {
+		return it.needles[i].Key > after
+	}) - 1
+}
+
+// Next move to the next needle, return false if no more needles.
+func (it *NeedleIterator) Next() bool {
+	if it.i < len(it.needles) {
+		it.i++
+	}
+	return it.i < len(it.needles)
+}
+
+// Needle get the current needle.
+func (it *NeedleIterator) Needle() NeedleInfo {
+	return it.needles[it.i]
+}
+
+// Len get the needles number of the snapshot.
+func (it *NeedleIterator) Len() int {
+	return len(it.needles)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestVolumeList(t *testing.T) {
+	var (
+		v       *Volume
+		err     error
+		more    bool
+		after   int64
+		cursor  uint64
+		keys    []int64
+		needles []NeedleInfo
+		it      *NeedleIterator
+		data    = []byte("test")
+		bfile   = "./test/test.list"
+		ifile   = "./test/test.list.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	if v, err = NewVolume(1, bfile, ifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	for _, key := range []int64{5, 3, 9, 1, 7} {
+		if err = v.Add(key, key, data); err != nil {
+			t.Errorf("Add() error(%v)", err)
+			goto failed
+		}
+	}
+	if err = v.Del(3); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	t.Log("List")
+	for more = true; more; {
+		if needles, cursor, more, err = v.List(cursor, after, 2); err != nil {
+			t.Errorf("List() error(%v)", err)
+			goto failed
+		}
+		if len(needles) == 0 {
+			break
+		}
+		// the pages are of the first snapshot
+		if err = v.Add(after+2, 1, data); err != nil {
+			t.Errorf("Add() error(%v)", err)
+			goto failed
+		}
+		for _, n := range needles {
+			keys = append(keys, n.Key)
+			if n.Deleted != (n.Key == 3) {
+				err = fmt.Errorf("needle: %d deleted: %t not match", n.Key, n.Deleted)
+				t.Error(err)
+				goto failed
+			}
+		}
+		after = needles[len(needles)-1].Key
+	}
+	if fmt.Sprint(keys) != "[1 3 5 7 9]" || cursor != 0 || len(v.cursors) != 0 {
+		err = fmt.Errorf("list keys: %v cursor: %d not match", keys, cursor)
+		t.Error(err)
+		goto failed
+	}
+	if _, _, _, err = v.List(1, 0, 2); err != ErrListCursor {
+		err = fmt.Errorf("List() dropped cursor error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("List cursors")
+	for i := 0; i <= listCursorMax; i++ {
+		if _, cursor, _, err = v.List(0, 0, 1); err != nil {
+			t.Errorf("List() error(%v)", err)
+			goto failed
+		}
+	}
+	if len(v.cursors) != listCursorMax {
+		err = fmt.Errorf("list cursors: %d not match", len(v.cursors))
+		t.Error(err)
+		goto failed
+	}
+	v.cursors[cursor].used = time.Now().Add(-2 * listCursorTTL)
+	if _, _, _, err = v.List(cursor, 1, 1); err != ErrListCursor {
+		err = fmt.Errorf("List() expired cursor error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	err = nil
+	t.Log("Snapshot")
+	it = v.Snapshot()
+	// not seen by the snapshot
+	if err = v.Add(4, 4, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	it.SeekAfter(3)
+	keys = keys[:0]
+	for it.Next() {
+		keys = append(keys, it.Needle().Key)
+	}
+	if fmt.Sprint(keys) != "[5 7 9]" {
+		err = fmt.Errorf("snapshot keys: %v not match", keys)
+		t.Error(err)
+		goto failed
+	}
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
@@ -3,24 +3,29 @@ package main
 import (
 	"flag"
 	log "github.com/golang/glog"
-	"time"
+	"strings"
 )
 
 var (
 	configFile string
+	// erasure code
+	erasureVolume string
+	erasureShards string
+	erasureData   int
 )
 
 func init() {
 	flag.StringVar(&configFile, "c", "./store.yaml", "set config file path")
+	flag.StringVar(&erasureVolume, "erasure", "", "convert the read only volume \"block,index\" into the erasure code shards then exit")
+	flag.StringVar(&erasureShards, "shards", "", "the erasure code shard files, comma separated, data shards first")
+	flag.IntVar(&erasureData, "data", 10, "the erasure code data shards count")
 }
 
 func main() {
 	var (
-		c      *Config
-		s      *Store
-		v      *Volume
-		d, buf []byte
-		err    error
+		c   *Config
+		s   *Store
+		err error
 	)
 	flag.Parse()
 	defer log.Flush()
@@ -30,27 +35,38 @@ func main() {
 		return
 	}
 	log.V(1).Infof("index: %s, zk: %v", c.Index, c.ZK)
-	if s, err = NewStore("/tmp/hijohn.idx"); err != nil {
-		log.Errorf("store init error(%v)", err)
-		return
+	if c.SlowLog != nil {
+		slowOpTime = *c.SlowLog
 	}
-	if v, err = s.AddVolume(2, "/tmp/hijohn_2", "/tmp/hijohn_2.idx"); err != nil {
+	if erasureVolume != "" {
+		if err = erasure(c); err != nil {
+			log.Errorf("erasure code volume: %s error(%v)", erasureVolume, err)
+		}
 		return
 	}
-	v.Add(2, 1, []byte("fa;dflkad;lfajdfkladf;ladjf"))
-	v.Add(3, 1, []byte("fa;dflkad;lfajdfkladf;ladjf"))
-	v.Add(4, 1, []byte("fa;dflkad;lfajdfkladf;ladjf"))
-	time.Sleep(1 * time.Second)
-	if v = s.Volume(1); v == nil {
-		log.Errorf("volume_id: %d not exist", 2)
+	if s, err = NewStore(c); err != nil {
+		log.Errorf("store init error(%v)", err)
 		return
 	}
-	buf = s.Buffer()
-	defer s.FreeBuffer(buf)
-	if d, err = v.Get(0, 0, buf); err != nil {
-		log.Errorf("v.Get() error(%v)", err)
-		return
+	if c.Http != "" {
+		StartHttp(s, c.Http)
 	}
-	log.V(1).Infof("get: %s", d)
+	HandleSignal(InitSignal())
+	s.Close()
+	log.Infof("bfs store[%s] stop", Ver)
 	return
 }
+
+// erasure convert the volume of flags into the erasure code shards offline.
+func erasure(c *Config) (err error) {
+	var files = strings.Split(erasureVolume, ",")
+	if len(files) != 2 {
+		return ErrStoreVolumeIndex
+	}
+	if c.KeyFile != "" {
+		if c.Volume.Keys, err = NewKeyFile(c.KeyFile); err != nil {
+			return
+		}
+	}
+	return ErasureVolume(files[0], files[1], strings.Split(erasureShards, ","), erasureData, &c.Volume)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"strconv"
+	"time"
+)
+
+// metrics exported by the http "/metrics" api, every volume series is
+// labeled by volume id.
+
+const (
+	metricsNamespace = "bfs"
+	// volume op
+	volumeOpGet   = "get"
+	volumeOpAdd   = "add"
+	volumeOpDel   = "del"
+	volumeOpUndel = "undel"
+	// op result
+	volumeOpOK = "ok"
+)
+
+var (
+	metricVolumeOps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "volume",
+		Name:      "ops_total",
+		Help:      "volume operations by outcome and error type.",
+	}, []string{"vid", "op", "result"})
+	metricVolumeOpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "volume",
+		Name:      "op_duration_seconds",
+		Help:      "volume operations latency.",
+		Buckets:   prometheus.ExponentialBuckets(0.00005, 2, 16),
+	}, []string{"vid", "op", "result"})
+	metricVolumePhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "volume",
+		Name:      "op_phase_duration_seconds",
+		Help:      "volume operations latency by phase: lock wait, disk io, parse, index append, flush and sync.",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 2, 18),
+	}, []string{"vid", "op", "phase"})
+	metricVolumeReadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "volume",
+		Name:      "read_bytes_total",
+		Help:      "needle data bytes read from volume.",
+	}, []string{"vid"})
+	metricVolumeWriteBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "volume",
+		Name:      "write_bytes_total",
+		Help:      "needle data bytes written to volume.",
+	}, []string{"vid"})
+	metricStoreBufferMiss = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "buffer_miss_total",
+		Help:      "store buffer pool misses, a new buffer allocated.",
+	})
+	metricStoreCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "cache_hits_total",
+		Help:      "hot needle cache hits.",
+	})
+	metricStoreCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "cache_misses_total",
+		Help:      "hot needle cache misses, the needle read from disk.",
+	})
+	metricStoreCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "cache_evictions_total",
+		Help:      "hot needle cache evictions by the bytes budget.",
+	})
+	metricStoreCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "cache_bytes",
+		Help:      "hot needle cache used bytes.",
+	})
+	// volume state, collected when scrape
+	descVolumeRing = prometheus.NewDesc(metricsNamespace+"_volume_index_ring_used",
+		"index ring buffer used entries (wn - rn).", []string{"vid"}, nil)
+	descVolumeRingFull = prometheus.NewDesc(metricsNamespace+"_volume_index_ring_full_total",
+		"index ring buffer full times, writers wait or write index synchronously.", []string{"vid"}, nil)
+	descVolumeDelQueue = prometheus.NewDesc(metricsNamespace+"_volume_del_queue",
+		"del goroutine signal channel depth.", []string{"vid"}, nil)
+	descVolumeAddQueue = prometheus.NewDesc(metricsNamespace+"_volume_add_queue",
+		"write goroutine add request queue depth.", []string{"vid"}, nil)
+	descVolumeAddBatches = prometheus.NewDesc(metricsNamespace+"_volume_add_batches_total",
+		"write goroutine add batches, every batch one flush and one fsync.", []string{"vid"}, nil)
+	descVolumeNeedles = prometheus.NewDesc(metricsNamespace+"_volume_needles",
+		"needles in volume needle cache.", []string{"vid"}, nil)
+	descVolumeLiveBytes = prometheus.NewDesc(metricsNamespace+"_volume_live_bytes",
+		"super block bytes used by live needles.", []string{"vid"}, nil)
+	descVolumeDeadBytes = prometheus.NewDesc(metricsNamespace+"_volume_dead_bytes",
+		"super block bytes used by deleted or overwritten needles.", []string{"vid"}, nil)
+	descVolumeCompress = prometheus.NewDesc(metricsNamespace+"_volume_compress_progress",
+		"compress progress ratio, 0 if not in compress.", []string{"vid"}, nil)
+	// error types
+	errTypes = map[error]string{
+		ErrNoNeedle:          "no_needle",
+		ErrNeedleDeleted:     "deleted",
+		ErrNeedleChecksum:    "checksum",
+		ErrNeedleFlag:        "flag",
+		ErrNeedleSize:        "size",
+		ErrNeedleHeaderMagic: "header_magic",
+		ErrNeedleFooterMagic: "footer_magic",
+		ErrNeedleKey:         "key",
+		ErrNeedlePadding:     "padding",
+		ErrNeedleCookie:      "cookie",
+		ErrNeedleTooLarge:    "too_large",
+		ErrNeedleVersion:     "no_version",
+		ErrSuperBlockNoSpace: "no_space",
+		ErrRingFull:          "ring_full",
+		ErrVolumeDel:         "del_queue",
+	}
+)
+
+func init() {
+	prometheus.MustRegister(metricVolumeOps)
+	prometheus.MustRegister(metricVolumeOpDuration)
+	prometheus.MustRegister(metricVolumePhaseDuration)
+	prometheus.MustRegister(metricVolumeReadBytes)
+	prometheus.MustRegister(metricVolumeWriteBytes)
+	prometheus.MustRegister(metricStoreBufferMiss)
+	prometheus.MustRegister(metricStoreCacheHits)
+	prometheus.MustRegister(metricStoreCacheMisses)
+	prometheus.MustRegister(metricStoreCacheEvictions)
+	prometheus.MustRegister(metricStoreCacheBytes)
+}
+
+// errType get the metrics label of a error.
+func errType(err error) string {
+	var (
+		ok bool
+		t  string
+	)
+	if err == nil {
+		return volumeOpOK
+	}
+	if t, ok = errTypes[err]; ok {
+		return t
+	}
+	if _, ok = err.(*os.PathError); ok {
+		return "io"
+	}
+	return "other"
+}
+
+// statVolumeOp stat a volume operation.
+func statVolumeOp(id int32, op string, start time.Time, err error) {
+	var (
+		vid    = strconv.FormatInt(int64(id), 10)
+		result = errType(err)
+	)
+	metricVolumeOps.WithLabelValues(vid, op, result).Inc()
+	metricVolumeOpDuration.WithLabelValues(vid, op, result).Observe(time.Since(start).Seconds())
+}
+
+// statVolumeRead stat the needle data bytes read.
+func statVolumeRead(id int32, n int) {
+	metricVolumeReadBytes.WithLabelValues(strconv.FormatInt(int64(id), 10)).Add(float64(n))
+}
+
+// statVolumeWrite stat the needle data bytes written.
+func statVolumeWrite(id int32, n int) {
+	metricVolumeWriteBytes.WithLabelValues(strconv.FormatInt(int64(id), 10)).Add(float64(n))
+}
+
+// statVolumeDel drop the series of a deleted volume.
+func statVolumeDel(id int32) {
+	var (
+		vid    = strconv.FormatInt(int64(id), 10)
+		labels = prometheus.Labels{"vid": vid}
+	)
+	metricVolumeOps.DeletePartialMatch(labels)
+	metricVolumeOpDuration.DeletePartialMatch(labels)
+	metricVolumePhaseDuration.DeletePartialMatch(labels)
+	metricVolumeReadBytes.DeleteLabelValues(vid)
+	metricVolumeWriteBytes.DeleteLabelValues(vid)
+}
+
+// StoreCollector collect the volumes state of a store when scrape.
+type StoreCollector struct {
+	s *Store
+}
+
+// NewStoreCollector new a store collector.
+func NewStoreCollector(s *Store) *StoreCollector {
+	return &StoreCollector{s: s}
+}
+
+// Describe implements prometheus.Collector.
+func (c *StoreCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descVolumeRing
+	ch <- descVolumeRingFull
+	ch <- descVolumeDelQueue
+	ch <- descVolumeAddQueue
+	ch <- descVolumeAddBatches
+	ch <- descVolumeNeedles
+	ch <- descVolumeLiveBytes
+	ch <- descVolumeDeadBytes
+	ch <- descVolumeCompress
+}
+
+// Collect implements prometheus.Collector.
+func (c *StoreCollector) Collect(ch chan<- prometheus.Metric) {
+	var (
+		v        *Volume
+		vid      string
+		st       VolumeStat
+		progress float64
+	)
+	for _, v = range c.s.Volumes() {
+		// the replaced volume is skipped
+		if !v.Ref() {
+			continue
+		}
+		st = v.Stat()
+		v.Unref()
+		vid = strconv.FormatInt(int64(v.Id), 10)
+		progress = 0
+		if st.Compress && st.BlockBytes > 0 {
+			progress = float64(st.CompressBytes) / float64(st.BlockBytes)
+		}
+		ch <- prometheus.MustNewConstMetric(descVolumeRing, prometheus.GaugeValue, float64(st.RingUsed), vid)
+		ch <- prometheus.MustNewConstMetric(descVolumeRingFull, prometheus.CounterValue, float64(st.RingFull), vid)
+		ch <- prometheus.MustNewConstMetric(descVolumeDelQueue, prometheus.GaugeValue, float64(st.DelQueue), vid)
+		ch <- prometheus.MustNewConstMetric(descVolumeAddQueue, prometheus.GaugeValue, float64(st.AddQueue), vid)
+		ch <- prometheus.MustNewConstMetric(descVolumeAddBatches, prometheus.CounterValue, float64(st.AddBatches), vid)
+		ch <- prometheus.MustNewConstMetric(descVolumeNeedles, prometheus.GaugeValue, float64(st.Needles), vid)
+		ch <- prometheus.MustNewConstMetric(descVolumeLiveBytes, prometheus.GaugeValue, float64(st.LiveBytes), vid)
+		ch <- prometheus.MustNewConstMetric(descVolumeDeadBytes, prometheus.GaugeValue, float64(st.BlockBytes-st.LiveBytes), vid)
+		ch <- prometheus.MustNewConstMetric(descVolumeCompress, prometheus.GaugeValue, progress, vid)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	var (
+		s     = &Store{}
+		v     *Volume
+		err   error
+		st    VolumeStat
+		n     int
+		ch    = make(chan prometheus.Metric, 100)
+		data  = []byte("test")
+		bfile = "./test/test.metrics"
+		ifile = "./test/test.metrics.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	t.Log("errType")
+	if errType(nil) != volumeOpOK || errType(ErrNoNeedle) != "no_needle" || errType(&os.PathError{}) != "io" {
+		err = fmt.Errorf("errType() not match")
+		t.Error(err)
+		goto failed
+	}
+	if v, err = NewVolume(1, bfile, ifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(1, 1, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(2, 2, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(1, 1, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if err = v.Del(2); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	t.Log("Stat")
+	// 3 needles, every needle 40 bytes
+	if st = v.Stat(); st.Needles != 2 || st.LiveBytes != 40 || st.BlockBytes != 120 {
+		err = fmt.Errorf("Stat() %+v not match", st)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Stat without lock")
+	v.lock.Lock()
+	st = v.Stat()
+	v.lock.Unlock()
+	if st.Needles != 2 {
+		err = fmt.Errorf("Stat() %+v not match", st)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("StoreCollector")
+	s.volumes.Store(map[int32]*Volume{1: v})
+	NewStoreCollector(s).Collect(ch)
+	close(ch)
+	for _ = range ch {
+		n++
+	}
+	if n != 9 {
+		err = fmt.Errorf("collect metrics: %d not match", n)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("statVolumeDel")
+	statVolumeDel(1)
+	if metricVolumeWriteBytes.DeleteLabelValues("1") || metricVolumeOps.DeletePartialMatch(prometheus.Labels{"vid": "1"}) != 0 {
+		err = fmt.Errorf("volume series not deleted")
+		t.Error(err)
+		goto failed
+	}
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
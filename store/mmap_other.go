@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+)
+
+// mmap isn't supported, the volume reads with pread.
+func mmap(f *os.File, size int) ([]byte, error) {
+	return nil, ErrSuperBlockMmap
+}
+
+// munmap unmap the mapping.
+func munmap(data []byte) error {
+	return nil
+}
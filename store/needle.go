@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"hash"
 	"hash/crc32"
 )
 
@@ -36,7 +37,8 @@ import (
 // data      | the actual photo data
 // magic     | footer magic number used for checksum
 // checksum  | used to check integrity
-// padding   | total needle size is aligned to 8 bytes
+// padding   | total needle size is aligned to 8 bytes, the first byte is
+//           | the data encoding, see NeedleEncoding
 
 const (
 	NeedleMaxSize = 5 * 1024 * 1024 // 5MB
@@ -75,14 +77,59 @@ var (
 		[]byte{0, 0, 0, 0, 0, 0},
 		[]byte{0, 0, 0, 0, 0, 0, 0},
 	}
-	crc32Table = crc32.MakeTable(crc32.Koopman)
+	crc32Tables = [...]*crc32.Table{
+		NeedleChecksumKoopman:    crc32.MakeTable(crc32.Koopman),
+		NeedleChecksumCastagnoli: crc32.MakeTable(crc32.Castagnoli),
+	}
 	// magic number
 	needleHeaderMagic = []byte{0x12, 0x34, 0x56, 0x78}
 	needleFooterMagic = []byte{0x87, 0x65, 0x43, 0x21}
 	// flag
+	NeedleStatusOKBytes  = []byte{NeedleStatusOK}
 	NeedleStatusDelBytes = []byte{NeedleStatusDel}
 )
 
+// NeedleChecksum the needle checksum algorithm of a volume, recorded in the
+// super block header, the old volumes are koopman, castagnoli (crc32c) is
+// accelerated by sse4.2.
+type NeedleChecksum byte
+
+const (
+	NeedleChecksumKoopman    = NeedleChecksum(0)
+	NeedleChecksumCastagnoli = NeedleChecksum(1)
+	// option names
+	NeedleChecksumOptKoopman = "koopman"
+	NeedleChecksumOptCrc32c  = "crc32c"
+)
+
+// ParseNeedleChecksum parse the checksum option, crc32c by default.
+func ParseNeedleChecksum(s string) (c NeedleChecksum, err error) {
+	switch s {
+	case "", NeedleChecksumOptCrc32c:
+		c = NeedleChecksumCastagnoli
+	case NeedleChecksumOptKoopman:
+		c = NeedleChecksumKoopman
+	default:
+		err = ErrNeedleCrcType
+	}
+	return
+}
+
+// Valid check the checksum algorithm is known.
+func (c NeedleChecksum) Valid() bool {
+	return int(c) < len(crc32Tables)
+}
+
+// Sum get the checksum of data.
+func (c NeedleChecksum) Sum(data []byte) uint32 {
+	return crc32.Update(0, crc32Tables[c], data)
+}
+
+// New new a streaming checksum.
+func (c NeedleChecksum) New() hash.Hash32 {
+	return crc32.New(crc32Tables[c])
+}
+
 // NeedleCache needle meta data in memory.
 // high 32bit = Offset
 // low 32 bit = Size
@@ -111,6 +158,7 @@ type Needle struct {
 	Checksum    uint32
 	PaddingSize int32
 	Padding     []byte
+	Encoding    NeedleEncoding
 	DataSize    int // data-part size
 }
 
@@ -144,8 +192,9 @@ func (n *Needle) ParseHeader(buf []byte) (err error) {
 	return
 }
 
-// ParseNeedleData parse a needle data part.
-func (n *Needle) ParseData(buf []byte) (err error) {
+// ParseNeedleData parse a needle data part, c is the checksum algorithm of
+// the volume.
+func (n *Needle) ParseData(buf []byte, c NeedleChecksum) (err error) {
 	var (
 		bn       int32
 		checksum uint32
@@ -158,7 +207,7 @@ func (n *Needle) ParseData(buf []byte) (err error) {
 		return
 	}
 	bn += needleMagicSize
-	checksum = crc32.Update(0, crc32Table, n.Data)
+	checksum = c.Sum(n.Data)
 	n.Checksum = BigEndian.Uint32(buf[bn : bn+needleChecksumSize])
 	if n.Checksum != checksum {
 		err = ErrNeedleChecksum
@@ -166,14 +215,15 @@ func (n *Needle) ParseData(buf []byte) (err error) {
 	}
 	bn += needleChecksumSize
 	n.Padding = buf[bn : bn+n.PaddingSize]
-	if !bytes.Equal(n.Padding, needlePadding[n.PaddingSize]) {
+	n.Encoding = NeedleEncoding(n.Padding[0])
+	if !n.Encoding.Valid() || !bytes.Equal(n.Padding[1:], needlePadding[n.PaddingSize][1:]) {
 		err = ErrNeedlePadding
 	}
 	return
 }
 
 // WriteNeedle write needle into bufio.
-func WriteNeedle(w *bufio.Writer, padding, size int32, key, cookie int64, data []byte) (err error) {
+func WriteNeedle(w *bufio.Writer, padding, size int32, key, cookie int64, e NeedleEncoding, data []byte, c NeedleChecksum) (err error) {
 	// header
 	// magic
 	if _, err = w.Write(needleHeaderMagic); err != nil {
@@ -205,19 +255,22 @@ func WriteNeedle(w *bufio.Writer, padding, size int32, key, cookie int64, data [
 		return
 	}
 	// checksum
-	if err = BigEndian.WriteUint32(w, crc32.Update(0, crc32Table, data)); err != nil {
+	if err = BigEndian.WriteUint32(w, c.Sum(data)); err != nil {
 		return
 	}
 	// padding
-	_, err = w.Write(needlePadding[padding])
+	if err = w.WriteByte(byte(e)); err != nil {
+		return
+	}
+	_, err = w.Write(needlePadding[padding][1:])
 	return
 }
 
 // FillNeedle fill needle buffer.
-func FillNeedle(padding, size int32, key, cookie int64, data, buf []byte) {
+func FillNeedle(padding, size int32, key, cookie int64, e NeedleEncoding, data, buf []byte, c NeedleChecksum) {
 	var (
 		n        int
-		checksum = crc32.Update(0, crc32Table, data)
+		checksum = c.Sum(data)
 	)
 	// --- header ---
 	// magic
@@ -247,6 +300,7 @@ func FillNeedle(padding, size int32, key, cookie int64, data, buf []byte) {
 	n += needleChecksumSize
 	// padding
 	copy(buf[n:], needlePadding[padding])
+	buf[n] = byte(e)
 	return
 }
 
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"sort"
+)
+
+// NeedleMap the needle cache of a volume, the keys are never removed, a
+// deleted needle is set to the NeedleCacheDelOffset cache.
+type NeedleMap interface {
+	// Get get the needle cache of key.
+	Get(key int64) (nc NeedleCache, ok bool)
+	// Set set the needle cache of key.
+	Set(key int64, nc NeedleCache)
+	// Len get the keys number.
+	Len() int
+	// Range call fn with every key until fn return false.
+	Range(fn func(key int64, nc NeedleCache) bool)
+}
+
+const (
+	// needle map type
+	NeedleMapHash    = "hash"
+	NeedleMapCompact = "compact"
+	NeedleMapDisk    = "disk"
+)
+
+// NewNeedleMap new a needle map of type t, n is the expected keys number,
+// the disk needle map is built from a compact one.
+func NewNeedleMap(t string, n int) NeedleMap {
+	if t == NeedleMapCompact || t == NeedleMapDisk {
+		return NewCompactNeedleMap(n)
+	}
+	return make(HashNeedleMap, n)
+}
+
+// HashNeedleMap the go map needle map, it's the default.
+type HashNeedleMap map[int64]NeedleCache
+
+// Get get the needle cache of key.
+func (m HashNeedleMap) Get(key int64) (nc NeedleCache, ok bool) {
+	nc, ok = m[key]
+	return
+}
+
+// Set set the needle cache of key.
+func (m HashNeedleMap) Set(key int64, nc NeedleCache) {
+	m[key] = nc
+}
+
+// Len get the keys number.
+func (m HashNeedleMap) Len() int {
+	return len(m)
+}
+
+// Range call fn with every key until fn return false.
+func (m HashNeedleMap) Range(fn func(key int64, nc NeedleCache) bool) {
+	for key, nc := range m {
+		if !fn(key, nc) {
+			return
+		}
+	}
+}
+
+const (
+	// the keys of compact needle map delta, the volume merges it in the
+	// background when full, a map without merger merges it synchronously
+	// when it's also larger than 1/compactNeedleMapRatio of the sorted
+	// entries, e.g. the recovery.
+	compactNeedleMapDelta = 65536
+	compactNeedleMapRatio = 8
+)
+
+// compactEntry a key and needle cache, no pointers so gc won't scan the
+// entries.
+type compactEntry struct {
+	key int64
+	nc  NeedleCache
+}
+
+// compactEntries sort by key.
+type compactEntries []compactEntry
+
+func (p compactEntries) Len() int           { return len(p) }
+func (p compactEntries) Less(i, j int) bool { return p[i].key < p[j].key }
+func (p compactEntries) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// search binary search the index of key in sorted entries, -1 if not exists.
+func (p compactEntries) search(key int64) int {
+	var (
+		i, j = 0, len(p)
+		h    int
+	)
+	for i < j {
+		if h = int(uint(i+j) >> 1); p[h].key < key {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	if i < len(p) && p[i].key == key {
+		return i
+	}
+	return -1
+}
+
+// CompactNeedleMap a sorted array of keys and needle caches, every key costs
+// 16 bytes, the new keys are written to a small hash delta first, then the
+// delta is frozen and merged into a new sorted array, the entries aren't
+// updated in place while merging, so the merge reads them without lock.
+type CompactNeedleMap struct {
+	entries compactEntries
+	delta   HashNeedleMap
+	// the frozen delta being merged, sorted
+	frozen compactEntries
+	// the keys of delta and frozen not in the entries
+	fresh  int
+	ffresh int
+}
+
+// NewCompactNeedleMap new a compact needle map for n keys.
+func NewCompactNeedleMap(n int) (m *CompactNeedleMap) {
+	m = &CompactNeedleMap{}
+	m.entries = make(compactEntries, 0, n)
+	m.delta = make(HashNeedleMap)
+	return
+}
+
+// Get get the needle cache of key.
+func (m *CompactNeedleMap) Get(key int64) (nc NeedleCache, ok bool) {
+	var i int
+	if nc, ok = m.delta[key]; ok {
+		return
+	}
+	if i = m.frozen.search(key); i >= 0 {
+		return m.frozen[i].nc, true
+	}
+	if i = m.entries.search(key); i >= 0 {
+		nc, ok = m.entries[i].nc, true
+	}
+	return
+}
+
+// Set set the needle cache of key.
+func (m *CompactNeedleMap) Set(key int64, nc NeedleCache) {
+	var (
+		ok bool
+		i  int
+	)
+	if _, ok = m.delta[key]; !ok {
+		if i = m.entries.search(key); i >= 0 && m.frozen == nil {
+			m.entries[i].nc = nc
+			return
+		}
+		if i < 0 && m.frozen.search(key) < 0 {
+			m.fresh++
+		}
+	}
+	m.delta[key] = nc
+	if m.frozen == nil && len(m.delta) > compactNeedleMapDelta && len(m.delta) > len(m.entries)/compactNeedleMapRatio {
+		m.freeze()
+		m.swap(m.merged())
+	}
+}
+
+// Full check the delta need merge.
+func (m *CompactNeedleMap) Full() bool {
+	return m.frozen == nil && len(m.delta) >= compactNeedleMapDelta
+}
+
+// Merge merge the delta into the sorted entries synchronously.
+func (m *CompactNeedleMap) Merge() {
+	if m.frozen == nil && len(m.delta) > 0 {
+		m.freeze()
+		m.swap(m.merged())
+	}
+}
+
+// freeze sort the delta into the frozen delta merged by merged.
+func (m *CompactNeedleMap) freeze() {
+	m.frozen = make(compactEntries, 0, len(m.delta))
+	for key, nc := range m.delta {
+		m.frozen = append(m.frozen, compactEntry{key: key, nc: nc})
+	}
+	sort.Sort(m.frozen)
+	m.ffresh, m.fresh = m.fresh, 0
+	m.delta = make(HashNeedleMap)
+}
+
+// merged merge the frozen delta into a new sorted entries, it only reads the
+// entries and the frozen delta, so it can be called concurrently with Get
+// and Set.
+func (m *CompactNeedleMap) merged() (entries compactEntries) {
+	var i, j int
+	entries = make(compactEntries, 0, len(m.entries)+m.ffresh)
+	for i < len(m.entries) && j < len(m.frozen) {
+		if m.entries[i].key < m.frozen[j].key {
+			entries = append(entries, m.entries[i])
+			i++
+		} else {
+			if m.entries[i].key == m.frozen[j].key {
+				i++
+			}
+			entries = append(entries, m.frozen[j])
+			j++
+		}
+	}
+	entries = append(entries, m.entries[i:]...)
+	entries = append(entries, m.frozen[j:]...)
+	return
+}
+
+// swap replace the entries by the merged one and drop the frozen delta.
+func (m *CompactNeedleMap) swap(entries compactEntries) {
+	m.entries = entries
+	m.frozen = nil
+	m.ffresh = 0
+}
+
+// Len get the keys number.
+func (m *CompactNeedleMap) Len() int {
+	return len(m.entries) + m.ffresh + m.fresh
+}
+
+// Range call fn with every key until fn return false.
+func (m *CompactNeedleMap) Range(fn func(key int64, nc NeedleCache) bool) {
+	var (
+		ok   bool
+		i, j int
+		e    compactEntry
+		nc   NeedleCache
+	)
+	for i < len(m.entries) || j < len(m.frozen) {
+		if j == len(m.frozen) || (i < len(m.entries) && m.entries[i].key < m.frozen[j].key) {
+			e = m.entries[i]
+			i++
+		} else {
+			if i < len(m.entries) && m.entries[i].key == m.frozen[j].key {
+				i++
+			}
+			e = m.frozen[j]
+			j++
+		}
+		if nc, ok = m.delta[e.key]; ok {
+			e.nc = nc
+		}
+		if !fn(e.key, e.nc) {
+			return
+		}
+	}
+	for key, nc := range m.delta {
+		if m.entries.search(key) < 0 && m.frozen.search(key) < 0 && !fn(key, nc) {
+			return
+		}
+	}
+}
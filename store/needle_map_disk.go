@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	clist "container/list"
+	log "github.com/golang/glog"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// DiskNeedleMap keeps the needle cache in a sorted file, only the first key
+// of every page, a small page cache and the changed keys (delta) are in
+// memory, so a lookup costs at most one disk io, the delta is merged into
+// a new sorted file when it's full, the frozen delta is written without
+// blocking Get and Set.
+//
+// sorted file format:
+//  ---------------
+// |     header    |           -------------------
+//  ---------------           |  magic (4bytes)   |
+// |     entry     |          |  ver (byte)       |
+// |     entry     |          |  padding(3bytes)  |
+// |     ......    |          |  index (int64)    |
+//  ---------------           |  block (uint32)   |
+// |   page keys   |          |  padding(4bytes)  |
+//  ---------------           |  count (int64)    |
+//                             -------------------
+//                             -------------------
+//         entry       ---->  |  key (int64)      |
+//                            |  needle (int64)   |
+//                             -------------------
+//                               int bigendian
+//
+// field     | explanation
+// ---------------------------------------------------------
+// magic     | sorted file magic number
+// ver       | sorted file version
+// index     | the index file offset merged, recovery from it
+// block     | the super block offset merged (aligned)
+// count     | entries count
+// key       | needle key (photo id), entries sorted by key
+// needle    | needle cache, offset and size
+// page keys | the first key of every page entries
+
+const (
+	diskNeedleMapHeaderSize = 32
+	diskNeedleMapEntrySize  = 16
+	diskNeedleMapPage       = 256
+	diskNeedleMapPageSize   = diskNeedleMapPage * diskNeedleMapEntrySize
+	diskNeedleMapCachePages = 64
+	diskNeedleMapDelta      = 102400
+	// header offset
+	diskNeedleMapVerOffset   = 4
+	diskNeedleMapIndexOffset = 8
+	diskNeedleMapBlockOffset = 16
+	diskNeedleMapCountOffset = 24
+	// ver
+	diskNeedleMapVer1 = byte(1)
+	// the sorted file suffix of index file
+	diskNeedleMapSuffix = ".sorted"
+)
+
+var (
+	diskNeedleMapMagic = []byte{0x62, 0x66, 0x73, 0x73}
+)
+
+// diskDelta a changed key, fresh if not in the sorted file.
+type diskDelta struct {
+	nc    NeedleCache
+	fresh bool
+}
+
+// diskPage a cached page of sorted file.
+type diskPage struct {
+	p   int
+	n   int
+	buf []byte
+}
+
+// DiskNeedleMap the sorted file needle map, Get can be called concurrently
+// with each other, but not with Set, freeze or reopen, write can be called
+// concurrently with all of them.
+type DiskNeedleMap struct {
+	File string
+	// the index and super block offset merged
+	Offset      int64
+	BlockOffset uint32
+	f           *os.File
+	count       int
+	pages       []int64
+	delta       map[int64]diskDelta
+	fresh       int
+	// the frozen delta being merged, fresh if not in the sorted file
+	merging map[int64]diskDelta
+	mfresh  int
+	// page cache
+	lock  sync.Mutex
+	cache map[int]*clist.Element
+	lru   *clist.List
+	err   error
+}
+
+// OpenDiskNeedleMap open a sorted file needle map.
+func OpenDiskNeedleMap(file string) (m *DiskNeedleMap, err error) {
+	m = &DiskNeedleMap{File: file}
+	if m.f, err = os.OpenFile(file, os.O_RDONLY, 0664); err != nil {
+		log.Errorf("os.OpenFile(\"%s\", os.O_RDONLY, 0664) error(%v)", file, err)
+		return
+	}
+	if err = m.init(); err != nil {
+		m.f.Close()
+		return
+	}
+	m.delta = make(map[int64]diskDelta)
+	m.cache = make(map[int]*clist.Element, diskNeedleMapCachePages)
+	m.lru = clist.New()
+	return
+}
+
+// init read the header and page keys.
+func (m *DiskNeedleMap) init() (err error) {
+	var (
+		n   int
+		buf = make([]byte, diskNeedleMapHeaderSize)
+	)
+	if _, err = m.f.ReadAt(buf, 0); err != nil {
+		log.Errorf("sorted: %s read header error(%v)", m.File, err)
+		return
+	}
+	if !bytes.Equal(buf[:diskNeedleMapVerOffset], diskNeedleMapMagic) {
+		err = ErrSortedMagic
+		return
+	}
+	if buf[diskNeedleMapVerOffset] != diskNeedleMapVer1 {
+		err = ErrSortedVer
+		return
+	}
+	m.Offset = BigEndian.Int64(buf[diskNeedleMapIndexOffset:])
+	m.BlockOffset = BigEndian.Uint32(buf[diskNeedleMapBlockOffset:])
+	m.count = int(BigEndian.Int64(buf[diskNeedleMapCountOffset:]))
+	n = (m.count + diskNeedleMapPage - 1) / diskNeedleMapPage
+	buf = make([]byte, n*8)
+	if _, err = m.f.ReadAt(buf, diskNeedleMapHeaderSize+int64(m.count)*diskNeedleMapEntrySize); err != nil {
+		log.Errorf("sorted: %s read page keys error(%v)", m.File, err)
+		return
+	}
+	m.pages = make([]int64, n)
+	for i := 0; i < n; i++ {
+		m.pages[i] = BigEndian.Int64(buf[i*8:])
+	}
+	return
+}
+
+// page get the page p from cache or disk.
+func (m *DiskNeedleMap) page(p int) (pg *diskPage, err error) {
+	var (
+		ok bool
+		e  *clist.Element
+	)
+	m.lock.Lock()
+	if e, ok = m.cache[p]; ok {
+		m.lru.MoveToFront(e)
+		m.lock.Unlock()
+		return e.Value.(*diskPage), nil
+	}
+	m.lock.Unlock()
+	// read without lock, the other readers won't wait for the io
+	pg = &diskPage{p: p, n: diskNeedleMapPage}
+	if p == len(m.pages)-1 {
+		pg.n = m.count - p*diskNeedleMapPage
+	}
+	pg.buf = make([]byte, pg.n*diskNeedleMapEntrySize)
+	if _, err = m.f.ReadAt(pg.buf, diskNeedleMapHeaderSize+int64(p)*diskNeedleMapPageSize); err != nil {
+		log.Errorf("sorted: %s read page: %d error(%v)", m.File, p, err)
+		m.setError(err)
+		return
+	}
+	m.lock.Lock()
+	if _, ok = m.cache[p]; !ok {
+		if m.lru.Len() >= diskNeedleMapCachePages {
+			e = m.lru.Back()
+			m.lru.Remove(e)
+			delete(m.cache, e.Value.(*diskPage).p)
+		}
+		m.cache[p] = m.lru.PushFront(pg)
+	}
+	m.lock.Unlock()
+	return
+}
+
+// get get the needle cache of key in sorted file.
+func (m *DiskNeedleMap) get(key int64) (nc NeedleCache, ok bool) {
+	var (
+		p, i, j, h int
+		pg         *diskPage
+		err        error
+	)
+	// the last page which first key <= key
+	if p = sort.Search(len(m.pages), func(i int) bool { return m.pages[i] > key }) - 1; p < 0 {
+		return
+	}
+	if pg, err = m.page(p); err != nil {
+		return
+	}
+	for i, j = 0, pg.n; i < j; {
+		if h = int(uint(i+j) >> 1); BigEndian.Int64(pg.buf[h*diskNeedleMapEntrySize:]) < key {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	if i < pg.n && BigEndian.Int64(pg.buf[i*diskNeedleMapEntrySize:]) == key {
+		nc, ok = NeedleCache(BigEndian.Int64(pg.buf[i*diskNeedleMapEntrySize+8:])), true
+	}
+	return
+}
+
+// Get get the needle cache of key.
+func (m *DiskNeedleMap) Get(key int64) (nc NeedleCache, ok bool) {
+	var d diskDelta
+	if d, ok = m.delta[key]; ok {
+		return d.nc, true
+	}
+	if d, ok = m.merging[key]; ok {
+		return d.nc, true
+	}
+	return m.get(key)
+}
+
+// Set set the needle cache of key, the key is kept in delta until merged,
+// it's fresh if neither in the frozen delta nor the sorted file.
+func (m *DiskNeedleMap) Set(key int64, nc NeedleCache) {
+	var (
+		ok bool
+		d  diskDelta
+	)
+	if d, ok = m.delta[key]; !ok {
+		if _, ok = m.merging[key]; !ok {
+			if _, ok = m.get(key); !ok {
+				d.fresh = true
+				m.fresh++
+			}
+		}
+	}
+	d.nc = nc
+	m.delta[key] = d
+}
+
+// Len get the keys number.
+func (m *DiskNeedleMap) Len() int {
+	return m.count + m.mfresh + m.fresh
+}
+
+// latest get the needle cache of key in the delta or frozen delta.
+func (m *DiskNeedleMap) latest(key int64, nc NeedleCache) NeedleCache {
+	var (
+		ok bool
+		d  diskDelta
+	)
+	if d, ok = m.delta[key]; ok {
+		return d.nc
+	}
+	if d, ok = m.merging[key]; ok {
+		return d.nc
+	}
+	return nc
+}
+
+// Range call fn with every key until fn return false.
+func (m *DiskNeedleMap) Range(fn func(key int64, nc NeedleCache) bool) {
+	var (
+		d   diskDelta
+		key int64
+	)
+	if !m.scan(func(key int64, nc NeedleCache) bool {
+		return fn(key, m.latest(key, nc))
+	}) {
+		return
+	}
+	for key, d = range m.merging {
+		if d.fresh && !fn(key, m.latest(key, d.nc)) {
+			return
+		}
+	}
+	for key, d = range m.delta {
+		if d.fresh && !fn(key, d.nc) {
+			return
+		}
+	}
+}
+
+// scan call fn with every entry of sorted file in key order, return false
+// if stopped.
+func (m *DiskNeedleMap) scan(fn func(key int64, nc NeedleCache) bool) bool {
+	var (
+		err error
+		buf = make([]byte, diskNeedleMapEntrySize)
+		rd  = bufio.NewReaderSize(io.NewSectionReader(m.f, diskNeedleMapHeaderSize, int64(m.count)*diskNeedleMapEntrySize), diskNeedleMapPageSize*16)
+	)
+	for i := 0; i < m.count; i++ {
+		if _, err = io.ReadFull(rd, buf); err != nil {
+			log.Errorf("sorted: %s scan error(%v)", m.File, err)
+			m.setError(err)
+			return false
+		}
+		if !fn(BigEndian.Int64(buf), NeedleCache(BigEndian.Int64(buf[8:]))) {
+			return false
+		}
+	}
+	return true
+}
+
+// Full check the delta need merge.
+func (m *DiskNeedleMap) Full() bool {
+	return len(m.delta) >= diskNeedleMapDelta
+}
+
+// Merge merge the delta into a new sorted file, offset and boffset are the
+// index file and super block offset of all the keys merged.
+func (m *DiskNeedleMap) Merge(offset int64, boffset uint32) (err error) {
+	m.freeze()
+	if err = m.write(offset, boffset); err != nil {
+		return
+	}
+	return m.reopen()
+}
+
+// freeze move the delta into the frozen delta written by write, the left
+// frozen delta of a failed write is kept.
+func (m *DiskNeedleMap) freeze() {
+	var (
+		ok  bool
+		key int64
+		d   diskDelta
+		md  diskDelta
+	)
+	if m.merging == nil {
+		m.merging, m.mfresh = m.delta, m.fresh
+	} else {
+		for key, d = range m.delta {
+			if md, ok = m.merging[key]; ok {
+				d.fresh = md.fresh
+			} else if d.fresh {
+				m.mfresh++
+			}
+			m.merging[key] = d
+		}
+	}
+	m.delta = make(map[int64]diskDelta)
+	m.fresh = 0
+}
+
+// write write the sorted file merged with the frozen delta, the opened file
+// is still valid and the frozen delta is read only, so it can be called
+// concurrently with Get and Set.
+func (m *DiskNeedleMap) write(offset int64, boffset uint32) (err error) {
+	var (
+		i     int
+		key   int64
+		d     diskDelta
+		delta = make(compactEntries, 0, m.mfresh)
+	)
+	for key, d = range m.merging {
+		if d.fresh {
+			delta = append(delta, compactEntry{key: key, nc: d.nc})
+		}
+	}
+	sort.Sort(delta)
+	return writeDiskNeedleMap(m.File, offset, boffset, m.count+m.mfresh, func(write func(key int64, nc NeedleCache) error) (err error) {
+		m.scan(func(key int64, nc NeedleCache) bool {
+			for ; i < len(delta) && delta[i].key < key; i++ {
+				if err = write(delta[i].key, delta[i].nc); err != nil {
+					return false
+				}
+			}
+			if d, ok := m.merging[key]; ok {
+				nc = d.nc
+			}
+			err = write(key, nc)
+			return err == nil
+		})
+		if err == nil {
+			err = m.Error()
+		}
+		for ; err == nil && i < len(delta); i++ {
+			err = write(delta[i].key, delta[i].nc)
+		}
+		return
+	})
+}
+
+// reopen open the new sorted file written and drop the frozen delta.
+func (m *DiskNeedleMap) reopen() (err error) {
+	m.f.Close()
+	if m.f, err = os.OpenFile(m.File, os.O_RDONLY, 0664); err != nil {
+		log.Errorf("os.OpenFile(\"%s\", os.O_RDONLY, 0664) error(%v)", m.File, err)
+		m.setError(err)
+		return
+	}
+	if err = m.init(); err != nil {
+		m.setError(err)
+		return
+	}
+	m.merging = nil
+	m.mfresh = 0
+	m.cache = make(map[int]*clist.Element, diskNeedleMapCachePages)
+	m.lru.Init()
+	log.Infof("sorted: %s merged, count: %d, index offset: %d, block offset: %d", m.File, m.count, m.Offset, m.BlockOffset)
+	return
+}
+
+// setError record the disk io error.
+func (m *DiskNeedleMap) setError(err error) {
+	m.lock.Lock()
+	m.err = err
+	m.lock.Unlock()
+}
+
+// Error get the disk io error.
+func (m *DiskNeedleMap) Error() (err error) {
+	m.lock.Lock()
+	err = m.err
+	m.lock.Unlock()
+	return
+}
+
+// Close close the sorted file.
+func (m *DiskNeedleMap) Close() {
+	if err := m.f.Close(); err != nil {
+		log.Errorf("sorted: %s close error(%v)", m.File, err)
+	}
+}
+
+// WriteDiskNeedleMap write all the keys of a needle map into a sorted file,
+// offset and boffset are the index file and super block offset of all the
+// keys.
+func WriteDiskNeedleMap(file string, m NeedleMap, offset int64, boffset uint32) (err error) {
+	var entries = make(compactEntries, 0, m.Len())
+	m.Range(func(key int64, nc NeedleCache) bool {
+		entries = append(entries, compactEntry{key: key, nc: nc})
+		return true
+	})
+	sort.Sort(entries)
+	return writeDiskNeedleMap(file, offset, boffset, len(entries), func(write func(key int64, nc NeedleCache) error) (err error) {
+		for _, e := range entries {
+			if err = write(e.key, e.nc); err != nil {
+				break
+			}
+		}
+		return
+	})
+}
+
+// writeDiskNeedleMap write count sorted entries into a temp file then rename
+// to the sorted file.
+func writeDiskNeedleMap(file string, offset int64, boffset uint32, count int, entries func(write func(key int64, nc NeedleCache) error) error) (err error) {
+	var (
+		f     *os.File
+		n     int
+		pages []int64
+		tfile = file + ".tmp"
+		buf   = make([]byte, diskNeedleMapHeaderSize)
+		bw    *bufio.Writer
+	)
+	if f, err = os.OpenFile(tfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664); err != nil {
+		log.Errorf("os.OpenFile(\"%s\", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664) error(%v)", tfile, err)
+		return
+	}
+	bw = bufio.NewWriterSize(f, diskNeedleMapPageSize*16)
+	copy(buf, diskNeedleMapMagic)
+	buf[diskNeedleMapVerOffset] = diskNeedleMapVer1
+	BigEndian.PutInt64(buf[diskNeedleMapIndexOffset:], offset)
+	BigEndian.PutUint32(buf[diskNeedleMapBlockOffset:], boffset)
+	BigEndian.PutInt64(buf[diskNeedleMapCountOffset:], int64(count))
+	if _, err = bw.Write(buf); err != nil {
+		goto failed
+	}
+	if err = entries(func(key int64, nc NeedleCache) (err error) {
+		if n%diskNeedleMapPage == 0 {
+			pages = append(pages, key)
+		}
+		n++
+		if err = BigEndian.WriteInt64(bw, key); err != nil {
+			return
+		}
+		return BigEndian.WriteInt64(bw, int64(nc))
+	}); err != nil {
+		goto failed
+	}
+	if n != count {
+		err = ErrSortedCount
+		goto failed
+	}
+	for _, key := range pages {
+		if err = BigEndian.WriteInt64(bw, key); err != nil {
+			goto failed
+		}
+	}
+	if err = bw.Flush(); err != nil {
+		goto failed
+	}
+	if err = f.Sync(); err != nil {
+		goto failed
+	}
+	if err = f.Close(); err != nil {
+		log.Errorf("sorted: %s close error(%v)", tfile, err)
+		return
+	}
+	if err = os.Rename(tfile, file); err != nil {
+		log.Errorf("os.Rename(\"%s\", \"%s\") error(%v)", tfile, file, err)
+	}
+	return
+failed:
+	log.Errorf("sorted: %s write error(%v)", tfile, err)
+	f.Close()
+	os.Remove(tfile)
+	return
+}
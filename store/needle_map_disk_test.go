@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestDiskNeedleMap(t *testing.T) {
+	var (
+		ok    bool
+		err   error
+		key   int64
+		nc    NeedleCache
+		m     *DiskNeedleMap
+		n     = 10000
+		file  = "./test/test.sorted"
+		hashm = make(HashNeedleMap)
+	)
+	defer os.Remove(file)
+	for key = 0; key < int64(n); key += 2 {
+		hashm.Set(key, NewNeedleCache(uint32(key+1), 8))
+	}
+	if err = WriteDiskNeedleMap(file, hashm, 16, 8); err != nil {
+		t.Errorf("WriteDiskNeedleMap() error(%v)", err)
+		goto failed
+	}
+	if m, err = OpenDiskNeedleMap(file); err != nil {
+		t.Errorf("OpenDiskNeedleMap() error(%v)", err)
+		goto failed
+	}
+	if m.Offset != 16 || m.BlockOffset != 8 || m.Len() != n/2 {
+		err = fmt.Errorf("offset: %d, block offset: %d, len: %d not match", m.Offset, m.BlockOffset, m.Len())
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Get")
+	for key = 0; key < int64(n); key++ {
+		nc, ok = m.Get(key)
+		if ok != (key%2 == 0) || (ok && nc != NewNeedleCache(uint32(key+1), 8)) {
+			err = fmt.Errorf("Get(%d) not match", key)
+			t.Error(err)
+			goto failed
+		}
+	}
+	t.Log("Set")
+	for key = 0; key < int64(n); key++ {
+		m.Set(key, NewNeedleCache(uint32(key+2), 8))
+	}
+	m.Set(-1, NewNeedleCache(NeedleCacheDelOffset, 8))
+	if m.Len() != n+1 {
+		err = fmt.Errorf("Len(): %d not match", m.Len())
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Merge")
+	if err = m.Merge(32, 16); err != nil {
+		t.Errorf("Merge() error(%v)", err)
+		goto failed
+	}
+	m.Close()
+	if m, err = OpenDiskNeedleMap(file); err != nil {
+		t.Errorf("OpenDiskNeedleMap() error(%v)", err)
+		goto failed
+	}
+	if m.Offset != 32 || m.BlockOffset != 16 || m.Len() != n+1 {
+		err = fmt.Errorf("offset: %d, block offset: %d, len: %d not match", m.Offset, m.BlockOffset, m.Len())
+		t.Error(err)
+		goto failed
+	}
+	if err = testNeedleMap(m, n+1); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Merge frozen")
+	m.freeze()
+	// set while the frozen delta is written
+	m.Set(2, NewNeedleCache(200, 8))
+	m.Set(int64(n), NewNeedleCache(201, 8))
+	if err = testDiskNeedleMap(m, n+2); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	if err = m.write(48, 24); err != nil {
+		t.Errorf("write() error(%v)", err)
+		goto failed
+	}
+	if err = m.reopen(); err != nil {
+		t.Errorf("reopen() error(%v)", err)
+		goto failed
+	}
+	if m.Offset != 48 || len(m.delta) != 2 || m.merging != nil {
+		err = fmt.Errorf("offset: %d, delta: %d not match", m.Offset, len(m.delta))
+		t.Error(err)
+		goto failed
+	}
+	if err = testDiskNeedleMap(m, n+2); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	if err = m.Merge(64, 32); err != nil {
+		t.Errorf("Merge() error(%v)", err)
+		goto failed
+	}
+	if err = testDiskNeedleMap(m, n+2); err != nil {
+		t.Error(err)
+		goto failed
+	}
+failed:
+	if m != nil && m.f != nil {
+		m.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+// testDiskNeedleMap check the keys set by testNeedleMap and the frozen merge.
+func testDiskNeedleMap(m *DiskNeedleMap, n int) (err error) {
+	var (
+		nc    NeedleCache
+		count int
+	)
+	if m.Len() != n {
+		return fmt.Errorf("Len(): %d not match", m.Len())
+	}
+	if nc, _ = m.Get(2); nc != NewNeedleCache(200, 8) {
+		return fmt.Errorf("Get(2) not match")
+	}
+	if nc, _ = m.Get(3); nc != NewNeedleCache(5, 8) {
+		return fmt.Errorf("Get(3) not match")
+	}
+	if nc, _ = m.Get(int64(n - 2)); nc != NewNeedleCache(201, 8) {
+		return fmt.Errorf("Get(%d) not match", n-2)
+	}
+	m.Range(func(key int64, nc NeedleCache) bool {
+		count++
+		return true
+	})
+	if count != n {
+		return fmt.Errorf("Range() count: %d not match", count)
+	}
+	return
+}
+
+func TestVolumeConvertIndex(t *testing.T) {
+	var (
+		v     *Volume
+		err   error
+		buf   = make([]byte, 40)
+		data  = []byte("test")
+		bfile = "./test/test.convert"
+		ifile = "./test/test.convert.idx"
+		sfile = ifile + diskNeedleMapSuffix
+		o     = &VolumeOptions{NeedleMap: NeedleMapDisk}
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	defer os.Remove(sfile)
+	if v, err = NewVolume(1, bfile, ifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	for key := int64(1); key <= 10; key++ {
+		if err = v.Add(key, key, data); err != nil {
+			t.Errorf("Add() error(%v)", err)
+			goto failed
+		}
+	}
+	t.Log("ConvertIndex disk")
+	if err = v.ConvertIndex(NeedleMapDisk); err != nil {
+		t.Errorf("ConvertIndex() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(11, 11, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if err = v.Del(2); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	v.Close()
+	t.Log("reopen disk")
+	if v, err = NewVolume(1, bfile, ifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if _, ok := v.needles.(*DiskNeedleMap); !ok {
+		err = fmt.Errorf("needle map not disk")
+		t.Error(err)
+		goto failed
+	}
+	if err = testVolumeKeys(v, buf, 11, 2); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	t.Log("ConvertIndex compact")
+	if err = v.ConvertIndex(NeedleMapCompact); err != nil {
+		t.Errorf("ConvertIndex() error(%v)", err)
+		goto failed
+	}
+	if _, err = os.Stat(sfile); !os.IsNotExist(err) {
+		err = fmt.Errorf("sorted file not removed")
+		t.Error(err)
+		goto failed
+	}
+	if err = testVolumeKeys(v, buf, 11, 2); err != nil {
+		t.Error(err)
+		goto failed
+	}
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+// testVolumeKeys check the keys 1 to n can be get except the deleted one.
+func testVolumeKeys(v *Volume, buf []byte, n, del int64) (err error) {
+	for key := int64(1); key <= n; key++ {
+		_, err = v.Get(key, key, buf)
+		if key == del {
+			if err != ErrNeedleDeleted {
+				return fmt.Errorf("Get(%d) error(%v) not deleted", key, err)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Get(%d) error(%v)", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestNeedleMap(t *testing.T) {
+	var (
+		err error
+		n   = 100000
+	)
+	for _, typ := range []string{NeedleMapHash, NeedleMapCompact} {
+		t.Logf("NeedleMap: %s", typ)
+		if err = testNeedleMap(NewNeedleMap(typ, 0), n); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+}
+
+func TestCompactNeedleMapFrozen(t *testing.T) {
+	var (
+		err     error
+		nc      NeedleCache
+		entries compactEntries
+		m       = NewCompactNeedleMap(0)
+	)
+	for key := int64(0); key < 10; key++ {
+		m.Set(key, NewNeedleCache(uint32(key+1), 8))
+	}
+	m.Merge()
+	for key := int64(10); key < 20; key++ {
+		m.Set(key, NewNeedleCache(uint32(key+1), 8))
+	}
+	m.freeze()
+	t.Log("Set while merging")
+	// the entry, frozen and new keys
+	m.Set(1, NewNeedleCache(100, 8))
+	m.Set(11, NewNeedleCache(101, 8))
+	m.Set(20, NewNeedleCache(102, 8))
+	if nc, _ = m.Get(0); nc != NewNeedleCache(1, 8) || len(m.entries) != 10 || m.entries[1].nc != NewNeedleCache(2, 8) {
+		err = fmt.Errorf("entries updated in place while merging")
+		t.Error(err)
+		goto failed
+	}
+	if err = testCompactNeedleMap(m, 21); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	entries = m.merged()
+	// set between the merge and the swap
+	m.Set(21, NewNeedleCache(22, 8))
+	m.swap(entries)
+	if err = testCompactNeedleMap(m, 22); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	m.Merge()
+	if len(m.delta) != 0 || len(m.entries) != 22 {
+		err = fmt.Errorf("Merge() delta: %d, entries: %d not match", len(m.delta), len(m.entries))
+		t.Error(err)
+		goto failed
+	}
+	if err = testCompactNeedleMap(m, 22); err != nil {
+		t.Error(err)
+		goto failed
+	}
+failed:
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestVolumeCompactNeedles(t *testing.T) {
+	var (
+		v      *Volume
+		err    error
+		cm     *CompactNeedleMap
+		frozen bool
+		buf    = make([]byte, 40)
+		data   = []byte("test")
+		bfile  = "./test/test.compact"
+		ifile  = "./test/test.compact.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	if v, err = NewVolume(1, bfile, ifile, &VolumeOptions{NeedleMap: NeedleMapCompact}); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	for key := int64(1); key <= 100; key++ {
+		if err = v.Add(key, key, data); err != nil {
+			t.Errorf("Add() error(%v)", err)
+			goto failed
+		}
+	}
+	t.Log("merge in background")
+	cm = v.needles.(*CompactNeedleMap)
+	v.lock.Lock()
+	v.nlock.Lock()
+	cm.freeze()
+	v.nlock.Unlock()
+	v.lock.Unlock()
+	go v.compactNeedles(cm)
+	for key := int64(101); key <= 200; key++ {
+		if err = v.Add(key, key, data); err != nil {
+			t.Errorf("Add() error(%v)", err)
+			goto failed
+		}
+		if _, err = v.Get(key-100, key-100, buf); err != nil {
+			t.Errorf("Get(%d) error(%v)", key-100, err)
+			goto failed
+		}
+	}
+	for frozen = true; frozen; {
+		v.nlock.RLock()
+		frozen = cm.frozen != nil
+		v.nlock.RUnlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = testVolumeKeys(v, buf, 200, 0); err != nil {
+		t.Error(err)
+		goto failed
+	}
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+// testCompactNeedleMap check the n keys set by TestCompactNeedleMapFrozen.
+func testCompactNeedleMap(m *CompactNeedleMap, n int64) (err error) {
+	var (
+		nc     NeedleCache
+		count  int
+		expect = map[int64]NeedleCache{1: NewNeedleCache(100, 8), 11: NewNeedleCache(101, 8), 20: NewNeedleCache(102, 8)}
+	)
+	for key := int64(0); key < n; key++ {
+		if _, ok := expect[key]; !ok {
+			expect[key] = NewNeedleCache(uint32(key+1), 8)
+		}
+	}
+	m.Range(func(key int64, nc NeedleCache) bool {
+		if expect[key] != nc {
+			err = fmt.Errorf("Range() key: %d not match", key)
+			return false
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		return
+	}
+	if m.Len() != len(expect) || count != len(expect) {
+		return fmt.Errorf("Len(): %d, Range() count: %d not match", m.Len(), count)
+	}
+	for key, enc := range expect {
+		if nc, _ = m.Get(key); nc != enc {
+			return fmt.Errorf("Get(%d) not match", key)
+		}
+	}
+	return
+}
+
+func testNeedleMap(m NeedleMap, n int) (err error) {
+	var (
+		ok    bool
+		nc    NeedleCache
+		count int
+		key   int64
+	)
+	// key zero and negative keys are valid
+	for key = -1; key < int64(n)-1; key++ {
+		m.Set(key, NewNeedleCache(uint32(key+2), 8))
+	}
+	if m.Len() != n {
+		return fmt.Errorf("Len(): %d not match", m.Len())
+	}
+	for key = -1; key < int64(n)-1; key++ {
+		if nc, ok = m.Get(key); !ok || nc != NewNeedleCache(uint32(key+2), 8) {
+			return fmt.Errorf("Get(%d) not match", key)
+		}
+	}
+	if _, ok = m.Get(int64(n)); ok {
+		return fmt.Errorf("Get(%d) must not exist", n)
+	}
+	// overwrite
+	m.Set(0, NewNeedleCache(NeedleCacheDelOffset, 8))
+	m.Set(1, NewNeedleCache(NeedleCacheDelOffset, 8))
+	if nc, _ = m.Get(1); nc != NewNeedleCache(NeedleCacheDelOffset, 8) {
+		return fmt.Errorf("Get(1) not match")
+	}
+	if m.Len() != n {
+		return fmt.Errorf("Len(): %d not match", m.Len())
+	}
+	m.Range(func(key int64, nc NeedleCache) bool {
+		count++
+		return true
+	})
+	if count != n {
+		return fmt.Errorf("Range() count: %d not match", count)
+	}
+	count = 0
+	m.Range(func(key int64, nc NeedleCache) bool {
+		count++
+		return count < 10
+	})
+	if count != 10 {
+		return fmt.Errorf("Range() stop count: %d not match", count)
+	}
+	return
+}
+
+const benchmarkNeedleMapKeys = 1000000
+
+// benchmarkNeedleMap fill a needle map and get the bytes per key.
+func benchmarkNeedleMap(typ string) (m NeedleMap, bytes float64) {
+	var (
+		i      int64
+		before runtime.MemStats
+		after  runtime.MemStats
+	)
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	m = NewNeedleMap(typ, 0)
+	for i = 0; i < benchmarkNeedleMapKeys; i++ {
+		m.Set(i, NewNeedleCache(uint32(i), 8))
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	bytes = float64(after.HeapAlloc-before.HeapAlloc) / benchmarkNeedleMapKeys
+	return
+}
+
+func benchmarkNeedleMapGet(b *testing.B, typ string) {
+	var m, bytes = benchmarkNeedleMap(typ)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := m.Get(mrand.Int63n(benchmarkNeedleMapKeys)); !ok {
+			b.FailNow()
+		}
+	}
+	b.ReportMetric(bytes, "bytes/key")
+}
+
+func benchmarkNeedleMapSet(b *testing.B, typ string) {
+	var m = NewNeedleMap(typ, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Set(int64(i), NewNeedleCache(uint32(i), 8))
+	}
+}
+
+func BenchmarkNeedleMapHashGet(b *testing.B) {
+	benchmarkNeedleMapGet(b, NeedleMapHash)
+}
+
+func BenchmarkNeedleMapCompactGet(b *testing.B) {
+	benchmarkNeedleMapGet(b, NeedleMapCompact)
+}
+
+func BenchmarkNeedleMapHashSet(b *testing.B) {
+	benchmarkNeedleMapSet(b, NeedleMapHash)
+}
+
+func BenchmarkNeedleMapCompactSet(b *testing.B) {
+	benchmarkNeedleMapSet(b, NeedleMapCompact)
+}
@@ -42,12 +42,12 @@ func TestNeedle(t *testing.T) {
 		goto failed
 	}
 	t.Log("FillNeedle")
-	FillNeedle(padding, int32(len(data)), 1, 1, data, buf)
+	FillNeedle(padding, int32(len(data)), 1, 1, NeedleEncodingNone, data, buf, NeedleChecksumCastagnoli)
 	if err = n.ParseHeader(buf[:NeedleHeaderSize]); err != nil {
 		t.Errorf("n.ParseHeader() error(%v)", err)
 		goto failed
 	}
-	if err = n.ParseData(buf[NeedleHeaderSize:]); err != nil {
+	if err = n.ParseData(buf[NeedleHeaderSize:], NeedleChecksumCastagnoli); err != nil {
 		t.Errorf("n.ParseData() error(%v)", err)
 		goto failed
 	}
@@ -56,7 +56,7 @@ func TestNeedle(t *testing.T) {
 		t.Error(err)
 		goto failed
 	}
-	if err = WriteNeedle(bw, padding, size, 1, 1, data); err != nil {
+	if err = WriteNeedle(bw, padding, size, 1, 1, NeedleEncodingNone, data, NeedleChecksumCastagnoli); err != nil {
 		t.Errorf("WriteNeedle() error(%v)", err)
 		goto failed
 	}
@@ -65,7 +65,7 @@ func TestNeedle(t *testing.T) {
 		t.Errorf("n.ParseHeader() error(%v)", err)
 		goto failed
 	}
-	if err = n.ParseData(buf[NeedleHeaderSize:]); err != nil {
+	if err = n.ParseData(buf[NeedleHeaderSize:], NeedleChecksumCastagnoli); err != nil {
 		t.Errorf("n.ParseData() error(%v)", err)
 		goto failed
 	}
@@ -79,3 +79,80 @@ failed:
 		t.FailNow()
 	}
 }
+
+func TestNeedleChecksum(t *testing.T) {
+	var (
+		err     error
+		c       NeedleChecksum
+		padding int32
+		n       = &Needle{}
+		data    = []byte("test")
+		buf     = make([]byte, 40)
+	)
+	if c, err = ParseNeedleChecksum(""); err != nil || c != NeedleChecksumCastagnoli {
+		err = fmt.Errorf("ParseNeedleChecksum(\"\") not crc32c")
+		t.Error(err)
+		goto failed
+	}
+	if c, err = ParseNeedleChecksum(NeedleChecksumOptKoopman); err != nil || c != NeedleChecksumKoopman {
+		err = fmt.Errorf("ParseNeedleChecksum(koopman) not match")
+		t.Error(err)
+		goto failed
+	}
+	if _, err = ParseNeedleChecksum("md5"); err != ErrNeedleCrcType {
+		err = fmt.Errorf("ParseNeedleChecksum(md5) error(%v)", err)
+		t.Error(err)
+		goto failed
+	}
+	if NeedleChecksum(2).Valid() {
+		err = fmt.Errorf("NeedleChecksum(2) valid")
+		t.Error(err)
+		goto failed
+	}
+	padding, _, _ = NeedleSize(4)
+	for _, c = range []NeedleChecksum{NeedleChecksumKoopman, NeedleChecksumCastagnoli} {
+		t.Logf("checksum: %d", c)
+		FillNeedle(padding, int32(len(data)), 1, 1, NeedleEncodingNone, data, buf, c)
+		if err = n.ParseHeader(buf[:NeedleHeaderSize]); err != nil {
+			t.Errorf("n.ParseHeader() error(%v)", err)
+			goto failed
+		}
+		if err = n.ParseData(buf[NeedleHeaderSize:], c); err != nil {
+			t.Errorf("n.ParseData() error(%v)", err)
+			goto failed
+		}
+		if n.Checksum != c.Sum(data) {
+			err = fmt.Errorf("checksum: %d not match", n.Checksum)
+			t.Error(err)
+			goto failed
+		}
+		// the other algorithm
+		if err = n.ParseData(buf[NeedleHeaderSize:], c^1); err != ErrNeedleChecksum {
+			err = fmt.Errorf("n.ParseData() other checksum error(%v)", err)
+			t.Error(err)
+			goto failed
+		}
+	}
+	err = nil
+failed:
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func BenchmarkNeedleChecksumKoopman(b *testing.B) {
+	benchmarkNeedleChecksum(b, NeedleChecksumKoopman)
+}
+
+func BenchmarkNeedleChecksumCastagnoli(b *testing.B) {
+	benchmarkNeedleChecksum(b, NeedleChecksumCastagnoli)
+}
+
+func benchmarkNeedleChecksum(b *testing.B, c NeedleChecksum) {
+	var data = make([]byte, 1024*1024)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Sum(data)
+	}
+}
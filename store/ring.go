@@ -1,11 +1,17 @@
 package main
 
+import (
+	"sync/atomic"
+)
+
+// Ring a single reader single writer index ring, the read and write counts
+// are atomic so the reader see the index data the writer advanced.
 type Ring struct {
 	// read
-	rn int
+	rn int64
 	rp int
 	// write
-	wn int
+	wn int64
 	wp int
 	// info
 	num  int
@@ -27,7 +33,7 @@ func InitRing(r *Ring, num int) {
 }
 
 func (r *Ring) Get() (index *Index, err error) {
-	if r.wn == r.rn {
+	if atomic.LoadInt64(&r.wn) == atomic.LoadInt64(&r.rn) {
 		return nil, ErrRingEmpty
 	}
 	index = &r.data[r.rp]
@@ -38,14 +44,14 @@ func (r *Ring) GetAdv() {
 	if r.rp++; r.rp >= r.num {
 		r.rp = 0
 	}
-	r.rn++
+	atomic.AddInt64(&r.rn, 1)
 	//if Conf.Debug {
 	//	log.Debug("ring rn: %d, rp: %d", r.rn, r.rp)
 	//}
 }
 
 func (r *Ring) Set() (index *Index, err error) {
-	if r.wn-r.rn >= r.num {
+	if atomic.LoadInt64(&r.wn)-atomic.LoadInt64(&r.rn) >= int64(r.num) {
 		return nil, ErrRingFull
 	}
 	index = &r.data[r.wp]
@@ -56,15 +62,19 @@ func (r *Ring) SetAdv() {
 	if r.wp++; r.wp >= r.num {
 		r.wp = 0
 	}
-	r.wn++
+	atomic.AddInt64(&r.wn, 1)
 	//if Conf.Debug {
 	//	log.Debug("ring wn: %d, wp: %d", r.wn, r.wp)
 	//}
 }
 
+func (r *Ring) Len() int {
+	return int(atomic.LoadInt64(&r.wn) - atomic.LoadInt64(&r.rn))
+}
+
 func (r *Ring) Reset() {
-	r.rn = 0
+	atomic.StoreInt64(&r.rn, 0)
 	r.rp = 0
-	r.wn = 0
+	atomic.StoreInt64(&r.wn, 0)
 	r.wp = 0
 }
@@ -0,0 +1,232 @@
+package main
+
+const (
+	// the gf(2^8) polynomial: x^8 + x^4 + x^3 + x^2 + 1
+	gfPolynomial = 0x11d
+	gfSize       = 256
+)
+
+var (
+	gfExp [2 * gfSize]byte
+	gfLog [gfSize]byte
+	// the multiply table of every coefficient
+	gfMulTable [gfSize][gfSize]byte
+)
+
+func init() {
+	var (
+		i, j int
+		x    = 1
+	)
+	for i = 0; i < gfSize-1; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		if x <<= 1; x&gfSize != 0 {
+			x ^= gfPolynomial
+		}
+	}
+	for i = gfSize - 1; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-(gfSize-1)]
+	}
+	for i = 1; i < gfSize; i++ {
+		for j = 1; j < gfSize; j++ {
+			gfMulTable[i][j] = gfExp[int(gfLog[i])+int(gfLog[j])]
+		}
+	}
+}
+
+// gfInv get the multiplicative inverse of a non zero a.
+func gfInv(a byte) byte {
+	return gfExp[gfSize-1-int(gfLog[a])]
+}
+
+// gfMulAdd dst += c * src.
+func gfMulAdd(dst, src []byte, c byte) {
+	var t = &gfMulTable[c]
+	if c == 0 {
+		return
+	}
+	for i, b := range src {
+		dst[i] ^= t[b]
+	}
+}
+
+// ReedSolomon the systematic reed-solomon code over gf(2^8), the data shards
+// are kept as is, the parity shards are computed by a cauchy matrix, so any
+// data shards of the data and parity shards can reconstruct the others.
+//
+// encoding matrix:
+//
+//	 ---------------
+//	|   identity    |  data rows
+//	 ---------------
+//	|    cauchy     |  parity rows: 1 / (x[i] + y[j]), x[i] = data + i, y[j] = j
+//	 ---------------
+type ReedSolomon struct {
+	data   int
+	parity int
+	// the parity rows of encoding matrix
+	matrix [][]byte
+}
+
+// NewReedSolomon new a reed-solomon code of data and parity shards, at most
+// 256 shards.
+func NewReedSolomon(data, parity int) (r *ReedSolomon, err error) {
+	var i, j int
+	if data < 1 || parity < 1 || data+parity > gfSize {
+		err = ErrEcCount
+		return
+	}
+	r = &ReedSolomon{data: data, parity: parity}
+	r.matrix = make([][]byte, parity)
+	for i = 0; i < parity; i++ {
+		r.matrix[i] = make([]byte, data)
+		for j = 0; j < data; j++ {
+			r.matrix[i][j] = gfInv(byte(data+i) ^ byte(j))
+		}
+	}
+	return
+}
+
+// row get the encoding matrix row of shard i.
+func (r *ReedSolomon) row(i int) (row []byte) {
+	if i >= r.data {
+		return r.matrix[i-r.data]
+	}
+	row = make([]byte, r.data)
+	row[i] = 1
+	return
+}
+
+// check check the shards count and the size of the ones not nil.
+func (r *ReedSolomon) check(shards [][]byte) (size int, err error) {
+	size = -1
+	if len(shards) != r.data+r.parity {
+		err = ErrEcCount
+		return
+	}
+	for _, s := range shards {
+		if s == nil {
+			continue
+		}
+		if size == -1 {
+			size = len(s)
+		} else if len(s) != size {
+			err = ErrEcShardSize
+			return
+		}
+	}
+	return
+}
+
+// Encode compute the parity shards from the data shards, all the shards
+// must be allocated with the same size.
+func (r *ReedSolomon) Encode(shards [][]byte) (err error) {
+	var (
+		i, j int
+		p    []byte
+	)
+	if _, err = r.check(shards); err != nil {
+		return
+	}
+	for i = 0; i < r.parity; i++ {
+		if p = shards[r.data+i]; p == nil {
+			return ErrEcShardSize
+		}
+		for j = range p {
+			p[j] = 0
+		}
+		for j = 0; j < r.data; j++ {
+			if shards[j] == nil {
+				return ErrEcShardSize
+			}
+			gfMulAdd(p, shards[j], r.matrix[i][j])
+		}
+	}
+	return
+}
+
+// Reconstruct reconstruct the missing (nil) data shards from any data shards
+// of the others, the missing parity shards are left, Encode them if needed.
+func (r *ReedSolomon) Reconstruct(shards [][]byte) (err error) {
+	var (
+		i, j, size int
+		rows       [][]byte
+		present    [][]byte
+		inv        [][]byte
+	)
+	if size, err = r.check(shards); err != nil {
+		return
+	}
+	for i = 0; i < r.data; i++ {
+		if shards[i] == nil {
+			break
+		}
+	}
+	if i == r.data {
+		return
+	}
+	for i = 0; i < len(shards) && len(present) < r.data; i++ {
+		if shards[i] != nil {
+			rows = append(rows, r.row(i))
+			present = append(present, shards[i])
+		}
+	}
+	if len(present) < r.data {
+		err = ErrEcShards
+		return
+	}
+	if inv, err = gfInvert(rows); err != nil {
+		return
+	}
+	for i = 0; i < r.data; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		shards[i] = make([]byte, size)
+		for j = 0; j < r.data; j++ {
+			gfMulAdd(shards[i], present[j], inv[i][j])
+		}
+	}
+	return
+}
+
+// gfInvert invert a square matrix by gauss-jordan elimination.
+func gfInvert(m [][]byte) (inv [][]byte, err error) {
+	var (
+		i, j, k int
+		c       byte
+		n       = len(m)
+		a       = make([][]byte, n)
+	)
+	// the augmented matrix [m | identity]
+	for i = 0; i < n; i++ {
+		a[i] = make([]byte, 2*n)
+		copy(a[i], m[i])
+		a[i][n+i] = 1
+	}
+	for i = 0; i < n; i++ {
+		for j = i; j < n && a[j][i] == 0; j++ {
+		}
+		if j == n {
+			err = ErrEcMatrix
+			return
+		}
+		a[i], a[j] = a[j], a[i]
+		if c = gfInv(a[i][i]); c != 1 {
+			for k = 0; k < 2*n; k++ {
+				a[i][k] = gfMulTable[c][a[i][k]]
+			}
+		}
+		for j = 0; j < n; j++ {
+			if j != i && a[j][i] != 0 {
+				gfMulAdd(a[j], a[i], a[j][i])
+			}
+		}
+	}
+	inv = make([][]byte, n)
+	for i = 0; i < n; i++ {
+		inv[i] = a[i][n:]
+	}
+	return
+}
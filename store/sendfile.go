@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	log "github.com/golang/glog"
+	"hash"
+	"io"
+	"os"
+)
+
+const (
+	// sendfile checksum policy
+	SendfileVerifyStream = "stream"
+	SendfileVerifyScrub  = "scrub"
+)
+
+// NeedleFile the data region of a needle in the block file, the header and
+// footer are validated when opened, WriteTo a net.Conn (or a http response)
+// sends the data with sendfile, the data is encoded by Encoding, and the
+// size before encoded is OriginalSize.
+type NeedleFile struct {
+	Key      int64
+	Size     int32
+	f        *os.File
+	r        *io.LimitedReader
+	checksum uint32
+	verify   bool
+	c        NeedleChecksum
+	// encoding
+	Encoding     NeedleEncoding
+	OriginalSize int32
+}
+
+// Sendfile check the needle of key should be sent by a NeedleFile, the
+// encrypted volume is never sent by a NeedleFile.
+func (v *Volume) Sendfile(key int64) bool {
+	var (
+		size int32
+		nc   NeedleCache
+	)
+	if v.options.Sendfile <= 0 || v.block.KeyId != cryptNoKey {
+		return false
+	}
+	v.nlock.RLock()
+	nc, _ = v.needles.Get(key)
+	v.nlock.RUnlock()
+	_, size = nc.Value()
+	return size >= v.options.Sendfile
+}
+
+// Open open the needle data of key in block file, the file is opened for
+// every needle, so the concurrent senders won't share the file offset.
+func (v *Volume) Open(key, cookie int64) (nf *NeedleFile, err error) {
+	var (
+		ok     bool
+		offset uint32
+		size   int32
+		nc     NeedleCache
+		f      *os.File
+		t      = newOpTrace(v.Id, volumeOpGet, key)
+		n      = &Needle{}
+		buf    = make([]byte, NeedleHeaderSize)
+		// the gzip isize, footer and the encoding padding byte
+		tail   = make([]byte, gzipIsizeSize+NeedleFooterSize+1)
+		footer = tail[gzipIsizeSize:]
+	)
+	if err = v.diskError(); err != nil {
+		t.done(err)
+		return
+	}
+	v.nlock.RLock()
+	t.mark(tracePhaseLock)
+	nc, ok = v.needles.Get(key)
+	v.nlock.RUnlock()
+	if !ok {
+		err = ErrNoNeedle
+		goto failed
+	}
+	if offset, size = nc.Value(); offset == NeedleCacheDelOffset {
+		err = ErrNeedleDeleted
+		goto failed
+	}
+	if f, err = os.Open(v.block.File); err != nil {
+		log.Errorf("os.Open(\"%s\") error(%v)", v.block.File, err)
+		v.setIOError(err)
+		goto failed
+	}
+	if _, err = f.ReadAt(buf, BlockOffset(offset)); err != nil {
+		v.setIOError(err)
+		goto failed
+	}
+	if err = n.ParseHeader(buf); err != nil {
+		goto failed
+	}
+	if _, err = f.ReadAt(tail, BlockOffset(offset)+NeedleHeaderSize+int64(n.Size)-gzipIsizeSize); err != nil {
+		v.setIOError(err)
+		goto failed
+	}
+	t.mark(tracePhaseIO)
+	if !bytes.Equal(footer[:needleMagicSize], needleFooterMagic) {
+		err = ErrNeedleFooterMagic
+		goto failed
+	}
+	if n.Encoding = NeedleEncoding(footer[NeedleFooterSize]); !n.Encoding.Valid() {
+		err = ErrNeedlePadding
+		goto failed
+	}
+	// an alias has its own cookie
+	if n.Key != key {
+		if n.Cookie, ok = v.dedup.alias(key, offset); !ok {
+			err = ErrNeedleKey
+			goto failed
+		}
+	}
+	if n.Cookie != cookie {
+		err = ErrNeedleCookie
+		goto failed
+	}
+	// the del goroutine update the flag later
+	if n.Flag == NeedleStatusDel {
+		err = ErrNeedleDeleted
+		goto failed
+	}
+	if _, err = f.Seek(BlockOffset(offset)+NeedleHeaderSize, os.SEEK_SET); err != nil {
+		goto failed
+	}
+	nf = &NeedleFile{Key: key, Size: n.Size, Encoding: n.Encoding, OriginalSize: n.Size, f: f}
+	if n.Encoding != NeedleEncodingNone {
+		nf.OriginalSize = n.Encoding.Size(tail[:gzipIsizeSize])
+	}
+	nf.r = &io.LimitedReader{R: f, N: int64(n.Size)}
+	nf.checksum = BigEndian.Uint32(footer[needleMagicSize:])
+	nf.verify = v.options.SendfileVerify == SendfileVerifyStream
+	nf.c = v.block.Checksum
+	statVolumeRead(v.Id, int(n.Size))
+	t.done(nil)
+	log.V(1).Infof("open needle, key: %d, cookie: %d, offset: %d, size: %d", key, cookie, offset, size)
+	return
+failed:
+	if f != nil {
+		f.Close()
+	}
+	t.done(err)
+	return
+}
+
+// WriteTo write the needle data to w, if verify the data is copied through a
+// streaming checksum, the last byte is held back until verified, so the reader
+// never gets a complete corrupted needle, otherwise the data is only verified
+// by Get and compress, io.Copy uses sendfile if w is a net.Conn.
+func (nf *NeedleFile) WriteTo(w io.Writer) (n int64, err error) {
+	var (
+		ln   int
+		crc  hash.Hash32
+		r    io.Reader
+		last = make([]byte, 1)
+	)
+	if !nf.verify {
+		return io.Copy(w, nf.r)
+	}
+	crc = nf.c.New()
+	r = io.TeeReader(nf.r, crc)
+	if n, err = io.CopyN(w, r, int64(nf.Size)-1); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(r, last); err != nil {
+		return
+	}
+	if crc.Sum32() != nf.checksum {
+		log.Errorf("needle: %d checksum: %d not match: %d", nf.Key, crc.Sum32(), nf.checksum)
+		err = ErrNeedleChecksum
+		return
+	}
+	ln, err = w.Write(last)
+	n += int64(ln)
+	return
+}
+
+// Close close the block file opened.
+func (nf *NeedleFile) Close() error {
+	return nf.f.Close()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestVolumeSendfile(t *testing.T) {
+	var (
+		v      *Volume
+		s      *Store
+		err    error
+		nf     *NeedleFile
+		resp   *http.Response
+		body   []byte
+		srv    *httptest.Server
+		data   = make([]byte, 64*1024)
+		b      = &bytes.Buffer{}
+		file   = "./test/store.sendfile.idx"
+		bfile  = "./test/test.sendfile"
+		ifile  = "./test/test.sendfile.idx"
+		config = &Config{Index: file, Volume: VolumeOptions{Sendfile: 1024}}
+	)
+	defer os.Remove(file)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	if _, err = rand.Read(data); err != nil {
+		t.Errorf("rand.Read() error(%v)", err)
+		t.FailNow()
+	}
+	if s, err = NewStore(config); err != nil {
+		t.Errorf("NewStore() error(%v)", err)
+		t.FailNow()
+	}
+	defer s.Close()
+	if _, err = s.AddVolume(1, bfile, ifile); err != nil {
+		t.Errorf("AddVolume() error(%v)", err)
+		t.FailNow()
+	}
+	time.Sleep(1 * time.Second)
+	if v = s.Volume(1); v == nil {
+		t.Errorf("Volume(1) not exist")
+		t.FailNow()
+	}
+	if err = v.Add(1, 1, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		t.FailNow()
+	}
+	if err = v.Add(2, 2, []byte("test")); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		t.FailNow()
+	}
+	srv = httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		get(s, wr, r)
+	}))
+	defer srv.Close()
+	t.Log("http get")
+	for key, d := range map[int64][]byte{1: data, 2: []byte("test")} {
+		if resp, err = http.Get(fmt.Sprintf("%s/get?vid=1&key=%d&cookie=%d", srv.URL, key, key)); err != nil {
+			t.Errorf("http.Get() error(%v)", err)
+			t.FailNow()
+		}
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || !bytes.Equal(body, d) {
+			t.Errorf("get needle: %d status: %d error(%v) not match", key, resp.StatusCode, err)
+			t.FailNow()
+		}
+	}
+	if resp, err = http.Get(srv.URL + "/get?vid=1&key=1&cookie=2"); err != nil {
+		t.Errorf("http.Get() error(%v)", err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("get cookie status: %d not match", resp.StatusCode)
+		t.FailNow()
+	}
+	t.Log("corrupt")
+	offset, _ := v.needleValue(1)
+	if _, err = v.block.w.WriteAt([]byte{^data[0]}, BlockOffset(offset)+NeedleHeaderSize); err != nil {
+		t.Errorf("WriteAt() error(%v)", err)
+		t.FailNow()
+	}
+	v.options.SendfileVerify = SendfileVerifyStream
+	if nf, err = v.Open(1, 1); err != nil {
+		t.Errorf("Open() error(%v)", err)
+		t.FailNow()
+	}
+	_, err = nf.WriteTo(b)
+	nf.Close()
+	if err != ErrNeedleChecksum {
+		t.Errorf("WriteTo() stream error(%v) not match", err)
+		t.FailNow()
+	}
+	if resp, err = http.Get(srv.URL + "/get?vid=1&key=1&cookie=1"); err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("get corrupted needle not aborted")
+		t.FailNow()
+	}
+	v.options.SendfileVerify = SendfileVerifyScrub
+	if nf, err = v.Open(1, 1); err != nil {
+		t.Errorf("Open() error(%v)", err)
+		t.FailNow()
+	}
+	b.Reset()
+	_, err = nf.WriteTo(b)
+	nf.Close()
+	if err != nil || b.Len() != len(data) {
+		t.Errorf("WriteTo() scrub error(%v) len: %d", err, b.Len())
+		t.FailNow()
+	}
+	// the default is zero copy
+	v.options.SendfileVerify = ""
+	if nf, err = v.Open(1, 1); err != nil {
+		t.Errorf("Open() error(%v)", err)
+		t.FailNow()
+	}
+	nf.Close()
+	if nf.verify {
+		t.Errorf("Open() default verify not scrub")
+		t.FailNow()
+	}
+}
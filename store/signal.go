@@ -0,0 +1,31 @@
+package main
+
+import (
+	log "github.com/golang/glog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// InitSignal register signals handler.
+func InitSignal() chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	return c
+}
+
+// HandleSignal wait the exit signals.
+func HandleSignal(c chan os.Signal) {
+	for {
+		s := <-c
+		log.Infof("bfs store get a signal %s", s.String())
+		switch s {
+		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
+			return
+		case syscall.SIGHUP:
+			// TODO reload
+		default:
+			return
+		}
+	}
+}
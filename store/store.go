@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // Store get all volume meta data from a index file. index contains volume id,
@@ -55,25 +56,61 @@ type Store struct {
 	bp       *sync.Pool
 	file     string
 	VolumeId int32
-	volumes  map[int32]*Volume
+	volumes  atomic.Value // map[int32]*Volume
+	disks    []*Disk
+	options  *VolumeOptions
+	cache    *HotCache
+	// the read only erasure code volumes
+	erasure map[int32]*EcVolume
+	// free volumes
+	flock    sync.Mutex
+	fillLock sync.Mutex
+	free     []*Volume
+	freeNum  int
+	freeId   int
+	// health
+	failed  []*FailedVolume
+	running int32
 }
 
-// NewStore
-func NewStore(file string) (s *Store, err error) {
+// NewStore new a store, load the volumes from the volume index file.
+func NewStore(c *Config) (s *Store, err error) {
 	var (
 		i              int
+		dir            string
 		bfiles, ifiles []string
+		disk           *Disk
 		volume         *Volume
+		ecVolume       *EcVolume
+		ec             EcVolumeConfig
 		volumeIds      []int32
+		volumes        = make(map[int32]*Volume)
 	)
 	s = &Store{}
 	s.VolumeId = 1
-	s.volumes = make(map[int32]*Volume)
-	s.file = file
+	s.volumes.Store(make(map[int32]*Volume))
+	s.erasure = make(map[int32]*EcVolume)
+	s.file = c.Index
+	s.options = &c.Volume
+	s.freeNum = c.FreeVolumes
+	s.cache = NewHotCache(c.CacheSize)
+	if c.KeyFile != "" {
+		if s.options.Keys, err = NewKeyFile(c.KeyFile); err != nil {
+			log.Errorf("NewKeyFile(\"%s\") error(%v)", c.KeyFile, err)
+			return
+		}
+	}
+	for _, dir = range c.Dirs {
+		if disk, err = NewDisk(dir); err != nil {
+			return
+		}
+		s.disks = append(s.disks, disk)
+	}
 	s.ch = make(chan *Volume, storeMap)
+	atomic.StoreInt32(&s.running, 1)
 	go s.command()
-	if s.f, err = os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0664); err != nil {
-		log.Errorf("os.OpenFile(\"%s\", os.O_RDWR|os.O_CREATE, 0664) error(%v)", file, err)
+	if s.f, err = os.OpenFile(s.file, os.O_RDWR|os.O_CREATE, 0664); err != nil {
+		log.Errorf("os.OpenFile(\"%s\", os.O_RDWR|os.O_CREATE, 0664) error(%v)", s.file, err)
 		return
 	}
 	if volumeIds, bfiles, ifiles, err = s.parseIndex(); err != nil {
@@ -81,13 +118,27 @@ func NewStore(file string) (s *Store, err error) {
 		return
 	}
 	for i = 0; i < len(bfiles); i++ {
-		if volume, err = NewVolume(volumeIds[i], bfiles[i], ifiles[i]); err != nil {
+		if volume, err = s.newVolume(volumeIds[i], bfiles[i], ifiles[i]); err != nil {
 			log.Warningf("fail recovery volume_id: %d, file: %s, index: %s", volumeIds[i], bfiles[i], ifiles[i])
+			s.failed = append(s.failed, &FailedVolume{Id: volumeIds[i], Block: bfiles[i], Index: ifiles[i], Error: err.Error()})
+			err = nil
 			continue
 		}
-		s.volumes[volumeIds[i]] = volume
+		volumes[volumeIds[i]] = volume
+	}
+	s.volumes.Store(volumes)
+	for _, ec = range c.Erasure {
+		if ecVolume, err = NewEcVolume(ec.Id, ec.Shards, s.options); err != nil {
+			log.Warningf("fail open ec volume_id: %d, shards: %v", ec.Id, ec.Shards)
+			s.failed = append(s.failed, &FailedVolume{Id: ec.Id, Block: strings.Join(ec.Shards, volumeIndexComma), Error: err.Error()})
+			err = nil
+			continue
+		}
+		s.erasure[ec.Id] = ecVolume
 	}
 	s.bp = &sync.Pool{}
+	s.loadFreeVolumes()
+	s.fillFreeVolumes()
 	log.Infof("current max volume id: %d", s.VolumeId)
 	return
 }
@@ -139,14 +190,21 @@ func (s *Store) saveIndex() (err error) {
 		ok           bool
 		vid          int32
 		bfile, ifile string
-		vids         = make([]int32, len(s.volumes))
+		volumes      = s.Volumes()
+		vids         = make([]int32, 0, len(volumes))
 	)
-	for vid, v = range s.volumes {
+	for vid, v = range volumes {
 		vids = append(vids, vid)
 	}
 	sort.Sort(Int32Slice(vids))
+	if _, err = s.f.Seek(0, os.SEEK_SET); err != nil {
+		return
+	}
+	if err = s.f.Truncate(0); err != nil {
+		return
+	}
 	for _, vid = range vids {
-		if v, ok = s.volumes[vid]; ok {
+		if v, ok = volumes[vid]; ok {
 			bfile, ifile = v.File()
 			if _, err = s.f.Write([]byte(fmt.Sprintf("%s,%s,%d\n", bfile, ifile, vid))); err != nil {
 				return
@@ -160,10 +218,10 @@ func (s *Store) saveIndex() (err error) {
 // command do volume command.
 func (s *Store) command() {
 	var (
-		err       error
-		volumeId  int32
-		v, vt, vc *Volume
-		volumes   map[int32]*Volume
+		err          error
+		volumeId     int32
+		v, vt, vc    *Volume
+		volumes, ovs map[int32]*Volume
 	)
 	for {
 		v = <-s.ch
@@ -172,8 +230,9 @@ func (s *Store) command() {
 			break
 		}
 		// copy-on-write
-		volumes = make(map[int32]*Volume, len(s.volumes))
-		for volumeId, vt = range s.volumes {
+		ovs = s.Volumes()
+		volumes = make(map[int32]*Volume, len(ovs))
+		for volumeId, vt = range ovs {
 			volumes[volumeId] = vt
 		}
 		vc = volumes[v.Id]
@@ -191,23 +250,54 @@ func (s *Store) command() {
 		} else {
 			panic("unknow store flag")
 		}
-		// close volume
-		if vc != nil {
-			vc.Close()
+		// the volume replaced or deleted, drop the cached needles and the
+		// late sets of the old volume readers
+		if v.Command == storeDel {
+			s.cache.DelVolume(v.Id, v.gen+1)
+		} else {
+			s.cache.DelVolume(v.Id, v.gen)
 		}
 		// atomic update ptr
-		s.volumes = volumes
+		s.volumes.Store(volumes)
+		// the replaced volume is closed after the readers release it
+		if vc != nil {
+			vc.Unref()
+		}
+		if v.Command == storeDel {
+			statVolumeDel(v.Id)
+		}
 		if err = s.saveIndex(); err != nil {
 			log.Errorf("store save index: %s error(%v)", s.file, err)
 		}
 	}
+	atomic.StoreInt32(&s.running, 0)
 	log.Errorf("store command goroutine exit")
 }
 
+// newVolume new a volume and bind it to the disk it belongs to.
+func (s *Store) newVolume(id int32, bfile, ifile string) (v *Volume, err error) {
+	var d *Disk
+	for _, d = range s.disks {
+		if d.Contains(bfile) {
+			if err = d.Error(); err != nil {
+				return
+			}
+			break
+		}
+		d = nil
+	}
+	if v, err = NewVolume(id, bfile, ifile, s.options); err != nil {
+		return
+	}
+	v.disk = d
+	v.cache = s.cache
+	return
+}
+
 // AddVolume add a new volume.
 func (s *Store) AddVolume(id int32, bfile, ifile string) (v *Volume, err error) {
 	// test
-	if v, err = NewVolume(id, bfile, ifile); err != nil {
+	if v, err = s.newVolume(id, bfile, ifile); err != nil {
 		return
 	}
 	v.Command = storeAdd
@@ -215,6 +305,185 @@ func (s *Store) AddVolume(id int32, bfile, ifile string) (v *Volume, err error)
 	return
 }
 
+// CreateVolume create a new volume, store choose the disk which has the most
+// free space, claim a pre-created free volume on it if exists.
+func (s *Store) CreateVolume(id int32) (v *Volume, err error) {
+	var (
+		bfile, ifile string
+		d            *Disk
+	)
+	if s.Volume(id) != nil {
+		err = ErrVolumeExist
+		return
+	}
+	if d, err = s.pickDisk(); err != nil {
+		return
+	}
+	bfile, ifile = d.VolumeFile(id)
+	if v = s.claimFreeVolume(d); v == nil {
+		v, err = s.AddVolume(id, bfile, ifile)
+		return
+	}
+	// reopen the free volume with the id, the goroutines never see it change
+	obfile, oifile := v.File()
+	v.Close()
+	if err = renameVolume(obfile, oifile, bfile, ifile); err != nil {
+		v = nil
+		return
+	}
+	v, err = s.AddVolume(id, bfile, ifile)
+	go s.fillFreeVolumes()
+	return
+}
+
+// loadFreeVolumes load the free volumes in disks.
+func (s *Store) loadFreeVolumes() {
+	var (
+		err          error
+		n            int
+		bfile, ifile string
+		bfiles       []string
+		d            *Disk
+		v            *Volume
+	)
+	for _, d = range s.disks {
+		if bfiles, err = d.FreeVolumes(); err != nil {
+			continue
+		}
+		for _, bfile = range bfiles {
+			if n = freeVolumeId(bfile); n > s.freeId {
+				s.freeId = n
+			}
+			ifile = bfile + diskIndexExt
+			if v, err = s.newVolume(0, bfile, ifile); err != nil {
+				log.Warningf("fail recovery free volume file: %s, index: %s", bfile, ifile)
+				continue
+			}
+			s.free = append(s.free, v)
+		}
+	}
+}
+
+// fillFreeVolumes create free volumes until reach the configured number.
+func (s *Store) fillFreeVolumes() {
+	var (
+		err          error
+		n            int
+		bfile, ifile string
+		d            *Disk
+		v            *Volume
+	)
+	s.fillLock.Lock()
+	defer s.fillLock.Unlock()
+	for {
+		s.flock.Lock()
+		if len(s.free) >= s.freeNum {
+			s.flock.Unlock()
+			break
+		}
+		s.freeId++
+		n = s.freeId
+		s.flock.Unlock()
+		if d, err = s.pickDisk(); err != nil {
+			log.Errorf("create free volume error(%v)", err)
+			break
+		}
+		bfile, ifile = d.FreeVolumeFile(n)
+		if v, err = s.newVolume(0, bfile, ifile); err != nil {
+			log.Errorf("create free volume: %s error(%v)", bfile, err)
+			break
+		}
+		s.flock.Lock()
+		s.free = append(s.free, v)
+		s.flock.Unlock()
+	}
+}
+
+// claimFreeVolume claim a free volume on the disk, nil if not exists.
+func (s *Store) claimFreeVolume(d *Disk) (v *Volume) {
+	var i int
+	s.flock.Lock()
+	for i, v = range s.free {
+		if v.disk == d {
+			s.free = append(s.free[:i], s.free[i+1:]...)
+			s.flock.Unlock()
+			return
+		}
+	}
+	s.flock.Unlock()
+	return nil
+}
+
+// FreeVolumes get the free volumes number.
+func (s *Store) FreeVolumes() (n int) {
+	s.flock.Lock()
+	n = len(s.free)
+	s.flock.Unlock()
+	return
+}
+
+// pickDisk pick a disk for new volume, skip the failed disks.
+func (s *Store) pickDisk() (d *Disk, err error) {
+	var (
+		dt        *Disk
+		free, max uint64
+		num, mnum int
+		counts    = s.diskVolumes()
+	)
+	for _, dt = range s.disks {
+		if dt.Error() != nil {
+			continue
+		}
+		if free, err = dt.Free(); err != nil {
+			dt.Fail(err)
+			continue
+		}
+		num = counts[dt]
+		if d == nil || free > max || (free == max && num < mnum) {
+			d, max, mnum = dt, free, num
+		}
+	}
+	if d == nil {
+		err = ErrStoreNoDisk
+		return
+	}
+	err = nil
+	return
+}
+
+// diskVolumes count the volumes on every disk.
+func (s *Store) diskVolumes() (counts map[*Disk]int) {
+	var v *Volume
+	counts = make(map[*Disk]int, len(s.disks))
+	for _, v = range s.Volumes() {
+		if v.disk != nil {
+			counts[v.disk]++
+		}
+	}
+	return
+}
+
+// Disks get all the disks state.
+func (s *Store) Disks() (stats []*DiskStat) {
+	var (
+		err    error
+		d      *Disk
+		st     *DiskStat
+		counts = s.diskVolumes()
+	)
+	for _, d = range s.disks {
+		st = &DiskStat{Path: d.Path, Volumes: counts[d]}
+		if st.Free, err = d.Free(); err != nil {
+			d.Fail(err)
+		}
+		if err = d.Error(); err != nil {
+			st.Error = err.Error()
+		}
+		stats = append(stats, st)
+	}
+	return
+}
+
 // DelVolume del the volume by volume id.
 func (s *Store) DelVolume(id int32) {
 	var v = s.Volume(id)
@@ -225,13 +494,33 @@ func (s *Store) DelVolume(id int32) {
 
 // Volume get a volume by volume id.
 func (s *Store) Volume(id int32) *Volume {
-	return s.volumes[id]
+	return s.Volumes()[id]
+}
+
+// RefVolume get a volume by volume id and hold it, the caller must Unref it.
+func (s *Store) RefVolume(id int32) (v *Volume) {
+	// the released volume is already replaced in the snapshot
+	for {
+		if v = s.Volume(id); v == nil || v.Ref() {
+			return
+		}
+	}
+}
+
+// Volumes get the current volumes, the map is a read only snapshot.
+func (s *Store) Volumes() map[int32]*Volume {
+	return s.volumes.Load().(map[int32]*Volume)
+}
+
+// EcVolume get a erasure code volume by volume id.
+func (s *Store) EcVolume(id int32) *EcVolume {
+	return s.erasure[id]
 }
 
 // Bulk copy a super block from another store server replace this server.
 func (s *Store) Bulk(id int32, bfile, ifile string) (err error) {
 	var v *Volume
-	if v, err = NewVolume(id, bfile, ifile); err != nil {
+	if v, err = s.newVolume(id, bfile, ifile); err != nil {
 		return
 	}
 	v.Command = storeUpdate
@@ -243,13 +532,14 @@ func (s *Store) Bulk(id int32, bfile, ifile string) (err error) {
 func (s *Store) Compress(id int32, bfile, ifile string) (err error) {
 	var (
 		nv *Volume
-		v  = s.Volume(id)
+		v  = s.RefVolume(id)
 	)
 	if v == nil {
 		err = ErrVolumeNotExist
 		return
 	}
-	if nv, err = NewVolume(id, bfile, ifile); err != nil {
+	defer v.Unref()
+	if nv, err = s.newVolume(id, bfile, ifile); err != nil {
 		return
 	}
 	// set volume compress flag
@@ -270,6 +560,7 @@ func (s *Store) Buffer() (d []byte) {
 		d = v.([]byte)
 		return
 	}
+	metricStoreBufferMiss.Inc()
 	return make([]byte, NeedleMaxSize)
 }
 
@@ -287,8 +578,17 @@ func (s *Store) Close() {
 		s.f.Close()
 	}
 	close(s.ch)
-	for _, v = range s.volumes {
+	for _, v = range s.Volumes() {
+		v.Unref()
+	}
+	for _, ev := range s.erasure {
+		ev.Close()
+	}
+	s.flock.Lock()
+	for _, v = range s.free {
 		v.Close()
 	}
+	s.free = s.free[:0]
+	s.flock.Unlock()
 	return
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	log "github.com/golang/glog"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -11,7 +12,7 @@ import (
 func TestStore(t *testing.T) {
 	var (
 		s      *Store
-		v      *Volume
+		v, ov  *Volume
 		err    error
 		buf    []byte
 		data   = []byte("test")
@@ -31,7 +32,7 @@ func TestStore(t *testing.T) {
 	defer os.Remove(b3file)
 	defer os.Remove(i3file)
 	t.Log("NewStore()")
-	if s, err = NewStore(file); err != nil {
+	if s, err = NewStore(&Config{Index: file}); err != nil {
 		t.Errorf("NewStore() error(%v)", err)
 		goto failed
 
@@ -82,13 +83,32 @@ func TestStore(t *testing.T) {
 		goto failed
 	}
 	t.Log("Compress(1)")
+	// the replaced volume is still readable until released
+	if ov = s.RefVolume(1); ov == nil {
+		err = fmt.Errorf("RefVolume(1) not exist")
+		t.Error(err)
+		goto failed
+	}
 	if err = s.Compress(1, b3file, i3file); err != nil {
+		ov.Unref()
 		t.Errorf("Compress(1) error(%v)", err)
 		goto failed
 	}
 	time.Sleep(2 * time.Second)
-	if v = s.Volume(1); v == nil {
-		err = fmt.Errorf("Volume(1) not exist")
+	if v = s.Volume(1); v == nil || v == ov {
+		ov.Unref()
+		err = fmt.Errorf("Volume(1) not replaced")
+		t.Error(err)
+		goto failed
+	}
+	_, err = ov.Get(1, 1, buf)
+	ov.Unref()
+	if err != nil {
+		t.Errorf("replaced v.Get(1) error(%v)", err)
+		goto failed
+	}
+	if ov.Ref() || atomic.LoadInt32(&ov.delExit) != 1 {
+		err = fmt.Errorf("replaced volume not closed by the last Unref")
 		t.Error(err)
 		goto failed
 	}
@@ -3,9 +3,12 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/cipher"
 	log "github.com/golang/glog"
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -20,38 +23,65 @@ const (
 	superBlockMagicOffset   = 0
 	superBlockVerOffset     = superBlockMagicOffset + superBlockVerSize
 	superBlockPaddingOffset = superBlockVerOffset + superBlockPaddingSize
+	// the needle checksum type, the first padding byte, zero is koopman
+	superBlockChecksumOffset = superBlockMagicSize + superBlockVerSize
+	// the encryption key id (uint16), the last padding bytes, zero is plain
+	superBlockKeyOffset = superBlockChecksumOffset + 1
 	// ver
 	superBlockVer1 = byte(1)
 	// limits
 	// 32GB, offset aligned 8 bytes, 4GB * 8
 	superBlockMaxSize   = 4 * 1024 * 1024 * 1024 * 8
 	superBlockMaxOffset = 4294967295
+	// the mapping grows by 256MB
+	superBlockMmapSize = 256 * 1024 * 1024
 )
 
 var (
-	superBlockMagic   = []byte{0xab, 0xcd, 0xef, 0x00}
-	superBlockVer     = []byte{superBlockVer1}
-	superBlockPadding = []byte{0x00, 0x00, 0x00}
+	superBlockMagic = []byte{0xab, 0xcd, 0xef, 0x00}
+	superBlockVer   = []byte{superBlockVer1}
 )
 
 // An Volume contains one superblock and many needles.
 type SuperBlock struct {
-	r      *os.File
-	w      *os.File
-	bw     *bufio.Writer
-	File   string
-	offset uint32
-	buf    []byte
+	r       *os.File
+	w       *os.File
+	bw      *bufio.Writer
+	File    string
+	offset  uint32 // written with the volume lock, read atomically by Offset
+	buf     []byte
+	options *VolumeOptions
+	// mmap, the old mappings are kept until close, the data returned may
+	// be still used, the referenced mappings are unmapped by the last Unref
+	mlock   sync.RWMutex
+	mdata   []byte
+	mmaps   [][]byte
+	mrefs   int
+	mclosed bool
+	// page cache
+	drop pageDropper
+	// encryption
+	klock sync.Mutex
+	aeads map[uint16]cipher.AEAD
 	// meta
-	Magic []byte
-	Ver   byte
+	Magic    []byte
+	Ver      byte
+	Checksum NeedleChecksum
+	KeyId    uint16
 }
 
-// NewSuperBlock new a super block struct.
-func NewSuperBlock(file string) (b *SuperBlock, err error) {
+// NewSuperBlock new a super block struct, if o is nil use the default
+// options.
+func NewSuperBlock(file string, o *VolumeOptions) (b *SuperBlock, err error) {
+	if o == nil {
+		o = &VolumeOptions{}
+	}
 	b = &SuperBlock{}
 	b.File = file
+	b.options = o
+	b.drop.size = o.DropCache
 	b.buf = make([]byte, NeedleMaxSize)
+	b.aeads = make(map[uint16]cipher.AEAD)
 	if b.w, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE, 0664); err != nil {
 		log.Errorf("os.OpenFile(\"%s\", os.O_WRONLY|os.O_CREATE, 0664) error(%v)", file, err)
 		return
@@ -95,24 +125,33 @@ func (b *SuperBlock) init() (err error) {
 		if _, err = b.w.Write(superBlockVer); err != nil {
 			return
 		}
-		// padding
-		if _, err = b.w.Write(superBlockPadding); err != nil {
+		// checksum
+		if b.Checksum, err = ParseNeedleChecksum(b.options.Checksum); err != nil {
 			return
 		}
-	} else {
-		if _, err = b.r.Read(b.buf[:superBlockHeaderSize]); err != nil {
+		if _, err = b.w.Write([]byte{byte(b.Checksum)}); err != nil {
+			return
+		}
+		// key id
+		if b.options.Encrypt {
+			if b.options.Keys == nil || b.options.Keys.Current() == cryptNoKey {
+				err = ErrSuperBlockKey
+				return
+			}
+			b.KeyId = b.options.Keys.Current()
+		}
+		BigEndian.PutUint16(b.buf, b.KeyId)
+		if _, err = b.w.Write(b.buf[:2]); err != nil {
+			return
+		}
+		if err = b.prealloc(); err != nil {
 			return
 		}
-		// parse block meta data
-		// check magic
-		b.Magic = b.buf[superBlockMagicOffset : superBlockMagicOffset+superBlockMagicSize]
-		b.Ver = byte(b.buf[superBlockVerOffset : superBlockVerOffset+superBlockVerSize][0])
-		if !bytes.Equal(b.Magic, superBlockMagic) {
-			err = ErrSuperBlockMagic
+	} else {
+		if _, err = b.r.Read(b.buf[:superBlockHeaderSize]); err != nil {
 			return
 		}
-		if b.Ver == superBlockVer1 {
-			err = ErrSuperBlockVer
+		if err = b.parseHeader(b.buf[:superBlockHeaderSize]); err != nil {
 			return
 		}
 		if _, err = b.w.Seek(superBlockHeaderOffset, os.SEEK_SET); err != nil {
@@ -120,12 +159,51 @@ func (b *SuperBlock) init() (err error) {
 			return
 		}
 	}
-	b.offset = NeedleOffset(superBlockHeaderOffset)
+	atomic.StoreUint32(&b.offset, NeedleOffset(superBlockHeaderOffset))
+	return
+}
+
+// parseHeader parse the block meta data of header.
+func (b *SuperBlock) parseHeader(buf []byte) (err error) {
+	// check magic
+	b.Magic = buf[superBlockMagicOffset : superBlockMagicOffset+superBlockMagicSize]
+	b.Ver = byte(buf[superBlockVerOffset : superBlockVerOffset+superBlockVerSize][0])
+	if !bytes.Equal(b.Magic, superBlockMagic) {
+		err = ErrSuperBlockMagic
+		return
+	}
+	if b.Ver == superBlockVer1 {
+		err = ErrSuperBlockVer
+		return
+	}
+	if b.Checksum = NeedleChecksum(buf[superBlockChecksumOffset]); !b.Checksum.Valid() {
+		err = ErrSuperBlockCrc
+		return
+	}
+	// check the key exists
+	if b.KeyId = BigEndian.Uint16(buf[superBlockKeyOffset:]); b.KeyId != cryptNoKey {
+		_, err = b.aead(b.KeyId)
+	}
+	return
+}
+
+// prealloc preallocate the block file, the tail of file is zero filled.
+func (b *SuperBlock) prealloc() (err error) {
+	var size = b.options.Prealloc
+	if size <= superBlockHeaderSize {
+		return
+	}
+	if size > superBlockMaxSize {
+		size = superBlockMaxSize
+	}
+	if err = fallocate(b.w, superBlockHeaderSize, size-superBlockHeaderSize); err != nil {
+		log.Errorf("block: %s fallocate(%d) error(%v)", b.File, size, err)
+	}
 	return
 }
 
 // Add append a photo to the block.
-func (b *SuperBlock) Add(key, cookie int64, data []byte) (offset uint32, size int32, err error) {
+func (b *SuperBlock) Add(key, cookie int64, e NeedleEncoding, data []byte) (offset uint32, size int32, err error) {
 	var (
 		padding    int32
 		incrOffset uint32
@@ -139,20 +217,20 @@ func (b *SuperBlock) Add(key, cookie int64, data []byte) (offset uint32, size in
 		err = ErrSuperBlockNoSpace
 		return
 	}
-	if err = WriteNeedle(b.bw, padding, dataSize, key, cookie, data); err != nil {
+	if err = WriteNeedle(b.bw, padding, dataSize, key, cookie, e, data, b.Checksum); err != nil {
 		return
 	}
 	if err = b.Flush(); err != nil {
 		return
 	}
 	offset = b.offset
-	b.offset += incrOffset
+	atomic.StoreUint32(&b.offset, offset+incrOffset)
 	log.V(1).Infof("add a needle, key: %d, cookie: %d, offset: %d, size: %d, b.offset: %d", key, cookie, offset, size, b.offset)
 	return
 }
 
 // Write start add needles to the block, must called after start a transaction.
-func (b *SuperBlock) Write(key, cookie int64, data []byte) (offset uint32, size int32, err error) {
+func (b *SuperBlock) Write(key, cookie int64, e NeedleEncoding, data []byte) (offset uint32, size int32, err error) {
 	var (
 		padding    int32
 		incrOffset uint32
@@ -166,11 +244,11 @@ func (b *SuperBlock) Write(key, cookie int64, data []byte) (offset uint32, size
 		err = ErrSuperBlockNoSpace
 		return
 	}
-	if err = WriteNeedle(b.bw, padding, dataSize, key, cookie, data); err != nil {
+	if err = WriteNeedle(b.bw, padding, dataSize, key, cookie, e, data, b.Checksum); err != nil {
 		return
 	}
 	offset = b.offset
-	b.offset += incrOffset
+	atomic.StoreUint32(&b.offset, offset+incrOffset)
 	return
 }
 
@@ -184,16 +262,28 @@ func (b *SuperBlock) Flush() (err error) {
 		} else if err == io.ErrShortWrite {
 			continue
 		}
-		// TODO append N times call flush then clean the os page cache
-		// page cache no used here...
-		// after upload a photo, we cache in user-level.
 		break
 	}
+	// drop the uploaded pages, the hot photos are cached in user-level
+	b.drop.advise(b.w, b.File, BlockOffset(b.offset))
+	return
+}
+
+// Sync fsync the block file.
+func (b *SuperBlock) Sync() (err error) {
+	if err = b.w.Sync(); err != nil {
+		log.Errorf("block: %s Sync() error(%v)", b.File, err)
+	}
 	return
 }
 
+// Offset get the current needle offset without the volume lock.
+func (b *SuperBlock) Offset() uint32 {
+	return atomic.LoadUint32(&b.offset)
+}
+
 // Repair repair the specified offset needle without update current offset.
-func (b *SuperBlock) Repair(key, cookie int64, data []byte, offset uint32) (err error) {
+func (b *SuperBlock) Repair(key, cookie int64, e NeedleEncoding, data []byte, offset uint32) (err error) {
 	var (
 		size     int32
 		padding  int32
@@ -202,7 +292,7 @@ func (b *SuperBlock) Repair(key, cookie int64, data []byte, offset uint32) (err
 	if padding, size, err = NeedleSize(dataSize); err != nil {
 		return
 	}
-	FillNeedle(padding, dataSize, key, cookie, data, b.buf)
+	FillNeedle(padding, dataSize, key, cookie, e, data, b.buf, b.Checksum)
 	_, err = b.w.WriteAt(b.buf[:size], BlockOffset(offset))
 	return
 }
@@ -213,6 +303,120 @@ func (b *SuperBlock) Get(offset uint32, buf []byte) (err error) {
 	return
 }
 
+// Mmap get a needle from the read only mapping of super block, the data is
+// valid until the super block closed, or the last Unref if it's referenced,
+// the caller must recover the fault of reading a truncated file, see
+// mmapFault.
+func (b *SuperBlock) Mmap(offset uint32, size int32) (data []byte, err error) {
+	var (
+		start = BlockOffset(offset)
+		end   = start + int64(size)
+	)
+	b.mlock.RLock()
+	if end <= int64(len(b.mdata)) {
+		data = b.mdata[start:end]
+	}
+	b.mlock.RUnlock()
+	if data == nil {
+		b.mlock.Lock()
+		if err = b.remap(end); err == nil {
+			data = b.mdata[start:end]
+		}
+		b.mlock.Unlock()
+	}
+	return
+}
+
+// remap map the file again if the mapping is less than end, must called
+// with mlock.
+func (b *SuperBlock) remap(end int64) (err error) {
+	var (
+		size int64
+		data []byte
+		stat os.FileInfo
+	)
+	if end <= int64(len(b.mdata)) {
+		return
+	}
+	if stat, err = b.r.Stat(); err != nil {
+		log.Errorf("block: %s Stat() error(%v)", b.File, err)
+		return
+	}
+	if stat.Size() < end {
+		err = &os.PathError{Op: "mmap", Path: b.File, Err: ErrSuperBlockFault}
+		return
+	}
+	// map beyond the file size, the appended needles need not remap
+	if size = (stat.Size()/superBlockMmapSize + 1) * superBlockMmapSize; size > superBlockMaxSize {
+		size = superBlockMaxSize
+	}
+	if data, err = mmap(b.r, int(size)); err != nil {
+		log.Errorf("block: %s mmap(%d) error(%v)", b.File, size, err)
+		return
+	}
+	if b.mdata != nil {
+		b.mmaps = append(b.mmaps, b.mdata)
+	}
+	b.mdata = data
+	log.V(1).Infof("block: %s mmap size: %d", b.File, size)
+	return
+}
+
+// Ref reference the mappings, so the data returned by Mmap is still valid
+// after the super block closed until Unref.
+func (b *SuperBlock) Ref() {
+	b.mlock.Lock()
+	b.mrefs++
+	b.mlock.Unlock()
+}
+
+// Unref release a reference of the mappings, they are unmapped if the super
+// block closed and no reference left.
+func (b *SuperBlock) Unref() {
+	b.mlock.Lock()
+	if b.mrefs--; b.mrefs == 0 && b.mclosed {
+		b.release()
+	}
+	b.mlock.Unlock()
+}
+
+// unmap unmap all the mappings when the super block closed, it's delayed
+// until the last reference released.
+func (b *SuperBlock) unmap() {
+	b.mlock.Lock()
+	if b.mclosed = true; b.mrefs == 0 {
+		b.release()
+	}
+	b.mlock.Unlock()
+}
+
+// release unmap all the mappings, must called with mlock.
+func (b *SuperBlock) release() {
+	var err error
+	if b.mdata != nil {
+		b.mmaps = append(b.mmaps, b.mdata)
+	}
+	for _, data := range b.mmaps {
+		if err = munmap(data); err != nil {
+			log.Errorf("block: %s munmap() error(%v)", b.File, err)
+		}
+	}
+	b.mdata, b.mmaps = nil, nil
+}
+
+// mmapFault get the error of a recovered mapping fault, the reader must call
+// debug.SetPanicOnFault(true), so a truncated file raises a panic instead of
+// crash by SIGBUS, other panics are raised again.
+func mmapFault(file string, r interface{}) error {
+	if _, ok := r.(interface {
+		Addr() uintptr
+	}); !ok {
+		panic(r)
+	}
+	log.Errorf("block: %s mapping fault(%v)", file, r)
+	return &os.PathError{Op: "mmap", Path: file, Err: ErrSuperBlockFault}
+}
+
 // Del logical del a needls, only update the flag to it.
 func (b *SuperBlock) Del(offset uint32) (err error) {
 	// WriteAt won't update the file offset.
@@ -220,8 +424,20 @@ func (b *SuperBlock) Del(offset uint32) (err error) {
 	return
 }
 
+// Undel clear the del flag of the needle at offset.
+func (b *SuperBlock) Undel(offset uint32) (err error) {
+	_, err = b.w.WriteAt(NeedleStatusOKBytes, BlockOffset(offset)+NeedleFlagOffset)
+	return
+}
+
 // Recovery recovery needles map from super block.
-func (b *SuperBlock) Recovery(needles map[int64]NeedleCache, indexer *Indexer, offset int64) (err error) {
+func (b *SuperBlock) Recovery(needles NeedleMap, indexer *Indexer, offset int64) (err error) {
+	return b.recovery(needles, indexer, offset, nil)
+}
+
+// recovery recovery needles map from super block, fn is called with every
+// needle not deleted.
+func (b *SuperBlock) recovery(needles NeedleMap, indexer *Indexer, offset int64, fn func(key int64, offset uint32, size int32)) (err error) {
 	var (
 		size    int32
 		data    []byte
@@ -245,7 +461,13 @@ func (b *SuperBlock) Recovery(needles map[int64]NeedleCache, indexer *Indexer, o
 		if data, err = rd.Peek(NeedleHeaderSize); err != nil {
 			break
 		}
+		// preallocated tail
+		if isZero(data) {
+			err = io.EOF
+			break
+		}
 		if err = n.ParseHeader(data); err != nil {
+			log.Warningf("block: %s recovery offset: %d parse error(%v), discard the left space", b.File, noffset, err)
 			break
 		}
 		if _, err = rd.Discard(NeedleHeaderSize); err != nil {
@@ -255,7 +477,7 @@ func (b *SuperBlock) Recovery(needles map[int64]NeedleCache, indexer *Indexer, o
 		if data, err = rd.Peek(n.DataSize); err != nil {
 			break
 		}
-		if err = n.ParseData(data); err != nil {
+		if err = n.ParseData(data, b.Checksum); err != nil {
 			break
 		}
 		if _, err = rd.Discard(n.DataSize); err != nil {
@@ -266,11 +488,14 @@ func (b *SuperBlock) Recovery(needles map[int64]NeedleCache, indexer *Indexer, o
 			if err = indexer.Add(n.Key, noffset, size); err != nil {
 				break
 			}
+			if fn != nil {
+				fn(n.Key, noffset, size)
+			}
 			nc = NewNeedleCache(noffset, size)
 		} else {
 			nc = NewNeedleCache(NeedleCacheDelOffset, size)
 		}
-		needles[n.Key] = nc
+		needles.Set(n.Key, nc)
 		log.V(1).Infof("block add offset: %d, size: %d to needles cache", noffset, size)
 		log.V(1).Info(n.String())
 		noffset += NeedleOffset(int64(size))
@@ -281,17 +506,29 @@ func (b *SuperBlock) Recovery(needles map[int64]NeedleCache, indexer *Indexer, o
 	// reset b.w offset, discard left space which can't parse to a needle
 	if _, err = b.w.Seek(BlockOffset(noffset), os.SEEK_SET); err != nil {
 		log.Errorf("block: %s Seek() error(%v)", b.File, err)
+		return
 	}
+	atomic.StoreUint32(&b.offset, noffset)
 	return
 }
 
 // Compress compress the orig block, copy to disk dst block.
 func (b *SuperBlock) Compress(offset int64, v *Volume) (noffset int64, err error) {
+	return b.compress(offset, v, func(n *Needle, _ uint32) error {
+		// skip delete needle
+		return v.compressWrite(n, b.KeyId, n.Flag != NeedleStatusDel, 0, needleVersion{})
+	})
+}
+
+// compress call fn with every needle from offset of the orig block, then
+// flush the dst block.
+func (b *SuperBlock) compress(offset int64, v *Volume, fn func(n *Needle, offset uint32) error) (noffset int64, err error) {
 	var (
 		data []byte
 		r    *os.File
 		rd   *bufio.Reader
 		n    = &Needle{}
+		o    uint32
 	)
 	log.Infof("block: %s compress", b.File)
 	if r, err = os.OpenFile(b.File, os.O_RDONLY, 0664); err != nil {
@@ -311,6 +548,11 @@ func (b *SuperBlock) Compress(offset int64, v *Volume) (noffset int64, err error
 		if data, err = rd.Peek(NeedleHeaderSize); err != nil {
 			break
 		}
+		// preallocated tail
+		if isZero(data) {
+			err = io.EOF
+			break
+		}
 		if err = n.ParseHeader(data); err != nil {
 			break
 		}
@@ -321,20 +563,16 @@ func (b *SuperBlock) Compress(offset int64, v *Volume) (noffset int64, err error
 		if data, err = rd.Peek(n.DataSize); err != nil {
 			break
 		}
-		if err = n.ParseData(data); err != nil {
+		if err = n.ParseData(data, b.Checksum); err != nil {
 			break
 		}
 		if _, err = rd.Discard(n.DataSize); err != nil {
 			break
 		}
+		o = NeedleOffset(offset)
 		offset += int64(NeedleHeaderSize + n.DataSize)
 		log.V(1).Info(n.String())
-		// skip delete needle
-		if n.Flag == NeedleStatusDel {
-			continue
-		}
-		// multi append
-		if err = v.Write(n.Key, n.Cookie, n.Data); err != nil {
+		if err = fn(n, o); err != nil {
 			break
 		}
 	}
@@ -353,6 +591,7 @@ func (b *SuperBlock) Compress(offset int64, v *Volume) (noffset int64, err error
 
 func (b *SuperBlock) Close() {
 	var err error
+	b.unmap()
 	if err = b.Flush(); err != nil {
 		log.Errorf("block: %s flush error(%v)", b.File, err)
 	}
@@ -368,6 +607,16 @@ func (b *SuperBlock) Close() {
 	return
 }
 
+// isZero check the buffer is all zero.
+func isZero(buf []byte) bool {
+	for _, c := range buf {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 // BlockOffset get super block file offset.
 func BlockOffset(offset uint32) int64 {
 	return int64(offset) * NeedlePaddingSize
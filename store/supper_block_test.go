@@ -12,7 +12,8 @@ func compareTestNeedle(t *testing.T, key, cookie int64, flag byte, n *Needle, da
 		t.Errorf("ParseNeedleHeader() error(%v)", err)
 		return
 	}
-	if err = n.ParseData(buf[NeedleHeaderSize:]); err != nil {
+	// the default checksum of new blocks
+	if err = n.ParseData(buf[NeedleHeaderSize:], NeedleChecksumCastagnoli); err != nil {
 		err = fmt.Errorf("ParseNeedleData() error(%v)", err)
 		t.Error(err)
 		return
@@ -52,7 +53,7 @@ func TestSuperBlock(t *testing.T) {
 		size    int32
 		offset  uint32
 		n       = &Needle{}
-		needles = make(map[int64]NeedleCache)
+		needles = make(HashNeedleMap)
 		data    = []byte("test")
 		file    = "./test/test.block"
 		bfile   = "./test/test.block.compress"
@@ -63,7 +64,7 @@ func TestSuperBlock(t *testing.T) {
 	defer os.Remove(file)
 	// test new block file
 	t.Log("NewSuperBlock() create a new file")
-	b, err := NewSuperBlock(file)
+	b, err := NewSuperBlock(file, nil)
 	if err != nil {
 		t.Errorf("NewSuperBlock(\"%s\") error(%v)", file, err)
 		goto failed
@@ -71,7 +72,7 @@ func TestSuperBlock(t *testing.T) {
 	b.Close()
 	// test parse block file
 	t.Log("NewSuperBlock() create a new file")
-	b, err = NewSuperBlock(file)
+	b, err = NewSuperBlock(file, nil)
 	if err != nil {
 		t.Errorf("NewSuperBlock(\"%s\") error(%v)", file, err)
 		goto failed
@@ -87,7 +88,7 @@ func TestSuperBlock(t *testing.T) {
 	}
 	// test add
 	t.Log("Add(1)")
-	if offset, size, err = b.Add(1, 1, data); err != nil {
+	if offset, size, err = b.Add(1, 1, NeedleEncodingNone, data); err != nil {
 		t.Errorf("b.Add() error(%v)", err)
 		goto failed
 	}
@@ -127,7 +128,7 @@ func TestSuperBlock(t *testing.T) {
 	}
 	// test add
 	t.Log("Add(2)")
-	if offset, size, err = b.Add(2, 2, data); err != nil {
+	if offset, size, err = b.Add(2, 2, NeedleEncodingNone, data); err != nil {
 		t.Errorf("b.Add() error(%v)", err)
 		goto failed
 	}
@@ -165,7 +166,7 @@ func TestSuperBlock(t *testing.T) {
 	}
 	// test write
 	t.Log("Write(3)")
-	if offset, size, err = b.Write(3, 3, data); err != nil {
+	if offset, size, err = b.Write(3, 3, NeedleEncodingNone, data); err != nil {
 		t.Errorf("b.Add() error(%v)", err)
 		goto failed
 	}
@@ -185,7 +186,7 @@ func TestSuperBlock(t *testing.T) {
 	}
 	// test write
 	t.Log("Write(4)")
-	if offset, size, err = b.Write(4, 4, data); err != nil {
+	if offset, size, err = b.Write(4, 4, NeedleEncodingNone, data); err != nil {
 		t.Errorf("b.Add() error(%v)", err)
 		goto failed
 	}
@@ -325,7 +326,7 @@ func TestSuperBlock(t *testing.T) {
 	}
 	// test repair
 	t.Log("Repair(3)")
-	if err = b.Repair(3, 3, data, 11); err != nil {
+	if err = b.Repair(3, 3, NeedleEncodingNone, data, 11); err != nil {
 		t.Errorf("b.Repair(3) error(%v)", err)
 		goto failed
 	}
@@ -341,7 +342,7 @@ func TestSuperBlock(t *testing.T) {
 	t.Log("Compress")
 	defer os.Remove(bfile)
 	defer os.Remove(bifile)
-	if v, err = NewVolume(1, bfile, bifile); err != nil {
+	if v, err = NewVolume(1, bfile, bifile, nil); err != nil {
 		t.Errorf("NewVolume(1) error(%v)", err)
 		goto failed
 	}
@@ -360,19 +361,19 @@ func TestSuperBlock(t *testing.T) {
 			}
 		}
 	}
-	if o, s := v.needles[1].Value(); o != 0 && s != 0 {
+	if o, s := v.needleValue(1); o != 0 && s != 0 {
 		t.Error("needle.Value(1) not match")
 		goto failed
 	}
-	if o, s := v.needles[2].Value(); o != 6 && s != 40 {
+	if o, s := v.needleValue(2); o != 6 && s != 40 {
 		t.Error("needle.Value(2) not match")
 		goto failed
 	}
-	if o, s := v.needles[3].Value(); o != 11 && s != 40 {
+	if o, s := v.needleValue(3); o != 11 && s != 40 {
 		t.Error("needle.Value(3) not match")
 		goto failed
 	}
-	if o, s := v.needles[4].Value(); o != 16 && s != 40 {
+	if o, s := v.needleValue(4); o != 16 && s != 40 {
 		t.Error("needle.Value(4) not match")
 		goto failed
 	}
@@ -388,3 +389,318 @@ failed:
 		t.FailNow()
 	}
 }
+
+func TestSuperBlockPrealloc(t *testing.T) {
+	var (
+		v      *Volume
+		b      *SuperBlock
+		err    error
+		stat   os.FileInfo
+		buf    = make([]byte, 40)
+		data   = []byte("test")
+		file   = "./test/test.prealloc"
+		ifile  = "./test/test.prealloc.idx"
+		nbfile = "./test/test.prealloc.compress"
+		nifile = "./test/test.prealloc.compress.idx"
+		o      = &VolumeOptions{Prealloc: 1024 * 1024}
+	)
+	defer os.Remove(file)
+	defer os.Remove(ifile)
+	defer os.Remove(nbfile)
+	defer os.Remove(nifile)
+	t.Log("NewSuperBlock() prealloc")
+	if b, err = NewSuperBlock(file, o); err != nil {
+		t.Errorf("NewSuperBlock(\"%s\") error(%v)", file, err)
+		goto failed
+	}
+	if _, _, err = b.Add(1, 1, NeedleEncodingNone, data); err != nil {
+		t.Errorf("b.Add() error(%v)", err)
+		goto failed
+	}
+	if _, _, err = b.Add(2, 2, NeedleEncodingNone, data); err != nil {
+		t.Errorf("b.Add() error(%v)", err)
+		goto failed
+	}
+	b.Close()
+	b = nil
+	if stat, err = os.Stat(file); err != nil {
+		t.Errorf("os.Stat() error(%v)", err)
+		goto failed
+	}
+	if stat.Size() != o.Prealloc {
+		err = fmt.Errorf("block size: %d not match", stat.Size())
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Recovery zero tail")
+	if v, err = NewVolume(1, file, ifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if v.block.offset != 11 {
+		err = fmt.Errorf("b.offset: %d not match", v.block.offset)
+		t.Error(err)
+		goto failed
+	}
+	if _, err = v.Get(2, 2, buf); err != nil {
+		t.Errorf("Get(2) error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(3, 3, data); err != nil {
+		t.Errorf("Add(3) error(%v)", err)
+		goto failed
+	}
+	if _, err = v.Get(3, 3, buf); err != nil {
+		t.Errorf("Get(3) error(%v)", err)
+		goto failed
+	}
+	t.Log("Compress zero tail")
+	if b, err = NewSuperBlock(file, nil); err != nil {
+		t.Errorf("NewSuperBlock(\"%s\") error(%v)", file, err)
+		goto failed
+	}
+	v.Close()
+	if v, err = NewVolume(1, nbfile, nifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if _, err = b.Compress(0, v); err != nil {
+		t.Errorf("b.Compress() error(%v)", err)
+		goto failed
+	}
+	if _, err = v.Get(3, 3, buf); err != nil {
+		t.Errorf("Get(3) error(%v)", err)
+		goto failed
+	}
+failed:
+	if b != nil {
+		b.Close()
+	}
+	if v != nil {
+		v.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestSuperBlockChecksum(t *testing.T) {
+	var (
+		v      *Volume
+		b      *SuperBlock
+		f      *os.File
+		err    error
+		buf    = make([]byte, 40)
+		data   = []byte("test")
+		file   = "./test/test.checksum"
+		ifile  = "./test/test.checksum.idx"
+		nbfile = "./test/test.checksum.compress"
+		nifile = "./test/test.checksum.compress.idx"
+		o      = &VolumeOptions{Checksum: NeedleChecksumOptKoopman}
+	)
+	defer os.Remove(file)
+	defer os.Remove(ifile)
+	defer os.Remove(nbfile)
+	defer os.Remove(nifile)
+	t.Log("NewSuperBlock() koopman")
+	if b, err = NewSuperBlock(file, o); err != nil {
+		t.Errorf("NewSuperBlock(\"%s\") error(%v)", file, err)
+		goto failed
+	}
+	if _, _, err = b.Add(1, 1, NeedleEncodingNone, data); err != nil {
+		t.Errorf("b.Add() error(%v)", err)
+		goto failed
+	}
+	b.Close()
+	b = nil
+	t.Log("reopen koopman with default options")
+	if v, err = NewVolume(1, file, ifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if v.block.Checksum != NeedleChecksumKoopman {
+		err = fmt.Errorf("checksum: %d not koopman", v.block.Checksum)
+		t.Error(err)
+		goto failed
+	}
+	if err = v.Add(2, 2, data); err != nil {
+		t.Errorf("Add(2) error(%v)", err)
+		goto failed
+	}
+	if err = testVolumeKeys(v, buf, 2, 0); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	t.Log("compress into crc32c")
+	if b, err = NewSuperBlock(file, nil); err != nil {
+		t.Errorf("NewSuperBlock(\"%s\") error(%v)", file, err)
+		goto failed
+	}
+	v.Close()
+	if v, err = NewVolume(1, nbfile, nifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if _, err = b.Compress(0, v); err != nil {
+		t.Errorf("b.Compress() error(%v)", err)
+		goto failed
+	}
+	if v.block.Checksum != NeedleChecksumCastagnoli {
+		err = fmt.Errorf("checksum: %d not crc32c", v.block.Checksum)
+		t.Error(err)
+		goto failed
+	}
+	if err = testVolumeKeys(v, buf, 2, 0); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	b.Close()
+	b = nil
+	v.Close()
+	v = nil
+	t.Log("unknown checksum")
+	if f, err = os.OpenFile(file, os.O_WRONLY, 0664); err != nil {
+		t.Errorf("os.OpenFile() error(%v)", err)
+		goto failed
+	}
+	_, err = f.WriteAt([]byte{0xff}, superBlockChecksumOffset)
+	f.Close()
+	if err != nil {
+		t.Errorf("WriteAt() error(%v)", err)
+		goto failed
+	}
+	if _, err = NewSuperBlock(file, nil); err != ErrSuperBlockCrc {
+		err = fmt.Errorf("NewSuperBlock() error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	err = nil
+failed:
+	if b != nil {
+		b.Close()
+	}
+	if v != nil {
+		v.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestVolumeMmap(t *testing.T) {
+	var (
+		v     *Volume
+		err   error
+		data  []byte
+		pe    *os.PathError
+		buf   = make([]byte, 40)
+		ndata = bytes.Repeat([]byte("test"), 2048)
+		bfile = "./test/test.mmap"
+		ifile = "./test/test.mmap.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	if v, err = NewVolume(1, bfile, ifile, &VolumeOptions{Mmap: true}); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	for key := int64(1); key <= 2; key++ {
+		if err = v.Add(key, key, ndata); err != nil {
+			t.Errorf("Add() error(%v)", err)
+			goto failed
+		}
+		// the needle appended after mapped
+		if data, err = v.Get(key, key, buf); err != nil || !bytes.Equal(data, ndata) {
+			err = fmt.Errorf("Get(%d) error(%v)", key, err)
+			t.Error(err)
+			goto failed
+		}
+	}
+	if !isZero(buf) {
+		err = fmt.Errorf("Get() data copied into buffer")
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Ref")
+	v.Ref()
+	if data, err = v.Get(1, 1, buf); err != nil {
+		v.Unref()
+		t.Errorf("Get() error(%v)", err)
+		goto failed
+	}
+	// the referenced mapping is still valid after the volume closed
+	v.Close()
+	if !bytes.Equal(data, ndata) {
+		v.Unref()
+		v = nil
+		err = fmt.Errorf("Get() data not match after closed")
+		t.Error(err)
+		goto failed
+	}
+	if v.Unref(); v.block.mdata != nil || v.block.mmaps != nil {
+		v = nil
+		err = fmt.Errorf("mapping not unmapped by the last Unref")
+		t.Error(err)
+		goto failed
+	}
+	if v, err = NewVolume(1, bfile, ifile, &VolumeOptions{Mmap: true}); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	// the second needle is beyond the first page
+	t.Log("truncate")
+	if err = os.Truncate(bfile, superBlockHeaderSize); err != nil {
+		t.Errorf("os.Truncate() error(%v)", err)
+		goto failed
+	}
+	_, err = v.Get(2, 2, buf)
+	if pe, _ = err.(*os.PathError); pe == nil || pe.Err != ErrSuperBlockFault {
+		err = fmt.Errorf("Get() truncated error(%v)", err)
+		t.Error(err)
+		goto failed
+	}
+	if err = v.Health(); err == nil {
+		err = fmt.Errorf("Health() fault not reported")
+		t.Error(err)
+		goto failed
+	}
+	err = nil
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestPageDropper(t *testing.T) {
+	var (
+		err  error
+		d    = &pageDropper{size: 4096}
+		file = "./test/test.drop"
+		f    *os.File
+	)
+	defer os.Remove(file)
+	if f, err = os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0664); err != nil {
+		t.Errorf("os.OpenFile() error(%v)", err)
+		t.FailNow()
+	}
+	defer f.Close()
+	if _, err = f.Write(make([]byte, 3*4096)); err != nil {
+		t.Errorf("f.Write() error(%v)", err)
+		t.FailNow()
+	}
+	d.advise(f, file, 1024)
+	if d.start != 0 || d.last != 0 {
+		t.Errorf("advise before size: %d, %d", d.start, d.last)
+		t.FailNow()
+	}
+	d.advise(f, file, 4096)
+	d.advise(f, file, 2*4096+1)
+	// the last window is advised again
+	if d.start != 4096 || d.last != 2*4096+1 {
+		t.Errorf("advise window: %d, %d not match", d.start, d.last)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/golang/glog"
+	"strconv"
+	"time"
+)
+
+const (
+	// trace phases
+	tracePhaseLock = iota
+	tracePhaseIO
+	tracePhaseParse
+	tracePhaseIndex
+	tracePhaseFlush
+	tracePhaseSync
+	tracePhaseNum
+)
+
+var (
+	// slow op log threshold, 0 disable the slow log
+	slowOpTime       = 100 * time.Millisecond
+	tracePhaseLabels = [tracePhaseNum]string{"lock", "io", "parse", "index", "flush", "sync"}
+)
+
+// opTrace trace the phases timing of a volume operation.
+type opTrace struct {
+	vid    int32
+	op     string
+	key    int64
+	start  time.Time
+	last   time.Time
+	phases [tracePhaseNum]time.Duration
+}
+
+// newOpTrace new a trace, start timing.
+func newOpTrace(vid int32, op string, key int64) *opTrace {
+	var now = time.Now()
+	return &opTrace{vid: vid, op: op, key: key, start: now, last: now}
+}
+
+// mark add the elapsed time since last mark into the phase.
+func (t *opTrace) mark(phase int) {
+	var now = time.Now()
+	t.phases[phase] += now.Sub(t.last)
+	t.last = now
+}
+
+// done stat the operation and phases, log if the operation is slow.
+func (t *opTrace) done(err error) {
+	var (
+		i     int
+		vid   = strconv.FormatInt(int64(t.vid), 10)
+		total = time.Since(t.start)
+	)
+	statVolumeOp(t.vid, t.op, t.start, err)
+	for i = 0; i < tracePhaseNum; i++ {
+		if t.phases[i] > 0 {
+			metricVolumePhaseDuration.WithLabelValues(vid, t.op, tracePhaseLabels[i]).Observe(t.phases[i].Seconds())
+		}
+	}
+	if slowOpTime > 0 && total >= slowOpTime {
+		log.Warning(t.slowLog(total, err))
+	}
+}
+
+// slowLog format a structured slow op log entry.
+func (t *opTrace) slowLog(total time.Duration, err error) string {
+	var (
+		i   int
+		buf = &bytes.Buffer{}
+	)
+	fmt.Fprintf(buf, "slow op vid=%d op=%s key=%d total=%s", t.vid, t.op, t.key, total)
+	for i = 0; i < tracePhaseNum; i++ {
+		fmt.Fprintf(buf, " %s=%s", tracePhaseLabels[i], t.phases[i])
+	}
+	fmt.Fprintf(buf, " result=%s", errType(err))
+	return buf.String()
+}
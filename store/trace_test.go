@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpTrace(t *testing.T) {
+	var (
+		err error
+		s   string
+		tr  = newOpTrace(1, volumeOpGet, 10)
+	)
+	time.Sleep(10 * time.Millisecond)
+	tr.mark(tracePhaseLock)
+	tr.mark(tracePhaseIO)
+	if tr.phases[tracePhaseLock] < 10*time.Millisecond || tr.phases[tracePhaseIO] >= 10*time.Millisecond {
+		err = fmt.Errorf("phases: %v not match", tr.phases)
+		t.Error(err)
+		goto failed
+	}
+	s = tr.slowLog(time.Since(tr.start), ErrNoNeedle)
+	if !strings.HasPrefix(s, "slow op vid=1 op=get key=10 total=") || !strings.Contains(s, " lock=") || !strings.HasSuffix(s, " result=no_needle") {
+		err = fmt.Errorf("slowLog: %s not match", s)
+		t.Error(err)
+		goto failed
+	}
+	tr.done(nil)
+failed:
+	if err != nil {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	log "github.com/golang/glog"
+	"io"
+	"os"
+	"time"
+)
+
+// versioned volume keeps the last VolumeOptions.Versions old needles of a
+// overwritten key, every needle of the key is numbered from 1 in add order.
+// the versions are rebuilt from index and super block order when recovery,
+// the number and time of every version are kept in the version file next to
+// the index. a version recovered without record has zero time, it's unknown,
+// so it never expires and GetAt can't tell it current at any timestamp.
+//
+// version file format:
+//  ---------------
+// |     record    |           -------------------
+// |     record    |  ---->   |  key (int64)      |
+// |     ......    |          |  offset (uint32)  |
+//  ---------------           |  num (int32)      |
+//                            |  time (int64)     |
+//                             -------------------
+//                               int bigendian
+//
+// field     | explanation
+// ---------------------------------------------------------
+// key       | the needle key
+// offset    | the needle offset
+// num       | the version number
+// time      | the version time in unix nanoseconds, the last record of the
+//           | needle wins
+
+const (
+	versionRecordSize = 24
+	// record offset
+	versionOffsetOffset = 8
+	versionNumOffset    = 12
+	versionTimeOffset   = 16
+	// the version file suffix of index file
+	versionSuffix = ".version"
+)
+
+// needleVersion a version of a needle, the last one is the current needle.
+type needleVersion struct {
+	num    int32
+	offset uint32
+	size   int32
+	time   int64
+}
+
+// NeedleVersion the version info of a needle.
+type NeedleVersion struct {
+	Version int32
+	Time    time.Time
+	Size    int32
+	Deleted bool
+}
+
+// versionFile the version records of a volume, it's written with the volume
+// lock.
+type versionFile struct {
+	File string
+	f    *os.File
+	bw   *bufio.Writer
+	buf  [versionRecordSize]byte
+}
+
+// openVersionFile open the version file, set the number and time of the
+// recovered versions, the torn record of a crash is truncated.
+func openVersionFile(file string, versions map[int64][]needleVersion) (vf *versionFile, err error) {
+	var (
+		i      int
+		key    int64
+		size   int64
+		offset uint32
+		vs     []needleVersion
+		rd     *bufio.Reader
+		buf    = make([]byte, versionRecordSize)
+	)
+	vf = &versionFile{File: file}
+	if vf.f, err = os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0664); err != nil {
+		log.Errorf("os.OpenFile(\"%s\", os.O_RDWR|os.O_CREATE, 0664) error(%v)", file, err)
+		return
+	}
+	rd = bufio.NewReader(vf.f)
+	for {
+		if _, err = io.ReadFull(rd, buf); err != nil {
+			break
+		}
+		key = BigEndian.Int64(buf)
+		offset = BigEndian.Uint32(buf[versionOffsetOffset:])
+		vs = versions[key]
+		for i = range vs {
+			if vs[i].offset == offset {
+				vs[i].num = BigEndian.Int32(buf[versionNumOffset:])
+				vs[i].time = BigEndian.Int64(buf[versionTimeOffset:])
+			}
+		}
+		size += versionRecordSize
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Errorf("version: %s read error(%v)", file, err)
+		goto failed
+	}
+	if err = vf.f.Truncate(size); err != nil {
+		log.Errorf("version: %s Truncate() error(%v)", file, err)
+		goto failed
+	}
+	if _, err = vf.f.Seek(size, os.SEEK_SET); err != nil {
+		log.Errorf("version: %s Seek() error(%v)", file, err)
+		goto failed
+	}
+	vf.bw = bufio.NewWriter(vf.f)
+	// the versions not recorded are numbered after the previous one
+	for _, vs = range versions {
+		for i = 1; i < len(vs); i++ {
+			if vs[i].time == 0 {
+				vs[i].num = vs[i-1].num + 1
+			}
+		}
+	}
+	log.Infof("version: %s load %d records", file, size/versionRecordSize)
+	return
+failed:
+	vf.f.Close()
+	return
+}
+
+// write append a record of the version of key, the error is returned by
+// Flush.
+func (vf *versionFile) write(key int64, ver *needleVersion) {
+	var b []byte
+	if vf == nil {
+		return
+	}
+	b = vf.buf[:]
+	putVersionRecord(b, key, ver)
+	vf.bw.Write(b)
+}
+
+// putVersionRecord encode a version record of key into b.
+func putVersionRecord(b []byte, key int64, ver *needleVersion) {
+	BigEndian.PutInt64(b, key)
+	BigEndian.PutUint32(b[versionOffsetOffset:], ver.offset)
+	BigEndian.PutInt32(b[versionNumOffset:], ver.num)
+	BigEndian.PutInt64(b[versionTimeOffset:], ver.time)
+}
+
+// rewrite replace the version file by one record per version, the records
+// of the expired versions and the overwritten records are dropped.
+func (vf *versionFile) rewrite(versions map[int64][]needleVersion) (err error) {
+	var (
+		f   *os.File
+		b   []byte
+		bw  *bufio.Writer
+		tmp string
+	)
+	if vf == nil {
+		return
+	}
+	b, tmp = vf.buf[:], vf.File+".tmp"
+	if f, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664); err != nil {
+		log.Errorf("os.OpenFile(\"%s\", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664) error(%v)", tmp, err)
+		return
+	}
+	bw = bufio.NewWriter(f)
+	for key, vs := range versions {
+		for i := range vs {
+			putVersionRecord(b, key, &vs[i])
+			bw.Write(b)
+		}
+	}
+	if err = bw.Flush(); err != nil {
+		log.Errorf("version: %s Flush() error(%v)", tmp, err)
+		goto failed
+	}
+	if err = f.Sync(); err != nil {
+		log.Errorf("version: %s Sync() error(%v)", tmp, err)
+		goto failed
+	}
+	if err = os.Rename(tmp, vf.File); err != nil {
+		log.Errorf("os.Rename(\"%s\", \"%s\") error(%v)", tmp, vf.File, err)
+		goto failed
+	}
+	vf.f.Close()
+	vf.f, vf.bw = f, bufio.NewWriter(f)
+	return
+failed:
+	f.Close()
+	os.Remove(tmp)
+	return
+}
+
+// Flush flush the version file buffer.
+func (vf *versionFile) Flush() (err error) {
+	if vf == nil {
+		return
+	}
+	if err = vf.bw.Flush(); err != nil {
+		log.Errorf("version: %s Flush() error(%v)", vf.File, err)
+	}
+	return
+}
+
+// Sync fsync the version file.
+func (vf *versionFile) Sync() (err error) {
+	if vf == nil {
+		return
+	}
+	if err = vf.Flush(); err != nil {
+		return
+	}
+	if err = vf.f.Sync(); err != nil {
+		log.Errorf("version: %s Sync() error(%v)", vf.File, err)
+	}
+	return
+}
+
+// Close close the version file.
+func (vf *versionFile) Close() {
+	if vf == nil {
+		return
+	}
+	vf.Flush()
+	vf.f.Close()
+}
+
+// versioned check the volume keeps old needles.
+func (v *Volume) versioned() bool {
+	return v.options.Versions > 0
+}
+
+// addVersion append a new version of key, if num is zero, use the next
+// number, the version is recorded if the version file opened, return the
+// offset of the expired version, must called with lock.
+func (v *Volume) addVersion(key int64, offset uint32, size int32, num int32, t int64) (eoffset uint32) {
+	var vs = v.versions[key]
+	if num == 0 {
+		if num = 1; len(vs) > 0 {
+			num = vs[len(vs)-1].num + 1
+		}
+	}
+	vs = append(vs, needleVersion{num: num, offset: offset, size: size, time: t})
+	v.vfile.write(key, &vs[len(vs)-1])
+	// the current and the last Versions old needles
+	if len(vs) > v.options.Versions+1 {
+		eoffset = vs[0].offset
+		vs = append(vs[:0], vs[1:]...)
+	}
+	v.versions[key] = vs
+	return
+}
+
+// setVersion set the number and time of the current version of key, used
+// by compress keep the version, must called with lock.
+func (v *Volume) setVersion(key int64, ver needleVersion) {
+	var vs = v.versions[key]
+	if len(vs) == 0 {
+		return
+	}
+	vs[len(vs)-1].num = ver.num
+	vs[len(vs)-1].time = ver.time
+	v.vfile.write(key, &vs[len(vs)-1])
+}
+
+// compactVersions rewrite the version file from the versions, compress
+// call it on the new volume after the needles copied, so only the records
+// of the kept versions are left.
+func (v *Volume) compactVersions() (err error) {
+	if !v.versioned() {
+		return
+	}
+	v.lock.Lock()
+	err = v.vfile.rewrite(v.versions)
+	v.lock.Unlock()
+	return
+}
+
+// compressVersion get the version of the needle at offset, the version
+// older than VersionTTL is expired, the unknown time never expires, must
+// called with lock.
+func (v *Volume) compressVersion(key int64, offset uint32) (ver needleVersion, ok bool) {
+	var vs = v.versions[key]
+	for i := len(vs) - 1; i >= 0; i-- {
+		if vs[i].offset != offset {
+			continue
+		}
+		ver = vs[i]
+		// the current needle never expires
+		ok = i == len(vs)-1 || v.options.VersionTTL == 0 || ver.time == 0 ||
+			time.Since(time.Unix(0, ver.time)) < v.options.VersionTTL
+		return
+	}
+	return
+}
+
+// Versions get the versions of a needle, oldest first.
+func (v *Volume) Versions(key int64) (vers []NeedleVersion, err error) {
+	var (
+		ok bool
+		d  delNeedle
+		vs []needleVersion
+	)
+	if !v.versioned() {
+		err = ErrVolumeNoVersion
+		return
+	}
+	v.lock.Lock()
+	if vs = v.versions[key]; len(vs) > 0 {
+		d, ok = v.deleted[key]
+		vers = make([]NeedleVersion, len(vs))
+		for i, ver := range vs {
+			vers[i] = NeedleVersion{
+				Version: ver.num,
+				Size:    ver.size,
+				Deleted: ok && d.offset == ver.offset,
+			}
+			// the unknown time is left zero
+			if ver.time != 0 {
+				vers[i].Time = time.Unix(0, ver.time)
+			}
+		}
+	}
+	v.lock.Unlock()
+	if len(vers) == 0 {
+		err = ErrNoNeedle
+	}
+	return
+}
+
+// GetVersion get a version of needle, version zero is the current needle.
+func (v *Volume) GetVersion(key, cookie int64, version int32, buf []byte) (data []byte, err error) {
+	if version == 0 {
+		return v.Get(key, cookie, buf)
+	}
+	return v.getVersion(key, cookie, buf, func(ver *needleVersion) bool {
+		return ver.num == version
+	})
+}
+
+// GetAt get the version of needle which is the current at time t, the
+// versions older than an unknown time one can't be told.
+func (v *Volume) GetAt(key, cookie int64, t time.Time, buf []byte) (data []byte, err error) {
+	var (
+		unknown bool
+		ns      = t.UnixNano()
+	)
+	return v.getVersion(key, cookie, buf, func(ver *needleVersion) bool {
+		if unknown = unknown || ver.time == 0; unknown {
+			return false
+		}
+		return ver.time <= ns
+	})
+}
+
+// getVersion get the newest version of needle which match.
+func (v *Volume) getVersion(key, cookie int64, buf []byte, match func(ver *needleVersion) bool) (data []byte, err error) {
+	var (
+		ok     bool
+		ver    needleVersion
+		d      delNeedle
+		vs     []needleVersion
+		needle = &Needle{}
+		t      = newOpTrace(v.Id, volumeOpGet, key)
+	)
+	if !v.versioned() {
+		err = ErrVolumeNoVersion
+		t.done(err)
+		return
+	}
+	if err = v.diskError(); err != nil {
+		t.done(err)
+		return
+	}
+	v.lock.Lock()
+	t.mark(tracePhaseLock)
+	vs = v.versions[key]
+	err = ErrNeedleVersion
+	for i := len(vs) - 1; i >= 0; i-- {
+		if match(&vs[i]) {
+			ver, err = vs[i], nil
+			break
+		}
+	}
+	if d, ok = v.deleted[key]; ok && err == nil && d.offset == ver.offset {
+		err = ErrNeedleDeleted
+	}
+	v.lock.Unlock()
+	if err != nil {
+		t.done(err)
+		return
+	}
+	err = v.block.Get(ver.offset, buf[:ver.size])
+	t.mark(tracePhaseIO)
+	if err != nil {
+		v.setIOError(err)
+		t.done(err)
+		return
+	}
+	if err = needle.ParseHeader(buf[:NeedleHeaderSize]); err == nil {
+		err = needle.ParseData(buf[NeedleHeaderSize:ver.size], v.block.Checksum)
+	}
+	t.mark(tracePhaseParse)
+	if err == nil {
+		if needle.Key != key {
+			err = ErrNeedleKey
+		} else if needle.Cookie != cookie {
+			err = ErrNeedleCookie
+		} else {
+			if data, buf, err = v.block.Open(needle.Key, needle.Cookie, needle.Data, buf[ver.size:]); err == nil {
+				data, err = needle.Encoding.Decode(data, buf)
+			}
+			statVolumeRead(v.Id, len(data))
+		}
+	}
+	t.done(err)
+	return
+}
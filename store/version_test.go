@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestVolumeVersion(t *testing.T) {
+	var (
+		v, nv, cv *Volume
+		err       error
+		d         []byte
+		vers      []NeedleVersion
+		fi        os.FileInfo
+		at        time.Time
+		before    = time.Now()
+		buf       = make([]byte, 40)
+		o         = &VolumeOptions{Versions: 2}
+		bfile     = "./test/test.version"
+		ifile     = "./test/test.version.idx"
+		nbfile    = "./test/testn.version"
+		nifile    = "./test/testn.version.idx"
+		cbfile    = "./test/testc.version"
+		cifile    = "./test/testc.version.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	defer os.Remove(ifile + versionSuffix)
+	defer os.Remove(nbfile)
+	defer os.Remove(nifile)
+	defer os.Remove(nifile + versionSuffix)
+	defer os.Remove(cbfile)
+	defer os.Remove(cifile)
+	defer os.Remove(cifile + versionSuffix)
+	if v, err = NewVolume(1, bfile, ifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	for i := 1; i <= 4; i++ {
+		if err = v.Add(1, 1, []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Errorf("Add() error(%v)", err)
+			goto failed
+		}
+		if i == 2 {
+			at = time.Now()
+		}
+	}
+	t.Log("Versions")
+	if vers, err = v.Versions(1); err != nil {
+		t.Errorf("Versions() error(%v)", err)
+		goto failed
+	}
+	// current and 2 old versions
+	if len(vers) != 3 || vers[0].Version != 2 || vers[2].Version != 4 {
+		err = fmt.Errorf("versions: %v not match", vers)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("GetVersion")
+	if d, err = v.GetVersion(1, 1, 2, buf); err != nil {
+		t.Errorf("GetVersion(2) error(%v)", err)
+		goto failed
+	}
+	if !bytes.Equal(d, []byte("v2")) {
+		err = fmt.Errorf("GetVersion(2) data: %s not match", d)
+		t.Error(err)
+		goto failed
+	}
+	if _, err = v.GetVersion(1, 1, 1, buf); err != ErrNeedleVersion {
+		err = fmt.Errorf("GetVersion(1) expired must be ErrNeedleVersion")
+		t.Error(err)
+		goto failed
+	}
+	if d, err = v.GetVersion(1, 1, 0, buf); err != nil || !bytes.Equal(d, []byte("v4")) {
+		err = fmt.Errorf("GetVersion(0) data: %s error(%v) not match", d, err)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("GetAt")
+	if d, err = v.GetAt(1, 1, at, buf); err != nil || !bytes.Equal(d, []byte("v2")) {
+		err = fmt.Errorf("GetAt() data: %s error(%v) not match", d, err)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Compress")
+	if nv, err = NewVolume(1, nbfile, nifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = v.StartCompress(nv); err != nil {
+		t.Errorf("StartCompress() error(%v)", err)
+		goto failed
+	}
+	if err = v.StopCompress(nv); err != nil {
+		t.Errorf("StopCompress() error(%v)", err)
+		goto failed
+	}
+	if d, err = nv.GetVersion(1, 1, 3, buf); err != nil || !bytes.Equal(d, []byte("v3")) {
+		err = fmt.Errorf("GetVersion(3) data: %s error(%v) not match", d, err)
+		t.Error(err)
+		goto failed
+	}
+	// the expired version record is dropped
+	if fi, err = os.Stat(nifile + versionSuffix); err != nil || fi.Size() != 3*versionRecordSize {
+		err = fmt.Errorf("compressed version file: %v error(%v) not match", fi, err)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Recovery")
+	v.Close()
+	if v, err = NewVolume(1, bfile, ifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if vers, err = v.Versions(1); err != nil {
+		t.Errorf("Versions() error(%v)", err)
+		goto failed
+	}
+	if len(vers) != 3 || vers[0].Version != 2 || vers[2].Version != 4 {
+		err = fmt.Errorf("versions: %v not match", vers)
+		t.Error(err)
+		goto failed
+	}
+	if d, err = v.GetVersion(1, 1, 3, buf); err != nil || !bytes.Equal(d, []byte("v3")) {
+		err = fmt.Errorf("GetVersion(3) data: %s error(%v) not match", d, err)
+		t.Error(err)
+		goto failed
+	}
+	// the version time is recovered from the version file
+	if d, err = v.GetAt(1, 1, at, buf); err != nil || !bytes.Equal(d, []byte("v2")) {
+		err = fmt.Errorf("GetAt() data: %s error(%v) not match", d, err)
+		t.Error(err)
+		goto failed
+	}
+	if _, err = v.GetAt(1, 1, before, buf); err != ErrNeedleVersion {
+		err = fmt.Errorf("GetAt() before added error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Recovery without version file")
+	v.Close()
+	os.Remove(ifile + versionSuffix)
+	if v, err = NewVolume(1, bfile, ifile, &VolumeOptions{Versions: 2, VersionTTL: time.Hour}); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if vers, err = v.Versions(1); err != nil || len(vers) != 3 || !vers[0].Time.IsZero() {
+		err = fmt.Errorf("versions: %v error(%v) not match", vers, err)
+		t.Error(err)
+		goto failed
+	}
+	if _, err = v.GetAt(1, 1, time.Now(), buf); err != ErrNeedleVersion {
+		err = fmt.Errorf("GetAt() unknown time error(%v) not match", err)
+		t.Error(err)
+		goto failed
+	}
+	// the unknown time never expires
+	if cv, err = NewVolume(1, cbfile, cifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = v.StartCompress(cv); err != nil {
+		t.Errorf("StartCompress() error(%v)", err)
+		goto failed
+	}
+	if err = v.StopCompress(cv); err != nil {
+		t.Errorf("StopCompress() error(%v)", err)
+		goto failed
+	}
+	if d, err = cv.GetVersion(1, 1, 2, buf); err != nil || !bytes.Equal(d, []byte("v2")) {
+		err = fmt.Errorf("GetVersion(2) data: %s error(%v) not match", d, err)
+		t.Error(err)
+		goto failed
+	}
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if nv != nil {
+		nv.Close()
+	}
+	if cv != nil {
+		cv.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestHttpGetVersion(t *testing.T) {
+	var (
+		s      *Store
+		v      *Volume
+		err    error
+		resp   *http.Response
+		body   []byte
+		srv    *httptest.Server
+		file   = "./test/store.version.idx"
+		bfile  = "./test/test.version.http"
+		ifile  = "./test/test.version.http.idx"
+		config = &Config{Index: file, Volume: VolumeOptions{Versions: 2}}
+	)
+	defer os.Remove(file)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	defer os.Remove(ifile + versionSuffix)
+	if s, err = NewStore(config); err != nil {
+		t.Errorf("NewStore() error(%v)", err)
+		t.FailNow()
+	}
+	defer s.Close()
+	if _, err = s.AddVolume(1, bfile, ifile); err != nil {
+		t.Errorf("AddVolume() error(%v)", err)
+		t.FailNow()
+	}
+	time.Sleep(1 * time.Second)
+	if v = s.Volume(1); v == nil {
+		t.Errorf("Volume(1) not exist")
+		t.FailNow()
+	}
+	for i := 1; i <= 4; i++ {
+		if err = v.Add(1, 1, []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Errorf("Add() error(%v)", err)
+			t.FailNow()
+		}
+	}
+	srv = httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		get(s, wr, r)
+	}))
+	defer srv.Close()
+	for _, c := range []struct {
+		version string
+		status  int
+		data    string
+	}{
+		{"", http.StatusOK, "v4"},
+		{"0", http.StatusOK, "v4"},
+		{"3", http.StatusOK, "v3"},
+		{"2", http.StatusOK, "v2"},
+		{"1", http.StatusNotFound, ""},
+		{"-1", http.StatusBadRequest, ""},
+	} {
+		t.Logf("version: %s", c.version)
+		if resp, err = http.Get(srv.URL + "/get?vid=1&key=1&cookie=1&version=" + c.version); err != nil {
+			t.Errorf("http.Get() error(%v)", err)
+			t.FailNow()
+		}
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != c.status {
+			t.Errorf("get version: %s status: %d error(%v)", c.version, resp.StatusCode, err)
+			t.FailNow()
+		}
+		if c.status == http.StatusOK && string(body) != c.data {
+			t.Errorf("get version: %s data: %s not match", c.version, body)
+			t.FailNow()
+		}
+	}
+}
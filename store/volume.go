@@ -2,23 +2,30 @@ package main
 
 import (
 	log "github.com/golang/glog"
+	"os"
+	"runtime/debug"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	// signal command
-	volumeFinish   = 0
 	volumeReady    = 1
 	volumeDelChNum = 10240
 	// del
 	volumeDelMax = 50
+	// add
+	volumeAddChNum = 1024
+	volumeAddMax   = 128
 )
 
 var (
 	// del
 	volumeDelTime = 1 * time.Minute
+	// the last volume generation
+	volumeGen uint64
 )
 
 // Uint32Slice deleted offset sort.
@@ -28,41 +35,199 @@ func (p Uint32Slice) Len() int           { return len(p) }
 func (p Uint32Slice) Less(i, j int) bool { return p[i] < p[j] }
 func (p Uint32Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
+// VolumeOptions the volume options, the zero value is the default.
+type VolumeOptions struct {
+	// preallocate the block file to the size in bytes with fallocate, so
+	// the block file won't fragment, 0 disable.
+	Prealloc int64 `yaml:"prealloc"`
+	// durability policy: none, interval or always, interval sync every
+	// SyncInterval or every SyncBytes written.
+	Sync         string        `yaml:"sync"`
+	SyncInterval time.Duration `yaml:"sync_interval"`
+	SyncBytes    int64         `yaml:"sync_bytes"`
+	// index ring size, if the ring is full, writers wait RingTimeout for
+	// the index merge goroutine then write the index synchronously.
+	RingSize    int           `yaml:"ring_size"`
+	RingTimeout time.Duration `yaml:"ring_timeout"`
+	// compress keeps the needles deleted in Retention, so they can be
+	// undeleted, the deleted time is reset to the recovery time if the
+	// volume reopened, 0 disable.
+	Retention time.Duration `yaml:"retention"`
+	// keep the last Versions needles of a overwritten key, they can be read
+	// by version or timestamp, compress drops the ones older than
+	// VersionTTL, 0 disable.
+	Versions   int           `yaml:"versions"`
+	VersionTTL time.Duration `yaml:"version_ttl"`
+	// needle map type: hash, compact or disk, compact costs less memory,
+	// disk keeps the needle cache in a sorted file next to the index, so
+	// the volume opens without replaying the whole index, a get may cost
+	// one more disk io, it can't be used with Versions.
+	NeedleMap string `yaml:"needle_map"`
+	// read needles from a read only mapping of the block file, Get returns
+	// a slice of the mapping instead of copy into the buffer, it's valid
+	// until the volume closed, or Unref if the reader holds a Ref, linux
+	// only.
+	Mmap bool `yaml:"mmap"`
+	// drop the written block and index pages from the os page cache with
+	// fadvise(DONTNEED) every DropCache bytes written, so the uploads won't
+	// evict the hot needles, 0 disable.
+	DropCache int64 `yaml:"drop_cache"`
+	// the http get api sends the needles not smaller than Sendfile bytes
+	// from the block file with sendfile, 0 disable, SendfileVerify is the
+	// checksum policy: scrub (default) only verify when the needle is read
+	// by Get or compress, so it's zero copy, stream verify with a streaming
+	// crc while sending and abort the response if not match, the data is
+	// copied through the process.
+	Sendfile       int32  `yaml:"sendfile"`
+	SendfileVerify string `yaml:"sendfile_verify"`
+	// the needle checksum of the new volumes: crc32c (default) or koopman,
+	// it's recorded in the super block header, the existing volumes keep
+	// their own, a compaction rewrites the needles with this one.
+	Checksum string `yaml:"checksum"`
+	// the needle data encoding of the adds: none (default) or gzip, the data
+	// is kept raw if the encoded isn't smaller, Get decodes the data, the
+	// http get api sends the encoded data if the client accepts it.
+	Encoding string `yaml:"encoding"`
+	// encrypt the needle data of the new volumes with aes-gcm by the current
+	// key of Keys, the key id is recorded in the super block header, the
+	// encrypted volumes aren't sent with sendfile, Keys is set by store from
+	// the key file.
+	Encrypt bool        `yaml:"encrypt"`
+	Keys    KeyProvider `yaml:"-"`
+	// dedup the adds by the sha-256 of the needle data, a key added with the
+	// same data as a live needle is an alias of it instead of a new needle,
+	// the sums and the alias cookies are kept in a file next to the index,
+	// the sums of an encrypted volume are keyed by hmac, the adds in
+	// compress aren't deduped, it can't be used with Versions.
+	Dedup bool `yaml:"dedup"`
+}
+
+// delNeedle a deleted needle which can be undeleted.
+type delNeedle struct {
+	offset uint32
+	size   int32
+	time   int64
+}
+
 // An store server contains many logic Volume, volume is superblock container.
 type Volume struct {
 	Id      int32
 	lock    sync.Mutex
-	block   *SuperBlock
-	indexer *Indexer
-	needles map[int64]NeedleCache
-	signal  chan uint32
+	options *VolumeOptions
+	// the writers take lock then nlock to set needles, the readers only
+	// take nlock, so they never wait for the writers io
+	nlock    sync.RWMutex
+	block    *SuperBlock
+	indexer  *Indexer
+	needles  NeedleMap
+	deleted  map[int64]delNeedle
+	versions map[int64][]needleVersion
+	vfile    *versionFile
+	signal   chan uint32
+	// the queued flag updates of offsets, undelete cancels them
+	dlock    sync.Mutex
+	dels     map[uint32]int
+	disk     *Disk
+	cache    *HotCache
+	gen      uint64
+	syncer   *syncer
+	encoding NeedleEncoding
+	dedup    *dedup
+	// add
+	addCh     chan *addReq
+	batches   int64
+	closed    chan struct{}
+	writeExit chan struct{}
+	delDone   chan struct{}
+	// the references of the store and the readers, the last Unref closes
+	refs int32
+	// the disk needle map merging, closed when done
+	merged chan struct{}
+	// list
+	clock    sync.Mutex
+	cursors  map[uint64]*listCursor
+	cursorId uint64
+	// stat, written with lock, read atomically by Stat
+	liveBytes int64
+	// health
+	hlock   sync.Mutex
+	ioErr   error
+	delTime int64
+	delExit int32
 	// flag used in store
 	Command int
-	// compress
-	Compress       bool
+	// compress, the flag and offset are written with lock, read atomically
+	// by Stat
+	compress       int32
 	compressOffset int64
 	compressKeys   []int64
 }
 
-// NewVolume new a volume and init it.
-func NewVolume(id int32, bfile, ifile string) (v *Volume, err error) {
+// NewVolume new a volume and init it, if o is nil use the default options,
+// the volume keeps its own copy of o.
+func NewVolume(id int32, bfile, ifile string, o *VolumeOptions) (v *Volume, err error) {
+	var vo VolumeOptions
+	if o != nil {
+		vo = *o
+	}
+	o = &vo
 	v = &Volume{}
 	v.Id = id
-	if v.block, err = NewSuperBlock(bfile); err != nil {
+	// every opened volume is a new generation of the cached needles
+	v.gen = atomic.AddUint64(&volumeGen, 1)
+	v.options = o
+	if v.encoding, err = ParseNeedleEncoding(o.Encoding); err != nil {
+		log.Errorf("volume: %d encoding: \"%s\" error(%v)", id, o.Encoding, err)
+		return
+	}
+	if v.block, err = NewSuperBlock(bfile, o); err != nil {
 		log.Errorf("init super block: \"%s\" error(%v)", bfile, err)
 		return
 	}
-	if v.indexer, err = NewIndexer(ifile, 102400); err != nil {
+	if o.RingSize <= 0 {
+		o.RingSize = indexRingDefault
+	}
+	if v.indexer, err = NewIndexer(ifile, o.RingSize); err != nil {
 		log.Errorf("init indexer: %s error(%v)", ifile, err)
 		goto failed
 	}
-	v.needles = make(map[int64]NeedleCache)
+	if o.RingTimeout > 0 {
+		v.indexer.timeout = o.RingTimeout
+	}
+	v.indexer.drop.size = o.DropCache
+	if o.NeedleMap == NeedleMapDisk && v.versioned() {
+		err = ErrVolumeNeedleMap
+		goto failed
+	}
+	if o.Dedup && v.versioned() {
+		err = ErrVolumeDedup
+		goto failed
+	}
+	v.deleted = make(map[int64]delNeedle)
+	v.dels = make(map[uint32]int)
+	v.cursors = make(map[uint64]*listCursor)
+	if v.versioned() {
+		v.versions = make(map[int64][]needleVersion)
+	}
 	if err = v.init(); err != nil {
+		if dm, ok := v.needles.(*DiskNeedleMap); ok {
+			dm.Close()
+		}
+		v.vfile.Close()
+		v.dedup.Close()
 		goto failed
 	}
 	v.signal = make(chan uint32, volumeDelChNum)
 	v.compressKeys = []int64{}
-	go v.del()
+	v.delTime = time.Now().UnixNano()
+	v.syncer = newSyncer(o, v.sync)
+	v.addCh = make(chan *addReq, volumeAddChNum)
+	v.closed = make(chan struct{})
+	v.writeExit = make(chan struct{})
+	v.delDone = make(chan struct{})
+	v.refs = 1
+	go v.del(volumeDelTime)
+	go v.write()
 	return
 failed:
 	v.block.Close()
@@ -72,18 +237,316 @@ failed:
 	return
 }
 
-// init recovery super block from index or super block.
+// init recovery super block from sorted file, index or super block.
 func (v *Volume) init() (err error) {
-	var offset uint32
-	// recovery from index
-	if offset, err = v.indexer.Recovery(v.needles); err != nil {
+	var (
+		ioffset int64
+		offset  uint32
+		key     []byte
+		offsets []uint32
+		tombs   []Index
+		dm      *DiskNeedleMap
+		sfile   = v.indexer.File + diskNeedleMapSuffix
+		now     = time.Now().UnixNano()
+	)
+	// recovery from sorted file, only the index after it need replay
+	if v.options.NeedleMap == NeedleMapDisk {
+		if dm, err = OpenDiskNeedleMap(sfile); err == nil {
+			// the index may be truncated
+			if fi, serr := os.Stat(v.indexer.File); serr != nil || fi.Size() < dm.Offset {
+				log.Errorf("volume: %d sorted file: %s index offset: %d out of range", v.Id, sfile, dm.Offset)
+				dm.Close()
+				dm = nil
+			} else {
+				v.needles = dm
+				ioffset = dm.Offset
+			}
+		} else if !os.IsNotExist(err) {
+			log.Errorf("volume: %d sorted file: %s invalid error(%v), recovery from index", v.Id, sfile, err)
+		}
+		err = nil
+	}
+	if dm == nil {
+		// the stale sorted file is rebuilt later
+		os.Remove(sfile)
+		// only the in memory needle map is presized, the disk one is built
+		// from it
+		v.needles = NewNeedleMap(v.options.NeedleMap, indexKeys(v.indexer.File))
+	}
+	// recovery from index, the tombstone deleted needles may not update flag
+	if offset, err = v.indexer.recovery(v.needles, ioffset, func(ix *Index) {
+		if ix.Offset != NeedleCacheDelOffset {
+			// the needle undeleted in place isn't a new version
+			if vs := v.versions[ix.Key]; v.versioned() && (len(vs) == 0 || vs[len(vs)-1].offset != ix.Offset) {
+				// the version time is unknown
+				v.addVersion(ix.Key, ix.Offset, ix.Size, 0, 0)
+			}
+			return
+		}
+		if offset, size := v.needleValue(ix.Key); offset != NeedleCacheDelOffset {
+			tombs = append(tombs, Index{Key: ix.Key, Offset: offset})
+			v.deleted[ix.Key] = delNeedle{offset: offset, size: size, time: now}
+		}
+	}); err != nil {
 		return
 	}
+	if dm != nil && offset < dm.BlockOffset {
+		offset = dm.BlockOffset
+	}
 	// recovery from super block
-	err = v.block.Recovery(v.needles, v.indexer, BlockOffset(offset))
+	if err = v.block.recovery(v.needles, v.indexer, BlockOffset(offset), func(key int64, offset uint32, size int32) {
+		if v.versioned() {
+			// the version time is unknown
+			v.addVersion(key, offset, size, 0, 0)
+		}
+	}); err != nil {
+		return
+	}
+	// drop the deleted needles added again
+	for key := range v.deleted {
+		if offset, _ = v.needleValue(key); offset != NeedleCacheDelOffset {
+			delete(v.deleted, key)
+		}
+	}
+	if v.versioned() {
+		if v.vfile, err = openVersionFile(v.indexer.File+versionSuffix, v.versions); err != nil {
+			return
+		}
+	}
+	if v.options.Dedup {
+		if key, err = v.block.SumKey(); err != nil {
+			return
+		}
+		if v.dedup, err = openDedup(v.indexer.File+dedupSuffix, key, v.needles); err != nil {
+			return
+		}
+	}
+	// replay the tombstones, except the needles undeleted in place
+	for _, ix := range tombs {
+		if offset, _ = v.needleValue(ix.Key); offset != ix.Offset {
+			offsets = append(offsets, ix.Offset)
+		}
+	}
+	sort.Sort(Uint32Slice(offsets))
+	for _, offset = range offsets {
+		// the needle shared by the other keys is kept
+		if v.dedup.shared(offset) {
+			continue
+		}
+		if err = v.block.Del(offset); err != nil {
+			log.Errorf("block: %s Del(%d) error(%v)", v.block.File, offset, err)
+			return
+		}
+	}
+	if len(offsets) > 0 {
+		log.Infof("volume: %d replay %d deleted needles", v.Id, len(offsets))
+	}
+	// the recovery delta isn't kept
+	if cm, ok := v.needles.(*CompactNeedleMap); ok {
+		cm.Merge()
+	}
+	atomic.StoreInt64(&v.liveBytes, 0)
+	v.needles.Range(func(_ int64, nc NeedleCache) bool {
+		if offset, size := nc.Value(); offset != NeedleCacheDelOffset {
+			atomic.AddInt64(&v.liveBytes, int64(size))
+		}
+		return true
+	})
+	if v.options.NeedleMap == NeedleMapDisk && dm == nil {
+		err = v.convertNeedles(NeedleMapDisk)
+	}
+	return
+}
+
+// ConvertIndex convert the needle map to type t, the needle map type is
+// reset to the options one when the volume reopened.
+func (v *Volume) ConvertIndex(t string) (err error) {
+	v.lock.Lock()
+	v.waitMerge()
+	err = v.convertNeedles(t)
+	v.lock.Unlock()
 	return
 }
 
+// convertNeedles convert the needle map to type t, must called with lock.
+func (v *Volume) convertNeedles(t string) (err error) {
+	var (
+		ok     bool
+		offset int64
+		dm     *DiskNeedleMap
+		sfile  = v.indexer.File + diskNeedleMapSuffix
+	)
+	if t != NeedleMapHash && t != NeedleMapCompact && t != NeedleMapDisk {
+		return ErrVolumeNeedleMap
+	}
+	if t == NeedleMapDisk && v.versioned() {
+		return ErrVolumeNeedleMap
+	}
+	dm, ok = v.needles.(*DiskNeedleMap)
+	if t == NeedleMapDisk {
+		if ok {
+			return
+		}
+		// all the needles must in the index and block before the offsets
+		if err = v.block.Flush(); err != nil {
+			return
+		}
+		if offset, err = v.indexer.Merge(); err != nil {
+			return
+		}
+		if err = WriteDiskNeedleMap(sfile, v.needles, offset, v.block.offset); err != nil {
+			return
+		}
+		if dm, err = OpenDiskNeedleMap(sfile); err != nil {
+			return
+		}
+		v.nlock.Lock()
+		v.needles = dm
+		v.nlock.Unlock()
+	} else {
+		needles := NewNeedleMap(t, v.needles.Len())
+		v.needles.Range(func(key int64, nc NeedleCache) bool {
+			needles.Set(key, nc)
+			return true
+		})
+		if cm, ok := needles.(*CompactNeedleMap); ok {
+			cm.Merge()
+		}
+		if ok {
+			if err = dm.Error(); err != nil {
+				return
+			}
+		}
+		v.nlock.Lock()
+		v.needles = needles
+		v.nlock.Unlock()
+		if ok {
+			dm.Close()
+			if err = os.Remove(sfile); err != nil {
+				log.Errorf("os.Remove(\"%s\") error(%v)", sfile, err)
+			}
+		}
+	}
+	log.Infof("volume: %d convert needle map to: %s", v.Id, t)
+	return
+}
+
+// mergeNeedles merge the disk needle map delta if it's full or force, the
+// new sorted file is written by a goroutine without lock, only the swap
+// takes the lock, force waits the merging one and merges synchronously.
+// must called with lock.
+func (v *Volume) mergeNeedles(force bool) {
+	var (
+		ok      bool
+		err     error
+		offset  int64
+		boffset uint32
+		dm      *DiskNeedleMap
+	)
+	if dm, ok = v.needles.(*DiskNeedleMap); !ok {
+		return
+	}
+	if force {
+		v.waitMerge()
+	} else if v.merged != nil || !dm.Full() {
+		return
+	}
+	// the needles merged must in the index and block
+	if err = v.block.Flush(); err == nil {
+		offset, err = v.indexer.Merge()
+	}
+	if err != nil {
+		log.Errorf("volume: %d merge needle map error(%v)", v.Id, err)
+		v.setIOError(err)
+		return
+	}
+	boffset = v.block.offset
+	v.nlock.Lock()
+	dm.freeze()
+	v.nlock.Unlock()
+	if force {
+		v.swapNeedles(dm, dm.write(offset, boffset))
+		return
+	}
+	v.merged = make(chan struct{})
+	go v.merge(dm, offset, boffset, v.merged)
+}
+
+// merge write the frozen delta into a new sorted file then swap it.
+func (v *Volume) merge(dm *DiskNeedleMap, offset int64, boffset uint32, done chan struct{}) {
+	var err = dm.write(offset, boffset)
+	v.lock.Lock()
+	v.swapNeedles(dm, err)
+	v.merged = nil
+	close(done)
+	v.lock.Unlock()
+}
+
+// swapNeedles open the new sorted file written by merge, the readers only
+// wait for the reopen, must called with lock.
+func (v *Volume) swapNeedles(dm *DiskNeedleMap, err error) {
+	if err == nil {
+		v.nlock.Lock()
+		err = dm.reopen()
+		v.nlock.Unlock()
+	}
+	if err != nil {
+		log.Errorf("volume: %d merge needle map error(%v)", v.Id, err)
+		v.setIOError(err)
+	}
+}
+
+// waitMerge wait the merging goroutine, the lock is released while waiting,
+// must called with lock.
+func (v *Volume) waitMerge() {
+	var done chan struct{}
+	for v.merged != nil {
+		done = v.merged
+		v.lock.Unlock()
+		<-done
+		v.lock.Lock()
+	}
+}
+
+// compactNeedles merge the frozen delta of the compact needle map without
+// lock, the readers and writers only wait for the swap.
+func (v *Volume) compactNeedles(cm *CompactNeedleMap) {
+	var entries = cm.merged()
+	v.lock.Lock()
+	v.nlock.Lock()
+	cm.swap(entries)
+	v.nlock.Unlock()
+	v.lock.Unlock()
+}
+
+// mmapRecover recover the fault of reading a truncated block file mapping.
+func (v *Volume) mmapRecover(data *[]byte, err *error) {
+	if r := recover(); r != nil {
+		*data, *err = nil, mmapFault(v.block.File, r)
+		v.setIOError(*err)
+	}
+}
+
+// setNeedle set the needle cache of key and drop the cached needle data,
+// must called with lock.
+func (v *Volume) setNeedle(key int64, nc NeedleCache) {
+	v.nlock.Lock()
+	v.needles.Set(key, nc)
+	if cm, ok := v.needles.(*CompactNeedleMap); ok && cm.Full() {
+		cm.freeze()
+		go v.compactNeedles(cm)
+	}
+	v.nlock.Unlock()
+	v.cache.Del(v.Id, key)
+}
+
+// needleValue get the offset and size of key, zero if not exists, must
+// called with lock.
+func (v *Volume) needleValue(key int64) (offset uint32, size int32) {
+	var nc, _ = v.needles.Get(key)
+	return nc.Value()
+}
+
 // Lock lock the volume, used in multi write needles.
 func (v *Volume) Lock() {
 	v.lock.Lock()
@@ -99,19 +562,106 @@ func (v *Volume) File() (string, string) {
 	return v.block.File, v.indexer.File
 }
 
+// renameVolume rename the closed volume block, index and the side files
+// next to the index if exist.
+func renameVolume(obfile, oifile, bfile, ifile string) (err error) {
+	if err = os.Rename(obfile, bfile); err != nil {
+		log.Errorf("os.Rename(\"%s\", \"%s\") error(%v)", obfile, bfile, err)
+		return
+	}
+	if err = os.Rename(oifile, ifile); err != nil {
+		log.Errorf("os.Rename(\"%s\", \"%s\") error(%v)", oifile, ifile, err)
+		return
+	}
+	for _, suffix := range []string{diskNeedleMapSuffix, dedupSuffix, versionSuffix} {
+		if err = os.Rename(oifile+suffix, ifile+suffix); err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+				continue
+			}
+			log.Errorf("os.Rename(\"%s\", \"%s\") error(%v)", oifile+suffix, ifile+suffix, err)
+			return
+		}
+	}
+	return
+}
+
 // Get get a needle by key.
 func (v *Volume) Get(key, cookie int64, buf []byte) (data []byte, err error) {
+	var t = newOpTrace(v.Id, volumeOpGet, key)
+	if err = v.diskError(); err != nil {
+		t.done(err)
+		return
+	}
+	if data, _, err = v.get(key, cookie, buf, true, t); err == nil {
+		statVolumeRead(v.Id, len(data))
+	}
+	t.done(err)
+	return
+}
+
+// Ref hold the volume and the block mappings, so the volume isn't closed
+// and the needle data returned by Get is still valid until Unref, the readers
+// of a store volume must hold it, since the store replaces or deletes the
+// volume any time. it fails if the volume is released by the store.
+func (v *Volume) Ref() (ok bool) {
+	var n int32
+	for {
+		if n = atomic.LoadInt32(&v.refs); n <= 0 {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&v.refs, n, n+1) {
+			break
+		}
+	}
+	if v.options.Mmap {
+		v.block.Ref()
+	}
+	return true
+}
+
+// Unref release a reference held by Ref or the store, the volume is closed
+// by the last one.
+func (v *Volume) Unref() {
+	if v.options.Mmap {
+		v.block.Unref()
+	}
+	if atomic.AddInt32(&v.refs, -1) == 0 {
+		v.Close()
+	}
+}
+
+// GetEncoded get a needle data without decode, e is the encoding of data,
+// used by the clients accept the encoding.
+func (v *Volume) GetEncoded(key, cookie int64, buf []byte) (data []byte, e NeedleEncoding, err error) {
+	var t = newOpTrace(v.Id, volumeOpGet, key)
+	if err = v.diskError(); err != nil {
+		t.done(err)
+		return
+	}
+	if data, e, err = v.get(key, cookie, buf, false, t); err == nil {
+		statVolumeRead(v.Id, len(data))
+	}
+	t.done(err)
+	return
+}
+
+// get get a needle by key.
+func (v *Volume) get(key, cookie int64, buf []byte, decode bool, t *opTrace) (data []byte, e NeedleEncoding, err error) {
 	var (
 		ok          bool
 		size        int32
+		acookie     int64
+		raw, spare  []byte
 		offset      uint32
 		needleCache NeedleCache
 		needle      = &Needle{}
 	)
 	// get a needle
-	v.lock.Lock()
-	needleCache, ok = v.needles[key]
-	v.lock.Unlock()
+	v.nlock.RLock()
+	t.mark(tracePhaseLock)
+	needleCache, ok = v.needles.Get(key)
+	v.nlock.RUnlock()
 	if !ok {
 		err = ErrNoNeedle
 		return
@@ -122,97 +672,379 @@ func (v *Volume) Get(key, cookie int64, buf []byte) (data []byte, err error) {
 		err = ErrNeedleDeleted
 		return
 	}
-	// WARN atomic read superblock, pread syscall is atomic
-	if err = v.block.Get(offset, buf[:size]); err != nil {
+	// the cached data is decrypted
+	if needle.Cookie, e, data, ok = v.cache.Get(v.Id, v.gen, key, needleCache, buf); ok {
+		if needle.Cookie != cookie {
+			data = nil
+			err = ErrNeedleCookie
+		} else if decode {
+			data, err = e.Decode(data, buf[len(data):])
+		}
+		return
+	}
+	if v.options.Mmap {
+		// the mapping pages are read when parse
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		defer v.mmapRecover(&data, &err)
+		raw, err = v.block.Mmap(offset, size)
+		spare = buf
+	} else {
+		// WARN atomic read superblock, pread syscall is atomic
+		raw, err = buf[:size], v.block.Get(offset, buf[:size])
+		spare = buf[size:]
+	}
+	t.mark(tracePhaseIO)
+	if err != nil {
+		v.setIOError(err)
 		return
 	}
 	// parse needle
-	if err = needle.ParseHeader(buf[:NeedleHeaderSize]); err != nil {
+	if err = needle.ParseHeader(raw[:NeedleHeaderSize]); err != nil {
 		return
 	}
-	if err = needle.ParseData(buf[NeedleHeaderSize:]); err != nil {
+	if err = needle.ParseData(raw[NeedleHeaderSize:], v.block.Checksum); err != nil {
 		return
 	}
-	log.V(1).Infof("%v\n", buf[:size])
+	t.mark(tracePhaseParse)
+	log.V(1).Infof("%v\n", raw)
 	log.V(1).Infof("%v\n", needle)
-	// check needle
-	if needle.Key != key {
-		err = ErrNeedleKey
-		return
+	// check needle, an alias has its own cookie
+	if acookie = needle.Cookie; needle.Key != key {
+		if acookie, ok = v.dedup.alias(key, offset); !ok {
+			err = ErrNeedleKey
+			return
+		}
 	}
-	if needle.Cookie != cookie {
+	if acookie != cookie {
 		err = ErrNeedleCookie
 		return
 	}
 	// if delete
 	if needle.Flag == NeedleStatusDel {
 		v.lock.Lock()
-		v.needles[key] = NewNeedleCache(NeedleCacheDelOffset, size)
+		if nc, _ := v.needles.Get(key); nc == needleCache {
+			v.setNeedle(key, NewNeedleCache(NeedleCacheDelOffset, size))
+			v.deleted[key] = delNeedle{offset: offset, size: size, time: time.Now().UnixNano()}
+			atomic.AddInt64(&v.liveBytes, -int64(size))
+		}
 		v.lock.Unlock()
 		err = ErrNeedleDeleted
 		return
 	}
-	data = needle.Data
+	e = needle.Encoding
+	// the data is sealed for the needle, not the alias
+	if data, spare, err = v.block.Open(needle.Key, needle.Cookie, needle.Data, spare); err != nil {
+		return
+	}
+	v.cache.Set(v.Id, v.gen, key, needleCache, cookie, e, data)
+	if decode {
+		data, err = e.Decode(data, spare)
+	}
 	return
 }
 
 // Add add a new needle, if key exists append to super block, then update
 // needle cache offset to new offset.
 func (v *Volume) Add(key, cookie int64, data []byte) (err error) {
+	var t = newOpTrace(v.Id, volumeOpAdd, key)
+	if err = v.diskError(); err != nil {
+		t.done(err)
+		return
+	}
+	var sum = v.dedup.sum(data)
+	e, edata := v.encode(data)
+	if edata, err = v.block.Seal(key, cookie, edata); err == nil {
+		err = v.add(key, cookie, e, edata, sum, t)
+	}
+	if err == nil {
+		statVolumeWrite(v.Id, len(data))
+	}
+	t.done(err)
+	return
+}
+
+// addReq a queued add request, the write goroutine fill the offset, size
+// and error then wake up the caller.
+type addReq struct {
+	key    int64
+	cookie int64
+	e      NeedleEncoding
+	data   []byte
+	sum    *dedupSum
+	t      *opTrace
+	alias  bool
+	offset uint32
+	size   int32
+	err    error
+	done   chan struct{}
+}
+
+// add queue a new needle to the write goroutine and wait, the data is
+// encoded by e and sealed by the block key, it's deduped if sum isn't nil.
+func (v *Volume) add(key, cookie int64, e NeedleEncoding, data []byte, sum *dedupSum, t *opTrace) (err error) {
+	var req = &addReq{key: key, cookie: cookie, e: e, data: data, sum: sum, t: t, done: make(chan struct{}, 1)}
+	select {
+	case v.addCh <- req:
+	case <-v.closed:
+		err = ErrVolumeClosed
+		return
+	}
+	select {
+	case <-req.done:
+	case <-v.writeExit:
+		// the write goroutine may exit before handle the request
+		select {
+		case <-req.done:
+		default:
+			req.err = ErrVolumeClosed
+		}
+	}
+	err = req.err
+	return
+}
+
+// write merge the queued add requests, write them to the block with one
+// flush and one fsync, then wake up every caller.
+func (v *Volume) write() {
 	var (
-		ok              bool
-		size, osize     int32
-		offset, ooffset uint32
-		needleCache     NeedleCache
+		req  *addReq
+		reqs = make([]*addReq, 0, volumeAddMax)
 	)
+	log.V(1).Infof("start volume: %d write goroutine", v.Id)
+	for {
+		select {
+		case req = <-v.addCh:
+		case <-v.closed:
+			// drain the left requests
+			for {
+				select {
+				case req = <-v.addCh:
+					req.err = ErrVolumeClosed
+					req.done <- struct{}{}
+				default:
+					close(v.writeExit)
+					log.V(1).Infof("volume: %d write goroutine exit", v.Id)
+					return
+				}
+			}
+		}
+		reqs = append(reqs[:0], req)
+		// merge
+		for len(reqs) < volumeAddMax {
+			select {
+			case req = <-v.addCh:
+				reqs = append(reqs, req)
+				continue
+			default:
+			}
+			break
+		}
+		v.writeBatch(reqs)
+	}
+}
+
+// writeBatch write a batch of add requests.
+func (v *Volume) writeBatch(reqs []*addReq) {
+	var (
+		err         error
+		ok          bool
+		seq         int64
+		now, last   time.Time
+		req         *addReq
+		dn          *dedupNeedle
+		osize       int32
+		ooffset     uint32
+		needleCache NeedleCache
+		ooffsets    = make([]uint32, len(reqs))
+		phases      [tracePhaseNum]time.Duration
+	)
+	atomic.AddInt64(&v.batches, 1)
 	v.lock.Lock()
-	needleCache, ok = v.needles[key]
-	// add needle
-	if offset, size, err = v.block.Add(key, cookie, data); err != nil {
-		v.lock.Unlock()
-		return
+	last = time.Now()
+	for _, req = range reqs {
+		req.t.mark(tracePhaseLock)
 	}
-	log.V(1).Infof("add needle, offset: %d, size: %d", offset, size)
-	// update index
-	if err = v.indexer.Add(key, offset, size); err != nil {
-		v.lock.Unlock()
-		return
+	for _, req = range reqs {
+		// the same data is an alias of the needle
+		if dn = v.dedupFind(req.key, req.sum); dn != nil {
+			req.offset, req.size, req.alias = dn.offset, dn.size, true
+			req.err = v.dedup.ref(req.key, req.cookie, dn)
+		} else if req.offset, req.size, req.err = v.block.Write(req.key, req.cookie, req.e, req.data); req.err == nil && req.sum != nil {
+			_, req.err = v.dedup.add(req.key, req.offset, req.size, req.sum)
+		}
+		if req.err != nil {
+			v.setIOError(req.err)
+		}
+	}
+	now = time.Now()
+	phases[tracePhaseIO], last = now.Sub(last), now
+	// one flush for all the requests, the alias cookies before the index
+	if err = v.block.Flush(); err == nil {
+		err = v.dedup.Flush()
+	}
+	if err != nil {
+		v.setIOError(err)
+	}
+	now = time.Now()
+	phases[tracePhaseFlush], last = now.Sub(last), now
+	for i, req := range reqs {
+		if err != nil && req.err == nil {
+			req.err = err
+		}
+		if req.err != nil {
+			continue
+		}
+		log.V(1).Infof("add needle, offset: %d, size: %d", req.offset, req.size)
+		// update index, an alias has no needle in the block to recover
+		// from, so it's written synchronously like a tombstone
+		if req.alias {
+			req.err = v.indexer.writeSync(req.key, req.offset, req.size)
+		} else {
+			req.err = v.indexer.Add(req.key, req.offset, req.size)
+		}
+		if req.err != nil {
+			continue
+		}
+		needleCache, ok = v.needles.Get(req.key)
+		v.setNeedle(req.key, NewNeedleCache(req.offset, req.size))
+		delete(v.deleted, req.key)
+		atomic.AddInt64(&v.liveBytes, int64(req.size))
+		if ok {
+			if ooffset, osize = needleCache.Value(); ooffset != NeedleCacheDelOffset {
+				atomic.AddInt64(&v.liveBytes, -int64(osize))
+				// the needle shared by the other keys is kept
+				if v.dedup.unref(ooffset) {
+					ooffsets[i] = ooffset
+				}
+				log.Warningf("same key: %d add a new needle, old offset: %d, old size: %d, new offset: %d, new size: %d", req.key, ooffset, osize, req.offset, req.size)
+			}
+		}
+		if v.versioned() {
+			// keep the old needle, del the expired version instead
+			ooffsets[i] = v.addVersion(req.key, req.offset, req.size, 0, time.Now().UnixNano())
+		}
+		v.queueDel(ooffsets[i])
+		seq = v.syncer.Advance(int64(req.size))
 	}
-	v.needles[key] = NewNeedleCache(offset, size)
+	// the lost version records only make the version time unknown
+	if verr := v.vfile.Flush(); verr != nil {
+		v.setIOError(verr)
+	}
+	v.mergeNeedles(false)
 	v.lock.Unlock()
-	if ok {
-		ooffset, osize = needleCache.Value()
-		log.Warningf("same key: %d add a new needle, old offset: %d, old size: %d, new offset: %d, new size: %d", key, ooffset, osize, offset, size)
-		// set old file delete
-		err = v.asyncDel(ooffset)
+	now = time.Now()
+	phases[tracePhaseIndex], last = now.Sub(last), now
+	// fsync before acknowledging if sync always, one fsync for all
+	if err = v.syncer.Commit(seq); err != nil {
+		v.setIOError(err)
+	}
+	now = time.Now()
+	phases[tracePhaseSync] = now.Sub(last)
+	for i, req := range reqs {
+		req.t.phases[tracePhaseIO] += phases[tracePhaseIO]
+		req.t.phases[tracePhaseFlush] += phases[tracePhaseFlush]
+		req.t.phases[tracePhaseIndex] += phases[tracePhaseIndex]
+		req.t.phases[tracePhaseSync] += phases[tracePhaseSync]
+		req.t.last = now
+		if req.err == nil && err != nil {
+			req.err = err
+		}
+		if req.err == nil && ooffsets[i] != NeedleCacheDelOffset {
+			// set old file delete
+			req.err = v.asyncDel(ooffsets[i])
+		}
+		req.done <- struct{}{}
 	}
-	return
 }
 
 // Write add a new needle, if key exists append to super block, then update
 // needle cache offset to new offset, Write is used for multi add needles.
 func (v *Volume) Write(key, cookie int64, data []byte) (err error) {
+	var (
+		dn  *dedupNeedle
+		sum = v.dedup.sum(data)
+	)
+	if dn = v.dedupFind(key, sum); dn != nil {
+		return v.writeAlias(key, cookie, dn)
+	}
+	e, edata := v.encode(data)
+	if edata, err = v.block.Seal(key, cookie, edata); err != nil {
+		return
+	}
+	return v.writeNeedle(key, cookie, e, edata, sum)
+}
+
+// dedupFind get the live needle of the data sum, the adds in compress
+// aren't deduped, since the aliases have no needle to compress, must called
+// with lock.
+func (v *Volume) dedupFind(key int64, sum *dedupSum) *dedupNeedle {
+	if v.compressing() {
+		return nil
+	}
+	return v.dedup.find(key, sum)
+}
+
+// writeFrom write the needle n of other volume as key and cookie, the data is
+// encoded by n.Encoding and sealed by key id, it's resealed if not the block
+// key or the needle key changed, the plain raw data is encoded by the volume
+// option.
+func (v *Volume) writeFrom(key, cookie int64, n *Needle, id uint16) (err error) {
+	var data []byte
+	if n.Encoding == NeedleEncodingNone && id == cryptNoKey {
+		return v.Write(key, cookie, n.Data)
+	}
+	if data, err = v.block.Reseal(id, n, key, cookie); err != nil {
+		return
+	}
+	return v.writeNeedle(key, cookie, n.Encoding, data, nil)
+}
+
+// writeNeedle write a needle which data is encoded by e and sealed by the
+// block key, the data sum is recorded if sum isn't nil.
+func (v *Volume) writeNeedle(key, cookie int64, e NeedleEncoding, data []byte, sum *dedupSum) (err error) {
 	var (
 		ok              bool
 		size, osize     int32
 		offset, ooffset uint32
 		needleCache     NeedleCache
 	)
-	needleCache, ok = v.needles[key]
+	needleCache, ok = v.needles.Get(key)
 	// add needle
-	if offset, size, err = v.block.Write(key, cookie, data); err != nil {
+	if offset, size, err = v.block.Write(key, cookie, e, data); err != nil {
 		return
 	}
 	log.V(1).Infof("add needle, offset: %d, size: %d", offset, size)
+	if sum != nil {
+		if _, err = v.dedup.add(key, offset, size, sum); err != nil {
+			return
+		}
+	}
 	// update index
 	if err = v.indexer.Write(key, offset, size); err != nil {
 		return
 	}
-	v.needles[key] = NewNeedleCache(offset, size)
+	v.setNeedle(key, NewNeedleCache(offset, size))
+	delete(v.deleted, key)
+	atomic.AddInt64(&v.liveBytes, int64(size))
+	v.syncer.Advance(int64(size))
 	if ok {
-		ooffset, osize = needleCache.Value()
+		if ooffset, osize = needleCache.Value(); ooffset != NeedleCacheDelOffset {
+			atomic.AddInt64(&v.liveBytes, -int64(osize))
+		}
 		log.Warningf("same key: %d add a new needle, old offset: %d, old size: %d, new offset: %d, new size: %d", key, ooffset, osize, offset, size)
+		// the needle shared by the other keys is kept
+		if !v.dedup.unref(ooffset) {
+			ooffset = NeedleCacheDelOffset
+		}
+	}
+	if v.versioned() {
+		// keep the old needle, del the expired version instead
+		ooffset = v.addVersion(key, offset, size, 0, time.Now().UnixNano())
+	}
+	v.mergeNeedles(false)
+	if ok || v.versioned() {
 		// set old file delete
+		v.queueDel(ooffset)
 		err = v.asyncDel(ooffset)
 	}
 	return
@@ -223,105 +1055,329 @@ func (v *Volume) Flush() (err error) {
 	if err = v.block.Flush(); err != nil {
 		return
 	}
-	err = v.indexer.Flush()
+	if err = v.dedup.Flush(); err != nil {
+		return
+	}
+	if err = v.vfile.Flush(); err != nil {
+		return
+	}
+	if err = v.indexer.Flush(); err != nil {
+		return
+	}
+	err = v.syncer.Commit(v.syncer.Advance(0))
+	return
+}
+
+// sync fsync the block and index file.
+func (v *Volume) sync() (err error) {
+	if err = v.block.Sync(); err != nil {
+		return
+	}
+	if err = v.dedup.Sync(); err != nil {
+		return
+	}
+	if err = v.vfile.Sync(); err != nil {
+		return
+	}
+	err = v.indexer.Sync()
 	return
 }
 
-// asyncDel signal the godel goroutine aync merge all offsets and del.
+// asyncDel signal the godel goroutine aync merge all offsets and del, if
+// the del goroutine is busy, update the flag synchronously.
 func (v *Volume) asyncDel(offset uint32) (err error) {
+	// already deleted
+	if offset == NeedleCacheDelOffset {
+		return
+	}
 	// async update super block flag
 	select {
 	case v.signal <- offset:
 	default:
-		log.Errorf("volume: %d send signal failed", v.Id)
-		err = ErrVolumeDel
+		log.Warningf("volume: %d del queue full, del offset: %d synchronously", v.Id, offset)
+		if err = v.delFlag(offset); err != nil {
+			v.setIOError(err)
+		}
+	}
+	return
+}
+
+// queueDel count a queued flag update of the needle at offset, so undelete
+// can cancel it, must called with lock.
+func (v *Volume) queueDel(offset uint32) {
+	if offset == NeedleCacheDelOffset {
+		return
 	}
+	v.dlock.Lock()
+	v.dels[offset]++
+	v.dlock.Unlock()
+}
+
+// delFlag update the flag of the needle at offset, it's skipped if the
+// queued update is canceled by undelete.
+func (v *Volume) delFlag(offset uint32) (err error) {
+	var n int
+	v.dlock.Lock()
+	if n = v.dels[offset]; n > 0 {
+		if n--; n == 0 {
+			delete(v.dels, offset)
+		} else {
+			v.dels[offset] = n
+		}
+		err = v.block.Del(offset)
+	}
+	v.dlock.Unlock()
 	return
 }
 
-// Del logical delete a needle, update disk needle flag and memory needle
-// cache offset to zero.
+// Del logical delete a needle, write a tombstone index, update memory needle
+// cache offset to zero and async update disk needle flag.
 func (v *Volume) Del(key int64) (err error) {
+	var t = newOpTrace(v.Id, volumeOpDel, key)
+	if err = v.diskError(); err == nil {
+		err = v.delete(key, t)
+	}
+	t.done(err)
+	return
+}
+
+// delete logical delete a needle.
+func (v *Volume) delete(key int64, t *opTrace) (err error) {
 	var (
 		ok          bool
+		seq         int64
 		size        int32
 		offset      uint32
 		needleCache NeedleCache
 	)
 	// get a needle, update the offset to del
 	v.lock.Lock()
-	needleCache, ok = v.needles[key]
-	if ok {
-		offset, size = needleCache.Value()
-		v.needles[key] = NewNeedleCache(NeedleCacheDelOffset, size)
-		// del barrier
-		if v.Compress {
-			v.compressKeys = append(v.compressKeys, key)
-		}
+	t.mark(tracePhaseLock)
+	if needleCache, ok = v.needles.Get(key); !ok {
+		v.lock.Unlock()
+		err = ErrNoNeedle
+		return
+	}
+	if offset, size = needleCache.Value(); offset == NeedleCacheDelOffset {
+		v.lock.Unlock()
+		return
 	}
+	// tombstone must be durable before the needle cache updated
+	err = v.indexer.Del(key, size)
+	t.mark(tracePhaseIndex)
+	if err != nil {
+		v.lock.Unlock()
+		v.setIOError(err)
+		return
+	}
+	v.setNeedle(key, NewNeedleCache(NeedleCacheDelOffset, size))
+	v.deleted[key] = delNeedle{offset: offset, size: size, time: time.Now().UnixNano()}
+	atomic.AddInt64(&v.liveBytes, -int64(size))
+	// del barrier
+	if v.compressing() {
+		v.compressKeys = append(v.compressKeys, key)
+	}
+	// the needle shared by the other keys is kept
+	if !v.dedup.unref(offset) {
+		offset = NeedleCacheDelOffset
+	}
+	v.queueDel(offset)
+	seq = v.syncer.Advance(indexSize)
+	v.mergeNeedles(false)
 	v.lock.Unlock()
-	if ok {
-		// async update super block flag
-		err = v.asyncDel(offset)
-	} else {
+	if err = v.syncer.Commit(seq); err != nil {
+		v.setIOError(err)
+		return
+	}
+	t.mark(tracePhaseSync)
+	// async update super block flag
+	err = v.asyncDel(offset)
+	return
+}
+
+// Undelete undelete a needle which hasn't been compressed away, the needle
+// flag is cleared in place and the index points the key at the needle again,
+// the flag updates of the needle queued before are canceled. it's rejected
+// in compress, since the needle may be copied as deleted.
+func (v *Volume) Undelete(key int64) (err error) {
+	var (
+		ok     bool
+		seq    int64
+		d      delNeedle
+		buf    []byte
+		needle = &Needle{}
+		t      = newOpTrace(v.Id, volumeOpUndel, key)
+	)
+	if err = v.diskError(); err != nil {
+		t.done(err)
+		return
+	}
+	v.lock.Lock()
+	t.mark(tracePhaseLock)
+	d, ok = v.deleted[key]
+	v.lock.Unlock()
+	if !ok {
+		err = ErrNoNeedle
+		t.done(err)
+		return
+	}
+	buf = make([]byte, d.size)
+	err = v.block.Get(d.offset, buf)
+	t.mark(tracePhaseIO)
+	if err != nil {
+		v.setIOError(err)
+		t.done(err)
+		return
+	}
+	if err = needle.ParseHeader(buf[:NeedleHeaderSize]); err == nil {
+		err = needle.ParseData(buf[NeedleHeaderSize:], v.block.Checksum)
+	}
+	t.mark(tracePhaseParse)
+	if err == nil && needle.Key != key {
+		// an alias of the needle
+		if _, ok = v.dedup.alias(key, d.offset); !ok {
+			err = ErrNeedleKey
+		}
+	}
+	if err != nil {
+		t.done(err)
+		return
+	}
+	v.lock.Lock()
+	// the key may be added or undeleted concurrently
+	if v.deleted[key] != d {
 		err = ErrNoNeedle
+	} else if v.compressing() {
+		err = ErrVolumeInCompress
+	} else if err = v.undelete(key, d); err == nil {
+		seq = v.syncer.Advance(indexSize)
+		v.mergeNeedles(false)
 	}
+	t.mark(tracePhaseIndex)
+	v.lock.Unlock()
+	if err == nil {
+		if err = v.syncer.Commit(seq); err != nil {
+			v.setIOError(err)
+		}
+		t.mark(tracePhaseSync)
+	}
+	log.Infof("volume: %d undelete key: %d error(%v)", v.Id, key, err)
+	t.done(err)
 	return
 }
 
-// del merge from volume signal, then update block needles flag.
-func (v *Volume) del() {
+// undelete clear the flag of the deleted needle d, then point the key at it,
+// the index is written synchronously like a tombstone, since there is no new
+// needle in the block to recover from, must called with lock.
+func (v *Volume) undelete(key int64, d delNeedle) (err error) {
+	// cancel the queued flag updates before clear the flag
+	v.dlock.Lock()
+	delete(v.dels, d.offset)
+	err = v.block.Undel(d.offset)
+	v.dlock.Unlock()
+	if err != nil {
+		v.setIOError(err)
+		return
+	}
+	if err = v.indexer.writeSync(key, d.offset, d.size); err != nil {
+		v.setIOError(err)
+		return
+	}
+	v.setNeedle(key, NewNeedleCache(d.offset, d.size))
+	delete(v.deleted, key)
+	atomic.AddInt64(&v.liveBytes, int64(d.size))
+	v.dedup.reref(d.offset)
+	return
+}
+
+// del merge from volume signal, then update block needles flag every tick,
+// the queued offsets are flushed before exit when the volume closed.
+func (v *Volume) del(tick time.Duration) {
 	var (
-		err     error
 		offset  uint32
+		flush   bool
 		offsets []uint32
+		ticker  = time.NewTicker(tick)
 	)
+	defer ticker.Stop()
 	log.V(1).Infof("start volume: %d del goroutine", v.Id)
+	defer close(v.delDone)
 	for {
 		select {
 		case offset = <-v.signal:
-			if offset == volumeFinish {
-				log.Info("signal volume del goroutine exit")
-				log.Errorf("volume del goroutine exit")
-				return
-			}
 			// merge
-			if offsets = append(offsets, offset); len(offsets) < volumeDelMax {
-				continue
+			offsets = append(offsets, offset)
+			flush = len(offsets) >= volumeDelMax
+		case <-ticker.C:
+			// the merged offsets never wait longer than a tick
+			flush = true
+		case <-v.closed:
+			for len(v.signal) > 0 {
+				offsets = append(offsets, <-v.signal)
 			}
-		case <-time.After(volumeDelTime):
+			v.delFlags(offsets)
+			log.Info("signal volume del goroutine exit")
+			atomic.StoreInt32(&v.delExit, 1)
+			return
 		}
-		if len(offsets) == 0 {
+		atomic.StoreInt64(&v.delTime, time.Now().UnixNano())
+		if !flush || len(offsets) == 0 {
 			continue
 		}
-		// sort let the disk seqence write
-		sort.Sort(Uint32Slice(offsets))
-		for _, offset = range offsets {
-			if err = v.block.Del(offset); err != nil {
-				break
-			}
-		}
+		v.delFlags(offsets)
+		atomic.StoreInt64(&v.delTime, time.Now().UnixNano())
 		offsets = offsets[:0]
 	}
-	return
+}
+
+// delFlags update the block needles flag of the merged offsets.
+func (v *Volume) delFlags(offsets []uint32) {
+	var (
+		err    error
+		offset uint32
+	)
+	// sort let the disk seqence write
+	sort.Sort(Uint32Slice(offsets))
+	for _, offset = range offsets {
+		if err = v.delFlag(offset); err != nil {
+			v.setIOError(err)
+			break
+		}
+	}
 }
 
 // Compress copy the super block to another space, and drop the "delete"
 // needle, so this can reduce disk space cost.
 func (v *Volume) StartCompress(nv *Volume) (err error) {
+	var offset int64
 	v.lock.Lock()
-	if v.Compress {
+	if v.compressing() {
 		err = ErrVolumeInCompress
 	} else {
-		v.Compress = true
+		atomic.StoreInt32(&v.compress, 1)
 	}
 	v.lock.Unlock()
 	if err == nil {
-		v.compressOffset, err = v.block.Compress(v.compressOffset, nv)
+		offset, err = v.block.compress(v.compressOffset, nv, func(n *Needle, offset uint32) (err error) {
+			v.lock.Lock()
+			keep, dtime, ver := v.compressKeep(n, offset)
+			sum, aliases := v.dedupAliases(offset)
+			v.lock.Unlock()
+			if err = nv.compressWrite(n, v.block.KeyId, keep, dtime, ver); err == nil && sum != nil {
+				err = nv.compressAliases(n, v.block.KeyId, keep && dtime == 0, sum, aliases)
+			}
+			return
+		})
+		atomic.StoreInt64(&v.compressOffset, offset)
 	}
 	return
 }
 
+// compressing check the volume is in compress.
+func (v *Volume) compressing() bool {
+	return atomic.LoadInt32(&v.compress) == 1
+}
+
 // StopCompress try append left block space and deleted needles when
 // compressing, then reset compress flag, offset and compressKeys.
 // if nv is nil, only reset compress status.
@@ -329,29 +1385,211 @@ func (v *Volume) StopCompress(nv *Volume) (err error) {
 	var key int64
 	v.lock.Lock()
 	if nv != nil {
-		if v.compressOffset, err = v.block.Compress(v.compressOffset, nv); err != nil {
+		if _, err = v.block.compress(v.compressOffset, nv, func(n *Needle, offset uint32) (err error) {
+			keep, dtime, ver := v.compressKeep(n, offset)
+			sum, aliases := v.dedupAliases(offset)
+			if err = nv.compressWrite(n, v.block.KeyId, keep, dtime, ver); err == nil && sum != nil {
+				err = nv.compressAliases(n, v.block.KeyId, keep && dtime == 0, sum, aliases)
+			}
+			return
+		}); err != nil {
 			goto failed
 		}
 		for _, key = range v.compressKeys {
-			if err = nv.Del(key); err != nil {
+			// the needle may be dropped by compress
+			if err = nv.Del(key); err != nil && err != ErrNoNeedle {
 				goto failed
 			}
 		}
+		if err = nv.compactVersions(); err != nil {
+			goto failed
+		}
 	}
 failed:
-	v.Compress = false
-	v.compressOffset = 0
+	atomic.StoreInt32(&v.compress, 0)
+	atomic.StoreInt64(&v.compressOffset, 0)
 	v.compressKeys = v.compressKeys[:0]
 	v.lock.Unlock()
 	return
 }
 
+// compressKeep check the needle at offset is kept by compress, the deleted
+// needles are dropped unless they are in the retention window, dtime is the
+// deleted time of a kept deleted needle, ver is the version of needle if
+// the volume is versioned, must called with lock.
+func (v *Volume) compressKeep(n *Needle, offset uint32) (keep bool, dtime int64, ver needleVersion) {
+	var (
+		ok bool
+		d  delNeedle
+	)
+	if v.versioned() {
+		if ver, ok = v.compressVersion(n.Key, offset); !ok {
+			return
+		}
+	}
+	// the flag may be not updated yet
+	if d, ok = v.deleted[n.Key]; ok && d.offset == offset {
+		if v.options.Retention > 0 && time.Since(time.Unix(0, d.time)) < v.options.Retention {
+			keep, dtime = true, d.time
+		}
+		return
+	}
+	// the needle shared by the aliases isn't flagged when its key overwritten
+	if v.dedup.shared(offset) {
+		noffset, _ := v.needleValue(n.Key)
+		keep = noffset == offset
+		return
+	}
+	// the tombstone may be merged into the sorted file before the flag
+	// updated, so it's not replayed
+	if _, ok = v.needles.(*DiskNeedleMap); ok {
+		if offset, _ = v.needleValue(n.Key); offset == NeedleCacheDelOffset {
+			return
+		}
+	}
+	keep = n.Flag != NeedleStatusDel
+	return
+}
+
+// compressWrite write a compressed needle, the data is sealed by key id, if
+// dtime isn't zero, the needle is kept deleted, if ver isn't zero, the needle
+// keep the version.
+func (v *Volume) compressWrite(n *Needle, id uint16, keep bool, dtime int64, ver needleVersion) (err error) {
+	var (
+		size   int32
+		offset uint32
+	)
+	if !keep {
+		return
+	}
+	// multi append, the key rotated by the new volume
+	if err = v.writeFrom(n.Key, n.Cookie, n, id); err != nil {
+		return
+	}
+	if ver.num > 0 && v.versioned() {
+		v.setVersion(n.Key, ver)
+	}
+	if dtime == 0 {
+		return
+	}
+	offset, size = v.needleValue(n.Key)
+	if err = v.indexer.Del(n.Key, size); err != nil {
+		return
+	}
+	v.setNeedle(n.Key, NewNeedleCache(NeedleCacheDelOffset, size))
+	v.deleted[n.Key] = delNeedle{offset: offset, size: size, time: dtime}
+	atomic.AddInt64(&v.liveBytes, -int64(size))
+	return
+}
+
+// setIOError record the disk io error, used by health check.
+func (v *Volume) setIOError(err error) {
+	if !isIOError(err) {
+		return
+	}
+	log.Errorf("volume: %d io error(%v)", v.Id, err)
+	// fail all the volumes on the disk, cleared if the disk probe ok
+	if v.disk != nil {
+		v.disk.Fail(err)
+		return
+	}
+	v.hlock.Lock()
+	v.ioErr = err
+	v.hlock.Unlock()
+}
+
+// diskError get the disk failed error of the volume.
+func (v *Volume) diskError() error {
+	if v.disk == nil {
+		return nil
+	}
+	return v.disk.Error()
+}
+
+// Health check the volume disk, index and del goroutine.
+func (v *Volume) Health() (err error) {
+	var delTime time.Time
+	v.hlock.Lock()
+	err = v.ioErr
+	v.hlock.Unlock()
+	if err != nil {
+		return
+	}
+	if err = v.diskError(); err != nil {
+		return
+	}
+	if dm, ok := v.needles.(*DiskNeedleMap); ok {
+		v.lock.Lock()
+		err = dm.Error()
+		v.lock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	if !v.indexer.Alive() {
+		return ErrIndexerExit
+	}
+	if atomic.LoadInt32(&v.delExit) == 1 {
+		return ErrVolumeDelExit
+	}
+	// del goroutine wakes up at least every volumeDelTime
+	delTime = time.Unix(0, atomic.LoadInt64(&v.delTime))
+	if time.Since(delTime) > 2*volumeDelTime {
+		return ErrVolumeDelWedged
+	}
+	return
+}
+
+// VolumeStat the volume state.
+type VolumeStat struct {
+	Needles       int
+	LiveBytes     int64
+	BlockBytes    int64
+	RingUsed      int
+	RingFull      int64
+	DelQueue      int
+	AddQueue      int
+	AddBatches    int64
+	Compress      bool
+	CompressBytes int64
+}
+
+// Stat get the volume state, the counters are read atomically without the
+// volume lock, so a scrape never stalls the writers.
+func (v *Volume) Stat() (st VolumeStat) {
+	v.nlock.RLock()
+	st.Needles = v.needles.Len()
+	v.nlock.RUnlock()
+	st.LiveBytes = atomic.LoadInt64(&v.liveBytes)
+	st.BlockBytes = BlockOffset(v.block.Offset()) - superBlockHeaderOffset
+	st.RingUsed = v.indexer.ring.Len()
+	st.RingFull = v.indexer.Full()
+	st.DelQueue = len(v.signal)
+	st.AddQueue = len(v.addCh)
+	st.AddBatches = atomic.LoadInt64(&v.batches)
+	st.Compress = v.compressing()
+	if offset := atomic.LoadInt64(&v.compressOffset); offset > 0 {
+		st.CompressBytes = offset - superBlockHeaderOffset
+	}
+	return
+}
+
 // Close close the volume.
 func (v *Volume) Close() {
+	close(v.closed)
+	<-v.writeExit
+	// the del goroutine stops before the block closed
+	<-v.delDone
+	v.syncer.Close()
 	v.lock.Lock()
+	v.mergeNeedles(true)
 	v.block.Close()
 	v.indexer.Close()
-	close(v.signal)
+	if dm, ok := v.needles.(*DiskNeedleMap); ok {
+		dm.Close()
+	}
+	v.dedup.Close()
+	v.vfile.Close()
 	v.lock.Unlock()
 	return
 }
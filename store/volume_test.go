@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"fmt"
 	mrand "math/rand"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestVolume(t *testing.T) {
@@ -22,7 +26,7 @@ func TestVolume(t *testing.T) {
 	defer os.Remove(bfile)
 	defer os.Remove(ifile)
 	t.Log("NewVolume()")
-	if v, err = NewVolume(1, bfile, ifile); err != nil {
+	if v, err = NewVolume(1, bfile, ifile, nil); err != nil {
 		t.Errorf("NewVolume() error(%v)", err)
 		goto failed
 	}
@@ -36,7 +40,7 @@ func TestVolume(t *testing.T) {
 		t.Errorf("Add() error(%v)", err)
 		goto failed
 	}
-	if o, s := v.needles[1].Value(); o != 6 && s != 40 {
+	if o, s := v.needleValue(1); o != 6 && s != 40 {
 		err = fmt.Errorf("needle.Value(1) not match")
 		t.Error(err)
 		goto failed
@@ -87,7 +91,7 @@ func TestVolume(t *testing.T) {
 	t.Log("StartCompress")
 	defer os.Remove(nbfile)
 	defer os.Remove(nifile)
-	if nv, err = NewVolume(1, nbfile, nifile); err != nil {
+	if nv, err = NewVolume(1, nbfile, nifile, nil); err != nil {
 		t.Errorf("NewVolume() error(%v)", err)
 		goto failed
 	}
@@ -145,10 +149,393 @@ failed:
 	}
 }
 
+func TestVolumeDelRecovery(t *testing.T) {
+	var (
+		v      *Volume
+		err    error
+		offset uint32
+		data   = []byte("test")
+		buf    = make([]byte, 40)
+		n      = &Needle{}
+		bfile  = "./test/test.volume.del"
+		ifile  = "./test/test.volume.del.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	if v, err = NewVolume(1, bfile, ifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(1, 1, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(2, 2, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	offset, _ = v.needleValue(1)
+	t.Log("Del(1)")
+	if err = v.Del(1); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	// crash before the del goroutine update the flag
+	v.Close()
+	t.Log("Recovery")
+	if v, err = NewVolume(1, bfile, ifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if _, err = v.Get(1, 1, buf); err != ErrNeedleDeleted {
+		err = fmt.Errorf("Get(1) must be ErrNeedleDeleted")
+		t.Error(err)
+		goto failed
+	}
+	if _, err = v.Get(2, 2, buf); err != nil {
+		t.Errorf("Get(2) error(%v)", err)
+		goto failed
+	}
+	// the tombstone replayed to the super block flag
+	if err = v.block.Get(offset, buf); err != nil {
+		t.Errorf("block.Get() error(%v)", err)
+		goto failed
+	}
+	if err = n.ParseHeader(buf[:NeedleHeaderSize]); err != nil {
+		t.Errorf("ParseHeader() error(%v)", err)
+		goto failed
+	}
+	if n.Flag != NeedleStatusDel {
+		err = fmt.Errorf("needle flag: %d not match", n.Flag)
+		t.Error(err)
+		goto failed
+	}
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestVolumeDelTicker(t *testing.T) {
+	var (
+		i      int64
+		v      *Volume
+		err    error
+		offset uint32
+		data   = []byte("test")
+		buf    = make([]byte, 40)
+		n      = &Needle{}
+		bfile  = "./test/test.volume.tick"
+		ifile  = "./test/test.volume.tick.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	defer func(d time.Duration) { volumeDelTime = d }(volumeDelTime)
+	volumeDelTime = 100 * time.Millisecond
+	if v, err = NewVolume(1, bfile, ifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	for i = 1; i <= 30; i++ {
+		if err = v.Add(i, i, data); err != nil {
+			t.Errorf("Add() error(%v)", err)
+			goto failed
+		}
+	}
+	offset, _ = v.needleValue(1)
+	// deletes more frequent than the tick, never a full batch
+	for i = 1; i <= 30; i++ {
+		if err = v.Del(i); err != nil {
+			t.Errorf("Del() error(%v)", err)
+			goto failed
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err = v.Health(); err != nil {
+		t.Errorf("Health() error(%v)", err)
+		goto failed
+	}
+	// the merged offsets flushed by the tick
+	if err = v.block.Get(offset, buf); err != nil {
+		t.Errorf("block.Get() error(%v)", err)
+		goto failed
+	}
+	if err = n.ParseHeader(buf[:NeedleHeaderSize]); err != nil {
+		t.Errorf("ParseHeader() error(%v)", err)
+		goto failed
+	}
+	if n.Flag != NeedleStatusDel {
+		err = fmt.Errorf("needle flag: %d not match", n.Flag)
+		t.Error(err)
+		goto failed
+	}
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+func TestVolumeUndelete(t *testing.T) {
+	var (
+		v, nv, nv1  *Volume
+		err         error
+		offset, end uint32
+		data        = []byte("test")
+		buf         = make([]byte, 40)
+		n           = &Needle{}
+		o           = &VolumeOptions{Retention: time.Hour}
+		bfile       = "./test/test.volume.undel"
+		ifile       = "./test/test.volume.undel.idx"
+		nbfile      = "./test/testn.volume.undel"
+		nifile      = "./test/testn.volume.undel.idx"
+		n1bfile     = "./test/testn1.volume.undel"
+		n1ifile     = "./test/testn1.volume.undel.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	defer os.Remove(nbfile)
+	defer os.Remove(nifile)
+	defer os.Remove(n1bfile)
+	defer os.Remove(n1ifile)
+	// the queued flag update is flushed by the tick
+	defer func(d time.Duration) { volumeDelTime = d }(volumeDelTime)
+	volumeDelTime = 100 * time.Millisecond
+	if v, err = NewVolume(1, bfile, ifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(1, 1, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	if err = v.Add(2, 2, data); err != nil {
+		t.Errorf("Add() error(%v)", err)
+		goto failed
+	}
+	t.Log("Undelete(1)")
+	if err = v.Undelete(1); err != ErrNoNeedle {
+		err = fmt.Errorf("Undelete() not deleted must be ErrNoNeedle")
+		t.Error(err)
+		goto failed
+	}
+	offset, _ = v.needleValue(1)
+	if err = v.Del(1); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	end = v.block.offset
+	if err = v.Undelete(1); err != nil {
+		t.Errorf("Undelete() error(%v)", err)
+		goto failed
+	}
+	if o, _ := v.needleValue(1); o != offset || v.block.offset != end {
+		err = fmt.Errorf("Undelete() offset: %d, block offset: %d not in place", o, v.block.offset)
+		t.Error(err)
+		goto failed
+	}
+	// the canceled flag update
+	time.Sleep(3 * volumeDelTime)
+	if err = testVolumeUndelete(v, offset, buf, data, n); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Recovery")
+	v.Close()
+	if v, err = NewVolume(1, bfile, ifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	// the tombstone isn't replayed
+	if err = testVolumeUndelete(v, offset, buf, data, n); err != nil {
+		t.Error(err)
+		goto failed
+	}
+	t.Log("Compress in retention")
+	if err = v.Del(1); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	if nv, err = NewVolume(1, nbfile, nifile, o); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = v.StartCompress(nv); err != nil {
+		t.Errorf("StartCompress() error(%v)", err)
+		goto failed
+	}
+	if err = v.StopCompress(nv); err != nil {
+		t.Errorf("StopCompress() error(%v)", err)
+		goto failed
+	}
+	if _, err = nv.Get(1, 1, buf); err != ErrNeedleDeleted {
+		err = fmt.Errorf("Get(1) must be ErrNeedleDeleted")
+		t.Error(err)
+		goto failed
+	}
+	if err = nv.Undelete(1); err != nil {
+		t.Errorf("Undelete() error(%v)", err)
+		goto failed
+	}
+	if _, err = nv.Get(1, 1, buf); err != nil {
+		t.Errorf("Get(1) error(%v)", err)
+		goto failed
+	}
+	t.Log("Compress out of retention")
+	if err = nv.Del(2); err != nil {
+		t.Errorf("Del() error(%v)", err)
+		goto failed
+	}
+	nv.options = &VolumeOptions{}
+	if nv1, err = NewVolume(1, n1bfile, n1ifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	if err = nv.StartCompress(nv1); err != nil {
+		t.Errorf("StartCompress() error(%v)", err)
+		goto failed
+	}
+	if err = nv.StopCompress(nv1); err != nil {
+		t.Errorf("StopCompress() error(%v)", err)
+		goto failed
+	}
+	// the flag may be not updated, the deleted needle mustn't be compressed
+	if _, err = nv1.Get(2, 2, buf); err != ErrNoNeedle {
+		err = fmt.Errorf("Get(2) must be ErrNoNeedle")
+		t.Error(err)
+		goto failed
+	}
+	if err = nv1.Undelete(2); err != ErrNoNeedle {
+		err = fmt.Errorf("Undelete() compressed must be ErrNoNeedle")
+		t.Error(err)
+		goto failed
+	}
+	err = nil
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if nv != nil {
+		nv.Close()
+	}
+	if nv1 != nil {
+		nv1.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+// testVolumeUndelete check the needle 1 undeleted at offset.
+func testVolumeUndelete(v *Volume, offset uint32, buf, data []byte, n *Needle) (err error) {
+	var d []byte
+	if d, err = v.Get(1, 1, buf); err != nil || !bytes.Equal(d, data) {
+		return fmt.Errorf("Get(1) error(%v) not match", err)
+	}
+	if err = v.block.Get(offset, buf); err != nil {
+		return fmt.Errorf("block.Get() error(%v)", err)
+	}
+	if err = n.ParseHeader(buf[:NeedleHeaderSize]); err != nil {
+		return fmt.Errorf("ParseHeader() error(%v)", err)
+	}
+	if n.Flag != NeedleStatusOK {
+		return fmt.Errorf("needle flag: %d not match", n.Flag)
+	}
+	return
+}
+
 var (
 	t int64
 )
 
+// TestVolumeAddBatch queue the adds while the write goroutine is blocked,
+// they must be written in one batch and every caller get its own result.
+func TestVolumeAddBatch(t *testing.T) {
+	var (
+		v       *Volume
+		err     error
+		i       int
+		batches int64
+		wg      sync.WaitGroup
+		n       = 64
+		errs    = make([]error, n)
+		buf     = make([]byte, 40)
+		bfile   = "./test/test.batch"
+		ifile   = "./test/test.batch.idx"
+	)
+	defer os.Remove(bfile)
+	defer os.Remove(ifile)
+	if v, err = NewVolume(1, bfile, ifile, nil); err != nil {
+		t.Errorf("NewVolume() error(%v)", err)
+		goto failed
+	}
+	t.Log("block the write goroutine")
+	v.lock.Lock()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := v.Add(0, 0, []byte("block")); err != nil {
+			t.Errorf("Add(0) error(%v)", err)
+		}
+	}()
+	// the write goroutine take the add then wait the lock
+	time.Sleep(100 * time.Millisecond)
+	batches = atomic.LoadInt64(&v.batches)
+	for i = 1; i <= n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i-1] = v.Add(int64(i), int64(i), []byte(fmt.Sprintf("test%d", i)))
+		}(i)
+	}
+	for len(v.addCh) < n {
+		time.Sleep(time.Millisecond)
+	}
+	v.lock.Unlock()
+	wg.Wait()
+	if batches = v.Stat().AddBatches - batches; batches != 1 {
+		t.Errorf("%d adds written in %d batches", n, batches)
+		err = fmt.Errorf("batch not merged")
+		goto failed
+	}
+	for i = 1; i <= n; i++ {
+		if errs[i-1] != nil {
+			t.Errorf("Add(%d) error(%v)", i, errs[i-1])
+			err = errs[i-1]
+			goto failed
+		}
+		if err = testVolumeData(v, int64(i), buf, []byte(fmt.Sprintf("test%d", i))); err != nil {
+			t.Error(err)
+			goto failed
+		}
+	}
+	err = nil
+failed:
+	if v != nil {
+		v.Close()
+	}
+	if err != nil {
+		t.FailNow()
+	}
+}
+
+// testVolumeData check the key data.
+func testVolumeData(v *Volume, key int64, buf, data []byte) (err error) {
+	var d []byte
+	if d, err = v.Get(key, key, buf); err != nil {
+		return fmt.Errorf("Get(%d) error(%v)", key, err)
+	}
+	if !bytes.Equal(d, data) {
+		return fmt.Errorf("Get(%d) data: %s not match", key, d)
+	}
+	return
+}
+
 func BenchmarkVolumeAdd(b *testing.B) {
 	var (
 		v     *Volume
@@ -163,7 +550,7 @@ func BenchmarkVolumeAdd(b *testing.B) {
 		b.Errorf("rand.Read() error(%v)", err)
 		b.FailNow()
 	}
-	if v, err = NewVolume(1, file, ifile); err != nil {
+	if v, err = NewVolume(1, file, ifile, nil); err != nil {
 		b.Errorf("NewVolume() error(%v)", err)
 		b.FailNow()
 	}
@@ -177,6 +564,110 @@ func BenchmarkVolumeAdd(b *testing.B) {
 	}
 }
 
+func BenchmarkVolumeAddParallel(b *testing.B) {
+	var (
+		v     *Volume
+		err   error
+		key   int64
+		file  = "./test/testb5"
+		ifile = "./test/testb5.idx"
+		data  = make([]byte, 1*1024)
+	)
+	defer os.Remove(file)
+	defer os.Remove(ifile)
+	if _, err = rand.Read(data); err != nil {
+		b.Errorf("rand.Read() error(%v)", err)
+		b.FailNow()
+	}
+	if v, err = NewVolume(1, file, ifile, nil); err != nil {
+		b.Errorf("NewVolume() error(%v)", err)
+		b.FailNow()
+	}
+	defer v.Close()
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			k := atomic.AddInt64(&key, 1)
+			if err := v.Add(k, k, data); err != nil {
+				b.Errorf("Add() error(%v)", err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkVolumeGetWithAdd get needles while the writers add big needles
+// at a fixed rate, the readers must not wait for the writers io.
+func BenchmarkVolumeGetWithAdd(b *testing.B) {
+	var (
+		i     int64
+		adds  int64
+		v     *Volume
+		err   error
+		wg    sync.WaitGroup
+		keys  = int64(100000)
+		file  = "./test/testb7"
+		ifile = "./test/testb7.idx"
+		data  = make([]byte, 1*1024)
+		wdata = make([]byte, 64*1024)
+		done  = make(chan struct{})
+	)
+	defer os.Remove(file)
+	defer os.Remove(ifile)
+	if _, err = rand.Read(data); err != nil {
+		b.Errorf("rand.Read() error(%v)", err)
+		b.FailNow()
+	}
+	if v, err = NewVolume(1, file, ifile, nil); err != nil {
+		b.Errorf("NewVolume() error(%v)", err)
+		b.FailNow()
+	}
+	defer v.Close()
+	for i = 0; i < keys; i++ {
+		if err = v.Add(i, i, data); err != nil {
+			b.Errorf("Add() error(%v)", err)
+			b.FailNow()
+		}
+	}
+	// writers
+	for i = 0; i < 4; i++ {
+		wg.Add(1)
+		go func(key int64) {
+			var tk = time.NewTicker(4 * time.Millisecond)
+			defer wg.Done()
+			defer tk.Stop()
+			for ; ; key += 4 {
+				select {
+				case <-done:
+					return
+				case <-tk.C:
+				}
+				if err := v.Add(key, key, wdata); err != nil {
+					b.Errorf("Add() error(%v)", err)
+					return
+				}
+				atomic.AddInt64(&adds, 1)
+			}
+		}(keys + i)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var buf = make([]byte, NeedleMaxSize)
+		for pb.Next() {
+			t1 := mrand.Int63n(keys)
+			if _, err := v.Get(t1, t1, buf); err != nil {
+				b.Errorf("Get(%d) error(%v)", t1, err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	close(done)
+	wg.Wait()
+	b.ReportMetric(float64(atomic.LoadInt64(&adds))/float64(b.N), "adds/op")
+}
+
 func BenchmarkVolumeWrite(b *testing.B) {
 	var (
 		i     int
@@ -193,7 +684,7 @@ func BenchmarkVolumeWrite(b *testing.B) {
 		b.Errorf("rand.Read() error(%v)", err)
 		goto failed
 	}
-	if v, err = NewVolume(1, file, ifile); err != nil {
+	if v, err = NewVolume(1, file, ifile, nil); err != nil {
 		b.Errorf("NewVolume() error(%v)", err)
 		goto failed
 	}
@@ -219,6 +710,18 @@ failed:
 }
 
 func BenchmarkVolumeGet(b *testing.B) {
+	benchmarkVolumeGet(b, nil)
+}
+
+func BenchmarkVolumeGetCompact(b *testing.B) {
+	benchmarkVolumeGet(b, &VolumeOptions{NeedleMap: NeedleMapCompact})
+}
+
+func BenchmarkVolumeGetMmap(b *testing.B) {
+	benchmarkVolumeGet(b, &VolumeOptions{Mmap: true})
+}
+
+func benchmarkVolumeGet(b *testing.B, o *VolumeOptions) {
 	var (
 		i     int
 		t     int64
@@ -234,7 +737,7 @@ func BenchmarkVolumeGet(b *testing.B) {
 		b.Errorf("rand.Read() error(%v)", err)
 		b.FailNow()
 	}
-	if v, err = NewVolume(1, file, ifile); err != nil {
+	if v, err = NewVolume(1, file, ifile, o); err != nil {
 		b.Errorf("NewVolume() error(%v)", err)
 		b.FailNow()
 	}
@@ -253,7 +756,7 @@ func BenchmarkVolumeGet(b *testing.B) {
 			t1 := mrand.Int63n(1000000)
 			if _, err := v.Get(t1, t1, buf); err != nil {
 				b.Errorf("Get(%d) error(%v)", t1, err)
-				b.FailNow()
+				return
 			}
 		}
 	})